@@ -2,12 +2,14 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"os"
 	"os/signal"
 	"syscall"
 
+	"github.com/wilriker/librfm/v2"
 	"github.com/wilriker/rfm/commands"
 )
 
@@ -20,21 +22,65 @@ func main() {
 	var err error
 	switch os.Args[1] {
 	case "backup":
-		err = commands.DoBackup(ctx, os.Args[2:])
+		err = commands.DoBackup(ctx, nil, os.Args[2:])
 	case "upload":
-		err = commands.DoUpload(ctx, os.Args[2:])
+		err = commands.DoUpload(ctx, nil, os.Args[2:])
 	case "mkdir":
-		err = commands.DoMkdir(ctx, os.Args[2:])
+		err = commands.DoMkdir(ctx, nil, os.Args[2:])
 	case "mv":
-		err = commands.DoMv(ctx, os.Args[2:])
+		err = commands.DoMv(ctx, nil, os.Args[2:])
 	case "rm":
-		err = commands.DoRm(ctx, os.Args[2:])
+		err = commands.DoRm(ctx, nil, os.Args[2:])
+	case "trash":
+		err = commands.DoTrash(ctx, nil, os.Args[2:])
 	case "download":
-		err = commands.DoDownload(ctx, os.Args[2:])
+		err = commands.DoDownload(ctx, nil, os.Args[2:])
 	case "fileinfo":
-		err = commands.DoFileinfo(ctx, os.Args[2:])
+		err = commands.DoFileinfo(ctx, nil, os.Args[2:])
 	case "ls":
-		err = commands.DoLs(ctx, os.Args[2:])
+		err = commands.DoLs(ctx, nil, os.Args[2:])
+	case "verify":
+		err = commands.DoVerify(ctx, nil, os.Args[2:])
+	case "gcode":
+		err = commands.DoGcode(ctx, nil, os.Args[2:])
+	case "console":
+		err = commands.DoConsole(ctx, nil, os.Args[2:])
+	case "print":
+		err = commands.DoPrint(ctx, nil, os.Args[2:])
+	case "pause":
+		err = commands.DoPause(ctx, nil, os.Args[2:])
+	case "resume":
+		err = commands.DoResume(ctx, nil, os.Args[2:])
+	case "cancel":
+		err = commands.DoCancel(ctx, nil, os.Args[2:])
+	case "status":
+		err = commands.DoStatus(ctx, nil, os.Args[2:])
+	case "model":
+		err = commands.DoModel(ctx, nil, os.Args[2:])
+	case "firmware":
+		err = commands.DoFirmware(ctx, nil, os.Args[2:])
+	case "volumes":
+		err = commands.DoVolumes(ctx, nil, os.Args[2:])
+	case "mount":
+		err = commands.DoMount(ctx, nil, os.Args[2:])
+	case "unmount":
+		err = commands.DoUnmount(ctx, nil, os.Args[2:])
+	case "fuse":
+		err = commands.DoFuse(ctx, nil, os.Args[2:])
+	case "plan":
+		err = commands.DoPlan(ctx, nil, os.Args[2:])
+	case "apply":
+		err = commands.DoApply(ctx, nil, os.Args[2:])
+	case "render":
+		err = commands.DoRender(ctx, nil, os.Args[2:])
+	case "run":
+		err = commands.DoRun(ctx, os.Args[2:])
+	case "daemon":
+		err = commands.DoDaemon(ctx, os.Args[2:])
+	case "serve-webdav":
+		err = commands.DoServeWebdav(ctx, nil, os.Args[2:])
+	case "proxy":
+		err = commands.DoProxy(ctx, nil, os.Args[2:])
 	case "help":
 		if len(os.Args) > 2 {
 			commands.PrintHelp(os.Args[2:], 0)
@@ -43,6 +89,13 @@ func main() {
 	default:
 		err = fmt.Errorf("Unknown command: %s", os.Args[1])
 	}
+	if errors.Is(err, commands.ErrUnavailable) {
+		log.Println("Duet currently not available")
+		os.Exit(0)
+	}
+	if errors.Is(err, librfm.ErrDriveNotMounted) {
+		err = fmt.Errorf("%w. Use \"rfm volumes\" to list volumes and \"rfm mount <volume>\" to mount one", err)
+	}
 	if err != nil {
 		log.Fatal(err)
 	}
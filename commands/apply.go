@@ -0,0 +1,400 @@
+package commands
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pelletier/go-toml"
+	"github.com/wilriker/librfm/v2"
+	"github.com/wilriker/rfm"
+)
+
+// actionKind is the kind of change of a planAction
+type actionKind int
+
+const (
+	actionMkdir actionKind = iota
+	actionCreate
+	actionUpdate
+	actionDelete
+)
+
+func (k actionKind) String() string {
+	switch k {
+	case actionMkdir:
+		return "+ mkdir"
+	case actionCreate:
+		return "+ upload"
+	case actionUpdate:
+		return "~ upload"
+	case actionDelete:
+		return "- delete"
+	}
+	return fmt.Sprintf("action %d", int(k))
+}
+
+// provisionManifest declares the desired state of a device
+type provisionManifest struct {
+	// Dirs are directories that have to exist
+	Dirs []string `toml:"dirs"`
+	// Absent are files or directories that must not exist
+	Absent []string `toml:"absent"`
+	// Files are files that have to exist with the given content
+	Files []provisionFile `toml:"files"`
+}
+
+// provisionFile is a file with its content either taken from a local file
+// or given inline
+type provisionFile struct {
+	Path    string `toml:"path"`
+	Source  string `toml:"source"`
+	Content string `toml:"content"`
+}
+
+// readProvisionManifest reads a manifest and validates its entries. Sources
+// are relative to the directory of the manifest.
+func readProvisionManifest(manifestPath string) (*provisionManifest, error) {
+	f, err := os.Open(manifestPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	m := &provisionManifest{}
+	if err = toml.NewDecoder(f).Decode(m); err != nil {
+		return nil, err
+	}
+	for i, d := range m.Dirs {
+		m.Dirs[i] = rfm.CleanRemotePath(d)
+	}
+	for i, a := range m.Absent {
+		m.Absent[i] = rfm.CleanRemotePath(a)
+	}
+	for i, file := range m.Files {
+		if file.Path == "" {
+			return nil, fmt.Errorf("File %d in %s has no path", i+1, manifestPath)
+		}
+		if (file.Source == "") == (file.Content == "") {
+			return nil, fmt.Errorf("%s in %s needs either source or content", file.Path, manifestPath)
+		}
+		m.Files[i].Path = rfm.CleanRemotePath(file.Path)
+		if file.Source != "" && !filepath.IsAbs(file.Source) {
+			m.Files[i].Source = filepath.Join(filepath.Dir(manifestPath), file.Source)
+		}
+	}
+	return m, nil
+}
+
+// planAction is a single change necessary to reach the state of a manifest
+type planAction struct {
+	action  actionKind
+	path    string
+	content []byte
+	oldSize uint64
+	isDir   bool
+}
+
+func (a planAction) String() string {
+	switch a.action {
+	case actionCreate:
+		return fmt.Sprintf("%-8s %s (%s)", a.action, a.path, humanSize(uint64(len(a.content))))
+	case actionUpdate:
+		return fmt.Sprintf("%-8s %s (%s, was %s)", a.action, a.path, humanSize(uint64(len(a.content))), humanSize(a.oldSize))
+	}
+	return fmt.Sprintf("%-8s %s", a.action, a.path)
+}
+
+// ApplyOptions holds the specific parameters for plan and apply
+type ApplyOptions struct {
+	*BaseOptions
+	manifestPath   string
+	assumeYes      bool
+	forceProtected bool
+}
+
+// Check checks all parameters for valid values
+func (a *ApplyOptions) Check() error {
+	if err := a.BaseOptions.Check(); err != nil {
+		return err
+	}
+
+	if a.manifestPath == "" {
+		return errors.New("<manifest.toml> is mandatory")
+	}
+	a.manifestPath = rfm.GetAbsPath(a.manifestPath)
+	return nil
+}
+
+// InitApplyOptions initializes a ApplyOptions instance from command-line parameters
+func InitApplyOptions(ctx context.Context, session *BaseOptions, arguments []string) (*ApplyOptions, error) {
+	a := ApplyOptions{BaseOptions: &BaseOptions{session: session}}
+
+	fs := a.GetFlagSet()
+	fs.BoolVar(&a.assumeYes, "y", false, "Apply without asking for confirmation")
+	fs.BoolVar(&a.forceProtected, "force-protected", false, "Also modify paths protected by the config")
+	if err := fs.Parse(arguments); err != nil {
+		return nil, err
+	}
+
+	if fs.NArg() > 0 {
+		a.manifestPath = fs.Arg(0)
+	}
+
+	if err := a.Check(); err != nil {
+		return nil, err
+	}
+
+	if err := a.Connect(ctx); err != nil {
+		return nil, err
+	}
+
+	return &a, nil
+}
+
+// DoPlan is a convenience function to run plan from command-line parameters
+func DoPlan(ctx context.Context, session *BaseOptions, arguments []string) error {
+	ao, err := InitApplyOptions(ctx, session, arguments)
+	if err != nil {
+		return err
+	}
+	return NewApply(ao).Plan(ctx, ao.manifestPath)
+}
+
+// DoApply is a convenience function to run apply from command-line parameters
+func DoApply(ctx context.Context, session *BaseOptions, arguments []string) error {
+	ao, err := InitApplyOptions(ctx, session, arguments)
+	if err != nil {
+		return err
+	}
+	return NewApply(ao).Apply(ctx, ao.manifestPath)
+}
+
+// apply implements the Apply interface
+type apply struct {
+	o *ApplyOptions
+
+	// listings caches the contents of remote directories. A nil entry
+	// means the directory does not exist.
+	listings map[string]map[string]librfm.File
+}
+
+// NewApply creates a new instance of the Apply interface
+func NewApply(ao *ApplyOptions) *apply {
+	return &apply{
+		o:        ao,
+		listings: make(map[string]map[string]librfm.File),
+	}
+}
+
+// Plan prints the changes necessary to bring the device into the state
+// described by the manifest
+func (a *apply) Plan(ctx context.Context, manifestPath string) error {
+	_, err := a.plan(ctx, manifestPath)
+	return err
+}
+
+// Apply brings the device into the state described by the manifest using
+// the minimal number of changes. The changes are shown and have to be
+// confirmed first.
+func (a *apply) Apply(ctx context.Context, manifestPath string) error {
+	actions, err := a.plan(ctx, manifestPath)
+	if err != nil || len(actions) == 0 {
+		return err
+	}
+	for _, action := range actions {
+		if action.action != actionMkdir {
+			if err = a.o.checkProtected(action.path, a.o.forceProtected); err != nil {
+				return err
+			}
+		}
+	}
+	if err = confirm("Apply these changes?", a.o.assumeYes); err != nil {
+		return err
+	}
+
+	u := NewUpload(&UploadOptions{BaseOptions: a.o.BaseOptions, forceProtected: a.o.forceProtected})
+	r := NewRm(&RmOptions{
+		BaseOptions:    a.o.BaseOptions,
+		trash:          rfm.GetDevice(a.o.device).TrashEnabled(),
+		assumeYes:      true,
+		forceProtected: a.o.forceProtected,
+	})
+	for _, action := range actions {
+		if a.o.verbose {
+			log.Println(action)
+		}
+		switch action.action {
+		case actionMkdir:
+			err = a.o.Rfm.Mkdir(ctx, action.path)
+		case actionCreate, actionUpdate:
+			err = u.uploadContent(ctx, action.path, action.content)
+		case actionDelete:
+			err = r.Rm(ctx, action.path, action.isDir)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	fmt.Printf("Applied %d changes\n", len(actions))
+	return nil
+}
+
+// plan compares the manifest to the device and prints the necessary actions
+// in the order they have to be executed
+func (a *apply) plan(ctx context.Context, manifestPath string) ([]planAction, error) {
+	m, err := readProvisionManifest(manifestPath)
+	if err != nil {
+		return nil, err
+	}
+
+	actions := make([]planAction, 0)
+	mkdirs, err := a.planDirs(ctx, m.Dirs)
+	if err != nil {
+		return nil, err
+	}
+	actions = append(actions, mkdirs...)
+
+	var uploads int
+	for _, file := range m.Files {
+		action, err := a.planFile(ctx, file)
+		if err != nil {
+			return nil, err
+		}
+		if action != nil {
+			actions = append(actions, *action)
+			uploads++
+		}
+	}
+
+	var deletes int
+	for _, absent := range m.Absent {
+		f, err := a.lookup(ctx, absent)
+		if err != nil {
+			return nil, err
+		}
+		if f != nil {
+			actions = append(actions, planAction{action: actionDelete, path: absent, isDir: f.IsDir()})
+			deletes++
+		}
+	}
+
+	if len(actions) == 0 {
+		fmt.Println("No changes. The device matches", manifestPath)
+		return actions, nil
+	}
+	for _, action := range actions {
+		fmt.Println(action)
+	}
+	fmt.Printf("Plan: %d to create, %d to upload, %d to delete\n", len(mkdirs), uploads, deletes)
+	return actions, nil
+}
+
+// planDirs returns mkdir actions for all missing directories including their
+// missing parents with parents first
+func (a *apply) planDirs(ctx context.Context, dirs []string) ([]planAction, error) {
+	needed := make(map[string]bool)
+	for _, d := range dirs {
+		for ; !strings.HasSuffix(d, ":"); d = path.Dir(d) {
+			needed[d] = true
+		}
+	}
+	sorted := make([]string, 0, len(needed))
+	for d := range needed {
+		sorted = append(sorted, d)
+	}
+	sort.Strings(sorted)
+
+	actions := make([]planAction, 0)
+	for _, d := range sorted {
+		f, err := a.lookup(ctx, d)
+		if err != nil {
+			return nil, err
+		}
+		if f == nil {
+			actions = append(actions, planAction{action: actionMkdir, path: d})
+		} else if !f.IsDir() {
+			return nil, fmt.Errorf("%s is a file but should be a directory", d)
+		}
+	}
+	return actions, nil
+}
+
+// planFile returns the upload action for a file if it is missing or its
+// content differs
+func (a *apply) planFile(ctx context.Context, file provisionFile) (*planAction, error) {
+	content := []byte(file.Content)
+	if file.Source != "" {
+		var err error
+		if content, err = os.ReadFile(file.Source); err != nil {
+			return nil, err
+		}
+		if isTemplate(file.Source) {
+			if content, err = a.o.renderTemplate(file.Source, content); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	f, err := a.lookup(ctx, file.Path)
+	if err != nil {
+		return nil, err
+	}
+	if f == nil {
+		return &planAction{action: actionCreate, path: file.Path, content: content}, nil
+	}
+	if f.IsDir() {
+		return nil, fmt.Errorf("%s is a directory but should be a file", file.Path)
+	}
+
+	// Only download files that might be unchanged
+	if f.Size == uint64(len(content)) {
+		remote, _, err := a.o.Rfm.Download(ctx, file.Path)
+		if err != nil {
+			return nil, err
+		}
+		if bytes.Equal(remote, content) {
+			return nil, nil
+		}
+	}
+	return &planAction{action: actionUpdate, path: file.Path, content: content, oldSize: f.Size}, nil
+}
+
+// lookup returns the remote file or directory at remotePath or nil if it
+// does not exist
+func (a *apply) lookup(ctx context.Context, remotePath string) (*librfm.File, error) {
+	dir := path.Dir(remotePath)
+	if strings.HasSuffix(remotePath, ":") || dir == remotePath {
+		return nil, fmt.Errorf("Invalid path: %s", remotePath)
+	}
+	listing, ok := a.listings[dir]
+	if !ok {
+		listDir := dir
+		if strings.HasSuffix(listDir, ":") {
+			listDir += "/"
+		}
+		fl, err := a.o.Rfm.Filelist(ctx, listDir, false)
+		if err != nil && err != librfm.ErrDirectoryNotFound {
+			return nil, err
+		}
+		if fl != nil {
+			listing = make(map[string]librfm.File)
+			for _, f := range fl.Files {
+				listing[f.Name] = f
+			}
+		}
+		a.listings[dir] = listing
+	}
+	f, ok := listing[path.Base(remotePath)]
+	if !ok {
+		return nil, nil
+	}
+	return &f, nil
+}
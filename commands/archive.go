@@ -0,0 +1,182 @@
+package commands
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// archiveWriter adds files and directories to a compressed archive
+type archiveWriter interface {
+	addDir(name string, mtime time.Time) error
+	addFile(name string, mtime time.Time, content []byte) error
+	Close() error
+}
+
+// isArchive checks whether the given path has the extension of a supported archive format
+func isArchive(path string) bool {
+	lp := strings.ToLower(path)
+	return strings.HasSuffix(lp, ".tar.gz") || strings.HasSuffix(lp, ".tgz") || strings.HasSuffix(lp, ".zip")
+}
+
+// newArchiveWriter creates the archive file at path. The format is chosen
+// from the file extension.
+func newArchiveWriter(path string) (archiveWriter, error) {
+	lp := strings.ToLower(path)
+	switch {
+	case strings.HasSuffix(lp, ".tar.gz"), strings.HasSuffix(lp, ".tgz"):
+		f, err := os.Create(path)
+		if err != nil {
+			return nil, err
+		}
+		gw := gzip.NewWriter(f)
+		return &tarGzWriter{f: f, gw: gw, tw: tar.NewWriter(gw)}, nil
+	case strings.HasSuffix(lp, ".zip"):
+		f, err := os.Create(path)
+		if err != nil {
+			return nil, err
+		}
+		return &zipWriter{f: f, zw: zip.NewWriter(f)}, nil
+	default:
+		return nil, fmt.Errorf("Unsupported archive format: %s (use .tar.gz, .tgz or .zip)", path)
+	}
+}
+
+// tarGzWriter writes gzip compressed tar archives
+type tarGzWriter struct {
+	f  *os.File
+	gw *gzip.Writer
+	tw *tar.Writer
+}
+
+func (t *tarGzWriter) addDir(name string, mtime time.Time) error {
+	return t.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeDir,
+		Name:     name + "/",
+		Mode:     0755,
+		ModTime:  mtime,
+	})
+}
+
+func (t *tarGzWriter) addFile(name string, mtime time.Time, content []byte) error {
+	err := t.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     0644,
+		Size:     int64(len(content)),
+		ModTime:  mtime,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = t.tw.Write(content)
+	return err
+}
+
+func (t *tarGzWriter) Close() error {
+	if err := t.tw.Close(); err != nil {
+		t.f.Close()
+		return err
+	}
+	if err := t.gw.Close(); err != nil {
+		t.f.Close()
+		return err
+	}
+	return t.f.Close()
+}
+
+// zipWriter writes zip archives
+type zipWriter struct {
+	f  *os.File
+	zw *zip.Writer
+}
+
+func (z *zipWriter) addDir(name string, mtime time.Time) error {
+	_, err := z.zw.CreateHeader(&zip.FileHeader{
+		Name:     name + "/",
+		Modified: mtime,
+	})
+	return err
+}
+
+func (z *zipWriter) addFile(name string, mtime time.Time, content []byte) error {
+	w, err := z.zw.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   zip.Deflate,
+		Modified: mtime,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(content)
+	return err
+}
+
+func (z *zipWriter) Close() error {
+	if err := z.zw.Close(); err != nil {
+		z.f.Close()
+		return err
+	}
+	return z.f.Close()
+}
+
+// readArchive returns the contents of all regular files in the archive at path
+func readArchive(path string) (map[string][]byte, error) {
+	files := make(map[string][]byte)
+	if strings.HasSuffix(strings.ToLower(path), ".zip") {
+		zr, err := zip.OpenReader(path)
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		for _, zf := range zr.File {
+			if zf.FileInfo().IsDir() {
+				continue
+			}
+			rc, err := zf.Open()
+			if err != nil {
+				return nil, err
+			}
+			content, err := io.ReadAll(rc)
+			rc.Close()
+			if err != nil {
+				return nil, err
+			}
+			files[zf.Name] = content
+		}
+		return files, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	gr, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	tr := tar.NewReader(gr)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return files, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if h.Typeflag != tar.TypeReg {
+			continue
+		}
+		content, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+		files[h.Name] = content
+	}
+}
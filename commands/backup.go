@@ -2,11 +2,14 @@ package commands
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io/fs"
-	"log"
 	"os"
 	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
 
 	"github.com/wilriker/librfm/v2"
 	"github.com/wilriker/rfm"
@@ -16,70 +19,162 @@ const (
 	// SysDir is the location of the default configuration directory
 	SysDir           = "0:/sys"
 	managedDirMarker = ".rfmbackup"
+	compareMtime     = "mtime"
+	compareSize      = "size"
+	compareChecksum  = "checksum"
+	m38Timeout       = 30 * time.Second
+	// m38MaxMisses is the number of consecutive replies to M38 without a
+	// checksum after which it is considered unavailable
+	m38MaxMisses = 3
 )
 
+// sha1Regex finds the checksum in the reply to M38
+var sha1Regex = regexp.MustCompile(`\b[0-9a-fA-F]{40}\b`)
+
+// m38UnsupportedRegex matches replies of firmware versions that do not know M38
+var m38UnsupportedRegex = regexp.MustCompile(`(?i)unknown command|unsupported command|not supported`)
+
 // BackupOptions holds all options relevant to a backup process
 type BackupOptions struct {
 	*BaseOptions
 	dirToBackup string
 	outDir      string
 	removeLocal bool
+	archive     string
+	compare     string
 	excls       rfm.Excludes
+	force       bool
+	git         bool
 }
 
 // Check checks all parameters for valid values
-func (b *BackupOptions) Check() {
-	b.BaseOptions.Check()
+func (b *BackupOptions) Check() error {
+	if err := b.BaseOptions.Check(); err != nil {
+		return err
+	}
 
+	if b.git && b.archive != "" {
+		return errors.New("-git cannot be used together with -archive")
+	}
+	if b.git {
+		if err := checkGit(); err != nil {
+			return err
+		}
+	}
+	return b.resolve()
+}
+
+// resolve validates the backup specific parameters and completes them from
+// the config of the device
+func (b *BackupOptions) resolve() error {
 	b.outDir = rfm.GetAbsPath(b.outDir)
+	if b.archive != "" {
+		b.archive = rfm.GetAbsPath(b.archive)
+	}
+	b.dirToBackup = b.getRemotePath(b.dirToBackup)
+	if b.dirToBackup == "" {
+		b.dirToBackup = SysDir
+	}
 	b.dirToBackup = rfm.CleanRemotePath(b.dirToBackup)
 
-	d := rfm.GetDevice(b.device)
-	if !b.optionsSeen["exclude"] {
-		b.excls = d.Excludes["backup"]
+	switch b.compare {
+	case compareMtime, compareSize, compareChecksum:
+	default:
+		return fmt.Errorf("Invalid value for -compare: %s", b.compare)
+	}
+
+	if !b.optionsSeen["exclude"] && !b.optionsSeen["include"] {
+		b.excls = rfm.GetDevice(b.device).Excludes["backup"]
 	} else {
-		d.Excludes["backup"] = b.excls
+		rfm.UpdateDevice(b.device, func(d *rfm.Device) {
+			d.Excludes["backup"] = b.excls
+		})
 	}
 
-	b.excls.ForEach(rfm.CleanRemotePath)
+	// Earlier versions used absolute remote paths as patterns
+	b.excls.Rebase(b.dirToBackup)
+	return b.excls.LoadIgnoreFile(b.outDir)
 }
 
 // InitBackupOptions intializes a backupOptions instance from command line parameters
-func InitBackupOptions(ctx context.Context, arguments []string) *BackupOptions {
-	b := BackupOptions{BaseOptions: &BaseOptions{}}
+func InitBackupOptions(ctx context.Context, session *BaseOptions, arguments []string) (*BackupOptions, error) {
+	b := BackupOptions{BaseOptions: &BaseOptions{session: session}}
 
 	fs := b.GetFlagSet()
 	fs.BoolVar(&b.removeLocal, "removeLocal", false, "Remove files locally that have been deleted on the Duet")
-	fs.Var(&b.excls, "exclude", "Exclude paths starting with this string (can be passed multiple times)")
+	fs.StringVar(&b.archive, "archive", "", "Write the backup into this .tar.gz or .zip archive")
+	fs.StringVar(&b.compare, "compare", compareMtime, "Strategy to detect changed files: size, mtime or checksum")
+	fs.BoolVar(&b.force, "force", false, "Backup even if there is not enough free space locally")
+	fs.BoolVar(&b.git, "git", false, "Commit all changes to a git repository in the local directory")
+	fs.Var(&b.excls, "exclude", "Exclude paths matching this pattern (can be passed multiple times)")
+	fs.Var(b.excls.Includes(), "include", "Include paths matching this pattern even if excluded (can be passed multiple times)")
 	if err := fs.Parse(arguments); err != nil {
-		log.Fatalf("Error parsing command-line arguments: %s", err)
+		return nil, fmt.Errorf("Error parsing command-line arguments: %s", err)
 	}
 
-	b.dirToBackup = SysDir
 	l := fs.NArg()
-	if l > 0 {
+	if b.archive != "" {
+
+		// There is no local directory if we write to an archive
+		if l > 0 {
+			b.dirToBackup = fs.Arg(0)
+		}
+	} else if l > 0 {
 		b.outDir = fs.Arg(0)
 		if l > 1 {
 			b.dirToBackup = fs.Arg(1)
 		}
 	}
 
-	b.Check()
+	if err := b.Check(); err != nil {
+		return nil, err
+	}
 
-	b.Connect(ctx)
+	if err := b.Connect(ctx); err != nil {
+		return nil, err
+	}
 
-	return &b
+	return &b, nil
 }
 
 // DoBackup is a convenience function to run a backup from command line parameters
-func DoBackup(ctx context.Context, arguments []string) error {
-	bo := InitBackupOptions(ctx, arguments)
+func DoBackup(ctx context.Context, session *BaseOptions, arguments []string) error {
+	bo, err := InitBackupOptions(ctx, session, arguments)
+	if err != nil {
+		return err
+	}
+	if bo.archive != "" {
+		return NewBackup(bo).Archive(ctx, bo.dirToBackup, bo.archive, bo.excls)
+	}
 	return NewBackup(bo).Backup(ctx, bo.dirToBackup, bo.outDir, bo.excls, bo.removeLocal)
 }
 
 // backup implementes the Backup interface
 type backup struct {
-	o *BackupOptions
+	o                *BackupOptions
+	root             string
+	manifest         *manifest
+	previousManifest map[string]manifestEntry
+	hashes           *hashCache
+	listings         map[string]*librfm.Filelist
+	noM38            bool
+	m38Misses        int
+	stats            backupStats
+}
+
+// backupStats sums up the changes a backup made locally
+type backupStats struct {
+	bytes        uint64
+	files        uint64
+	downloadTime time.Duration
+}
+
+// throughput returns the average download speed in KiB/s
+func (s backupStats) throughput() float64 {
+	if s.downloadTime <= 0 {
+		return 0
+	}
+	return (float64(s.bytes) / s.downloadTime.Seconds()) / 1024
 }
 
 // NewBackup creates a new instance of the Backup interface
@@ -106,7 +201,7 @@ func (b *backup) ensureOutDirExists(outDir string) error {
 	// Create the directory
 	if fi == nil {
 		if b.o.verbose {
-			log.Println("  Creating directory", path)
+			b.o.logger().Println("  Creating directory", path)
 		}
 		if err = os.MkdirAll(path, 0755); err != nil {
 			return err
@@ -136,9 +231,9 @@ func (b *backup) updateLocalFiles(ctx context.Context, fl *librfm.Filelist, outD
 		remoteFilename := fmt.Sprintf("%s/%s", fl.Dir, file.Name)
 
 		// Skip files covered by an exclude pattern
-		if excls.Contains(remoteFilename) {
+		if excls.Excluded(b.relativePath(remoteFilename), false) {
 			if b.o.verbose {
-				log.Println("  Excluding: ", remoteFilename)
+				b.o.logger().Println("  Excluding: ", remoteFilename)
 			}
 			continue
 		}
@@ -149,14 +244,30 @@ func (b *backup) updateLocalFiles(ctx context.Context, fl *librfm.Filelist, outD
 			return err
 		}
 
+		update, body, duration, err := b.needsUpdate(ctx, remoteFilename, fileName, fi, file)
+		if err != nil {
+			return err
+		}
+
 		// File does not exist or is outdated so get it
-		if fi == nil || fi.ModTime().Before(file.Date()) {
+		if update {
 
-			// Download file
-			body, duration, err := b.o.Rfm.Download(ctx, remoteFilename)
-			if err != nil {
-				return err
+			// Download file unless it has already been fetched to compare it
+			if body == nil {
+				body, duration, err = b.o.Rfm.Download(ctx, remoteFilename)
+				if err != nil {
+					return err
+				}
 			}
+			b.stats.bytes += uint64(len(body))
+			b.stats.files++
+			if duration != nil {
+				b.stats.downloadTime += *duration
+			}
+			if b.o.compare == compareChecksum {
+				b.hashes.put(remoteFilename, file.Size, file.Date(), sha1Sum(body))
+			}
+			b.manifest.add(b.relativePath(remoteFilename), file.Date(), body)
 
 			// Create corresponding local file
 			nf, err := os.Create(fileName)
@@ -179,14 +290,17 @@ func (b *backup) updateLocalFiles(ctx context.Context, fl *librfm.Filelist, outD
 			if b.o.verbose {
 				kibs := (float64(file.Size) / duration.Seconds()) / 1024
 				if fi != nil {
-					log.Printf("  Updated:   %s (%.1f KiB/s)", remoteFilename, kibs)
+					b.o.logger().Printf("  Updated:   %s (%.1f KiB/s)", remoteFilename, kibs)
 				} else {
-					log.Printf("  Added:     %s (%.1f KiB/s)", remoteFilename, kibs)
+					b.o.logger().Printf("  Added:     %s (%.1f KiB/s)", remoteFilename, kibs)
 				}
 			}
 		} else {
+			if err = b.addUnchangedToManifest(b.relativePath(remoteFilename), fileName, file); err != nil {
+				return err
+			}
 			if b.o.verbose {
-				log.Println("  Up-to-date:", remoteFilename)
+				b.o.logger().Println("  Up-to-date:", remoteFilename)
 			}
 		}
 
@@ -195,6 +309,86 @@ func (b *backup) updateLocalFiles(ctx context.Context, fl *librfm.Filelist, outD
 	return nil
 }
 
+// needsUpdate decides whether the local copy of a remote file has to be updated
+// using the configured compare strategy. If the remote file had to be downloaded
+// to decide this its contents and the download duration are returned.
+func (b *backup) needsUpdate(ctx context.Context, remoteFilename, fileName string, fi fs.FileInfo, file librfm.File) (bool, []byte, *time.Duration, error) {
+	if fi == nil {
+		return true, nil, nil, nil
+	}
+	switch b.o.compare {
+	case compareSize:
+		return uint64(fi.Size()) != file.Size, nil, nil, nil
+	case compareChecksum:
+		if uint64(fi.Size()) != file.Size {
+			return true, nil, nil, nil
+		}
+		remoteSum, body, duration, err := b.remoteChecksum(ctx, remoteFilename, file)
+		if err != nil {
+			return false, nil, nil, err
+		}
+		localContent, err := os.ReadFile(fileName)
+		if err != nil {
+			return false, nil, nil, err
+		}
+		return sha1Sum(localContent) != remoteSum, body, duration, nil
+	default:
+		return fi.ModTime().Before(file.Date()), nil, nil, nil
+	}
+}
+
+// remoteChecksum determines the SHA-1 checksum of a remote file. It will use a
+// cached value if the file did not change, otherwise it will ask the firmware via
+// M38 and in case this is not supported fall back to downloading the file.
+func (b *backup) remoteChecksum(ctx context.Context, remoteFilename string, file librfm.File) (string, []byte, *time.Duration, error) {
+	if sum, ok := b.hashes.get(remoteFilename, file.Size, file.Date()); ok {
+		return sum, nil, nil, nil
+	}
+	if !b.noM38 {
+		reply, err := b.o.Machine.Gcode(ctx, "M38 "+quoteGcodeString(remoteFilename), m38Timeout)
+		if err != nil {
+			return "", nil, nil, err
+		}
+		if sum := sha1Regex.FindString(reply); sum != "" {
+			b.m38Misses = 0
+			sum = strings.ToLower(sum)
+			b.hashes.put(remoteFilename, file.Size, file.Date(), sum)
+			return sum, nil, nil, nil
+		}
+
+		// Do not try again for every single file once it is clear that M38
+		// does not work. Single failures only fall back for this file.
+		b.m38Misses++
+		if m38UnsupportedRegex.MatchString(reply) || b.m38Misses >= m38MaxMisses {
+			b.o.logger().Println("  M38 not available, falling back to downloading files for checksums")
+			b.noM38 = true
+		}
+	}
+	body, duration, err := b.o.Rfm.Download(ctx, remoteFilename)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	sum := sha1Sum(body)
+	b.hashes.put(remoteFilename, file.Size, file.Date(), sum)
+	return sum, body, duration, nil
+}
+
+// addUnchangedToManifest records a file that has not been downloaded in the manifest.
+// The checksum of the previous run is kept as long as the remote file did not change
+// so corruption of the local copy can be detected. Otherwise the local file is hashed.
+func (b *backup) addUnchangedToManifest(rel, fileName string, file librfm.File) error {
+	if e, ok := b.previousManifest[rel]; ok && e.Size == file.Size && e.Date.Equal(file.Date()) {
+		b.manifest.Files = append(b.manifest.Files, e)
+		return nil
+	}
+	body, err := os.ReadFile(fileName)
+	if err != nil {
+		return err
+	}
+	b.manifest.add(rel, file.Date(), body)
+	return nil
+}
+
 // isManagedDirectory checks wether the given path is a directory and
 // if so if it contains the marker file. It will return false in case
 // any error has occured.
@@ -229,19 +423,20 @@ func (b *backup) removeDeletedFiles(fl *librfm.Filelist, outDir string) error {
 	for _, de := range dirEntries {
 		if !existingFiles[de.Name()] {
 
-			// Skip directories not managed by us as well as our marker file
-			if (de.IsDir() && !b.isManagedDirectory(outDir, de)) || de.Name() == managedDirMarker {
+			// Skip directories not managed by us as well as our own files
+			if (de.IsDir() && !b.isManagedDirectory(outDir, de)) || de.Name() == managedDirMarker || de.Name() == rfm.IgnoreFileName || de.Name() == manifestFileName || de.Name() == hashCacheFileName {
 				continue
 			}
 			if err := os.RemoveAll(filepath.Join(outDir, de.Name())); err != nil {
 				return err
 			}
+			b.stats.files++
 			if b.o.verbose {
 				marker := fileMarker
 				if de.IsDir() {
 					marker = dirMarker
 				}
-				log.Println("  Removed:   ", marker, de.Name())
+				b.o.logger().Println("  Removed:   ", marker, de.Name())
 			}
 		}
 	}
@@ -249,30 +444,164 @@ func (b *backup) removeDeletedFiles(fl *librfm.Filelist, outDir string) error {
 	return nil
 }
 
+// checkFreeSpace makes sure that all files of folder that are not excluded fit
+// into the local directory dir. If replace is true files that already exist in
+// dir only need the space they grow by.
+func (b *backup) checkFreeSpace(ctx context.Context, folder, dir string, excls rfm.Excludes, replace bool) error {
+	fl, err := b.o.Rfm.Filelist(ctx, folder, true)
+	if err != nil {
+		return err
+	}
+	b.rememberListings(folder, fl)
+	needed := b.neededSpace(fl, dir, excls, replace)
+	if needed == 0 {
+		return nil
+	}
+
+	// The directory might not exist yet so check the closest existing parent
+	existing := dir
+	for {
+		if _, err = os.Stat(existing); err == nil || filepath.Dir(existing) == existing {
+			break
+		}
+		existing = filepath.Dir(existing)
+	}
+	free, err := localFreeSpace(existing)
+	if err != nil {
+		b.o.logger().Println("Unable to determine free space, continuing anyway:", err)
+		return nil
+	}
+	if b.o.verbose {
+		b.o.logger().Printf("Fetching up to %s with %s free locally", humanSize(needed), humanSize(free))
+	}
+	if needed > free {
+		return fmt.Errorf("Not enough space in %s: %s needed but only %s free. Use -force to backup anyway",
+			existing, humanSize(needed), humanSize(free))
+	}
+	return nil
+}
+
+// rememberListings keeps the listing of dir and all its subdirectories so they
+// do not have to be fetched again during the backup
+func (b *backup) rememberListings(dir string, fl *librfm.Filelist) {
+	b.listings[dir] = fl
+
+	// Directories come first and have their listings in the same order
+	for i, sub := range fl.Subdirs {
+		if i >= len(fl.Files) || !fl.Files[i].IsDir() {
+			break
+		}
+		b.rememberListings(fmt.Sprintf("%s/%s", fl.Dir, fl.Files[i].Name), sub)
+	}
+}
+
+// filelist returns the listing of dir. A listing remembered earlier is used
+// only once as every directory is only visited once.
+func (b *backup) filelist(ctx context.Context, dir string) (*librfm.Filelist, error) {
+	if fl, ok := b.listings[dir]; ok {
+		delete(b.listings, dir)
+		return fl, nil
+	}
+	b.o.logger().Println("Fetching filelist for", dir)
+	return b.o.Rfm.Filelist(ctx, dir, false)
+}
+
+// neededSpace sums up the sizes of all files in fl and its subdirectories that are not excluded
+func (b *backup) neededSpace(fl *librfm.Filelist, dir string, excls rfm.Excludes, replace bool) uint64 {
+	var needed uint64
+	for _, file := range fl.Files {
+		if file.IsDir() {
+			continue
+		}
+		rel := b.relativePath(fmt.Sprintf("%s/%s", fl.Dir, file.Name))
+		if excls.Excluded(rel, false) {
+			continue
+		}
+		size := file.Size
+		if replace {
+			if fi, err := os.Stat(filepath.Join(dir, filepath.FromSlash(rel))); err == nil {
+				if uint64(fi.Size()) >= size {
+					continue
+				}
+				size -= uint64(fi.Size())
+			}
+		}
+		needed += size
+	}
+	for _, sub := range fl.Subdirs {
+		needed += b.neededSpace(sub, dir, excls, replace)
+	}
+	return needed
+}
+
+// relativePath returns the given remote path relative to the root of the backup
+func (b *backup) relativePath(remotePath string) string {
+	return strings.TrimPrefix(strings.TrimPrefix(remotePath, b.root), "/")
+}
+
 // Backup will synchronize the contents of a remote folder to a local directory.
 // The boolean flag removeLocal decides whether or not files that have been remove
-// remote should also be deleted locally
+// remote should also be deleted locally. A manifest of all backuped files including
+// their checksums is written to outDir.
 func (b *backup) Backup(ctx context.Context, folder, outDir string, excls rfm.Excludes, removeLocal bool) error {
+	b.root = folder
+	b.listings = make(map[string]*librfm.Filelist)
+	b.manifest = newManifest(b.o.BaseOptions, folder)
+	b.hashes = loadHashCache(outDir)
+	b.previousManifest = make(map[string]manifestEntry)
+	if m, err := readManifest(outDir); err == nil {
+		for _, e := range m.Files {
+			b.previousManifest[e.Path] = e
+		}
+	}
+	if !b.o.force {
+		if err := b.checkFreeSpace(ctx, folder, outDir, excls, true); err != nil {
+			return err
+		}
+	}
+	if err := b.backup(ctx, folder, outDir, excls, removeLocal); err != nil {
+		return err
+	}
+	if b.o.compare == compareChecksum {
+		if err := b.hashes.save(outDir); err != nil {
+			return err
+		}
+	}
+
+	// Record what has been backuped
+	if err := b.manifest.write(outDir); err != nil {
+		return err
+	}
+	if b.o.git {
+		g := &gitRepo{dir: outDir, verbose: b.o.verbose, log: b.o.logger()}
+		if err := g.init(ctx); err != nil {
+			return err
+		}
+		return g.commit(ctx, b.o.device, b.o.domain)
+	}
+	return nil
+}
+
+func (b *backup) backup(ctx context.Context, folder, outDir string, excls rfm.Excludes, removeLocal bool) error {
 
 	// Skip complete directories if they are covered by an exclude pattern
-	if excls.Contains(folder) {
-		log.Println("Excluding", folder)
+	if excls.Excluded(b.relativePath(folder), true) {
+		b.o.logger().Println("Excluding", folder)
 		return nil
 	}
 
-	log.Println("Fetching filelist for", folder)
-	fl, err := b.o.Rfm.Filelist(ctx, folder, false)
+	fl, err := b.filelist(ctx, folder)
 	if err != nil {
 		return err
 	}
 
-	log.Println("Downloading new/changed files from", folder, "to", outDir)
+	b.o.logger().Println("Downloading new/changed files from", folder, "to", outDir)
 	if err = b.updateLocalFiles(ctx, fl, outDir, excls, removeLocal); err != nil {
 		return err
 	}
 
 	if removeLocal {
-		log.Println("Removing no longer existing files in", outDir)
+		b.o.logger().Println("Removing no longer existing files in", outDir)
 		if err = b.removeDeletedFiles(fl, outDir); err != nil {
 			return err
 		}
@@ -285,9 +614,95 @@ func (b *backup) Backup(ctx context.Context, folder, outDir string, excls rfm.Ex
 		}
 		remoteFilename := fmt.Sprintf("%s/%s", fl.Dir, file.Name)
 		fileName := filepath.Join(outDir, file.Name)
-		if err = b.Backup(ctx, remoteFilename, fileName, excls, removeLocal); err != nil {
+		if err = b.backup(ctx, remoteFilename, fileName, excls, removeLocal); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Archive will download the contents of a remote folder directly into a
+// compressed archive. The archive will contain a manifest file listing
+// all files and the source device.
+func (b *backup) Archive(ctx context.Context, folder, archivePath string, excls rfm.Excludes) (err error) {
+	b.root = folder
+	b.listings = make(map[string]*librfm.Filelist)
+	if !b.o.force {
+		if err = b.checkFreeSpace(ctx, folder, filepath.Dir(archivePath), excls, false); err != nil {
+			return err
+		}
+	}
+	aw, err := newArchiveWriter(archivePath)
+	if err != nil {
+		return err
+	}
+
+	// Do not leave incomplete archives behind
+	defer func() {
+		if err != nil {
+			aw.Close()
+			os.Remove(archivePath)
+		}
+	}()
+
+	b.o.logger().Println("Archiving", folder, "to", archivePath)
+	m := newManifest(b.o.BaseOptions, folder)
+	if err = b.archiveDir(ctx, aw, folder, excls, m); err != nil {
+		return err
+	}
+
+	content, err := m.marshal()
+	if err != nil {
+		return err
+	}
+	if err = aw.addFile(manifestFileName, m.Created, content); err != nil {
+		return err
+	}
+	return aw.Close()
+}
+
+func (b *backup) archiveDir(ctx context.Context, aw archiveWriter, folder string, excls rfm.Excludes, m *manifest) error {
+	fl, err := b.filelist(ctx, folder)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range fl.Files {
+		remoteFilename := fmt.Sprintf("%s/%s", fl.Dir, file.Name)
+		rel := b.relativePath(remoteFilename)
+
+		// Skip files and directories covered by an exclude pattern
+		if excls.Excluded(rel, file.IsDir()) {
+			if b.o.verbose {
+				b.o.logger().Println("  Excluding: ", remoteFilename)
+			}
+			continue
+		}
+
+		if file.IsDir() {
+			if err = aw.addDir(rel, file.Date()); err != nil {
+				return err
+			}
+			if err = b.archiveDir(ctx, aw, remoteFilename, excls, m); err != nil {
+				return err
+			}
+			continue
+		}
+
+		body, duration, err := b.o.Rfm.Download(ctx, remoteFilename)
+		if err != nil {
 			return err
 		}
+		if err = aw.addFile(rel, file.Date(), body); err != nil {
+			return err
+		}
+		m.add(rel, file.Date(), body)
+
+		if b.o.verbose {
+			kibs := (float64(file.Size) / duration.Seconds()) / 1024
+			b.o.logger().Printf("  Added:     %s (%.1f KiB/s)", remoteFilename, kibs)
+		}
 	}
 
 	return nil
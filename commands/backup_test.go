@@ -0,0 +1,69 @@
+package commands
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNeedsUpdate(t *testing.T) {
+	dir := t.TempDir()
+	fileName := filepath.Join(dir, "config.g")
+	if err := os.WriteFile(fileName, []byte("local"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Date(2024, time.March, 1, 12, 0, 0, 0, time.UTC)
+	if err := os.Chtimes(fileName, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		compare   string
+		missing   bool
+		size      uint64
+		date      time.Time
+		remoteSum string
+		want      bool
+	}{
+		{"missing locally", compareMtime, true, 5, mtime, "", true},
+		{"mtime newer remote", compareMtime, false, 5, mtime.Add(time.Second), "", true},
+		{"mtime same", compareMtime, false, 6, mtime, "", false},
+		{"mtime older remote", compareMtime, false, 5, mtime.Add(-time.Second), "", false},
+		{"size same", compareSize, false, 5, mtime.Add(time.Hour), "", false},
+		{"size changed", compareSize, false, 6, mtime, "", true},
+		{"checksum size changed", compareChecksum, false, 6, mtime, "", true},
+		{"checksum same", compareChecksum, false, 5, mtime.Add(time.Hour), sha1Sum([]byte("local")), false},
+		{"checksum changed", compareChecksum, false, 5, mtime, sha1Sum([]byte("remote")), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &backup{
+				o:      &BackupOptions{BaseOptions: &BaseOptions{}, compare: tt.compare},
+				hashes: &hashCache{entries: make(map[string]hashCacheEntry)},
+			}
+
+			// Remote checksums come from the cache so no device is needed
+			if tt.remoteSum != "" {
+				b.hashes.put("0:/sys/config.g", tt.size, tt.date, tt.remoteSum)
+			}
+			localInfo := fi
+			if tt.missing {
+				localInfo = nil
+			}
+			got, _, _, err := b.needsUpdate(context.Background(), "0:/sys/config.g", fileName, localInfo, *remoteFile(tt.size, tt.date))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("needsUpdate() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -2,38 +2,70 @@ package commands
 
 import (
 	"context"
+	"errors"
 	"flag"
+	"fmt"
+	"io"
 	"log"
-	"os"
 	"sync"
 
 	"github.com/wilriker/librfm/v2"
 	"github.com/wilriker/rfm"
 )
 
-// BaseOptions is the struct holding the basic parameters common to all commands
+// ErrUnavailable is returned if the device cannot be reached
+var ErrUnavailable = errors.New("currently not available")
+
+// BaseOptions is the struct holding the basic parameters common to all commands.
+// Commands that are run as part of a script get the options of the script as
+// session. They use its connection instead of creating their own and report
+// invalid parameters as errors instead of ending the process.
 type BaseOptions struct {
+	session     *BaseOptions
 	device      string
 	domain      string
 	port        uint64
 	password    string
+	remotePath  string
 	verbose     bool
 	debug       bool
 	optionsSeen map[string]bool
 	fs          *flag.FlagSet
 	once        sync.Once
 	Rfm         *librfm.RRFFileManager
+	Machine     *rfm.Machine
+
+	// log is used for the output of commands that run concurrently for
+	// several devices. The standard logger is used if it is nil.
+	log *log.Logger
+}
+
+// logger returns the logger for the output of the command
+func (b *BaseOptions) logger() *log.Logger {
+	if b.log == nil {
+		return log.Default()
+	}
+	return b.log
 }
 
 // GetFlagSet returns the basic flag.FlagSet shared by all commands
 func (b *BaseOptions) GetFlagSet() *flag.FlagSet {
 	b.once.Do(func() {
-		b.fs = flag.NewFlagSet("options", flag.ExitOnError)
+		errorHandling := flag.ExitOnError
+		if b.session != nil {
+			errorHandling = flag.ContinueOnError
+		}
+		b.fs = flag.NewFlagSet("options", errorHandling)
+		if b.session != nil {
+
+			// The error is reported with the summary of the script
+			b.fs.SetOutput(io.Discard)
+		}
 
 		b.fs.StringVar(&b.device, "device", rfm.DefaultDevice, "Use this device from the config file")
 		b.fs.StringVar(&b.domain, "domain", "", "Domain of Duet Wifi")
-		b.fs.Uint64Var(&b.port, "port", 80, "Port of Duet Wifi")
-		b.fs.StringVar(&b.password, "password", "reprap", "Connection password")
+		b.fs.Uint64Var(&b.port, "port", rfm.DefaultPort, "Port of Duet Wifi")
+		b.fs.StringVar(&b.password, "password", rfm.DefaultPassword, "Connection password")
 		b.fs.BoolVar(&b.verbose, "verbose", false, "Output more details")
 		b.fs.BoolVar(&b.debug, "debug", false, "Output details on underlying HTTP requests")
 
@@ -54,55 +86,124 @@ func (b *BaseOptions) initOptionsSeen() {
 func (b *BaseOptions) updateFromConfig() {
 	b.initOptionsSeen()
 
+	// A project-local config might pin the device to use
+	if !b.optionsSeen["device"] {
+		b.device = rfm.GetDefaultDevice()
+	}
+
 	// Get possibly existing config
 	if d := rfm.GetDevice(b.device); d != nil {
 		if !b.optionsSeen["domain"] {
 			b.domain = d.Domain
-		} else {
-			d.Domain = b.domain
 		}
-		if !b.optionsSeen["port"] {
+		if !b.optionsSeen["port"] && d.Port != 0 {
 			b.port = d.Port
-		} else {
-			d.Port = b.port
 		}
-		if !b.optionsSeen["password"] {
+		if !b.optionsSeen["password"] && d.Password != "" {
 			b.password = d.Password
-		} else {
-			d.Password = b.password
 		}
+		b.remotePath = d.RemotePath
+		rfm.UpdateDevice(b.device, func(d *rfm.Device) {
+			if b.optionsSeen["domain"] {
+				d.Domain = b.domain
+			}
+			if b.optionsSeen["port"] {
+				d.Port = b.port
+			}
+			if b.optionsSeen["password"] {
+				d.Password = b.password
+			}
+		})
 	} else {
 		rfm.AddConfig(b.device, b.domain, b.port, b.password)
 	}
 }
 
+// getRemotePath returns the given path or the configured default remote path
+// of the device if path is empty
+func (b *BaseOptions) getRemotePath(path string) string {
+	if path == "" {
+		return b.remotePath
+	}
+	return path
+}
+
 // Check checks the basic parameters for correctness
-func (b *BaseOptions) Check() {
+func (b *BaseOptions) Check() error {
 
 	// Check port first
 	if b.port > 65535 {
-		log.Fatal("Invalid port: ", b.port)
+		return fmt.Errorf("Invalid port: %d", b.port)
+	}
+
+	// Commands in a script use the settings the script was started with
+	if b.session != nil {
+		b.useSession()
+		return nil
 	}
 
 	// Update settings from config and config from parameters
 	b.updateFromConfig()
 	if b.domain == "" {
-		log.Fatal("-domain is mandatory")
+		return errors.New("-domain is mandatory")
 	}
+	return nil
+}
 
+// useSession takes over the connection settings of the session
+func (b *BaseOptions) useSession() {
+	b.initOptionsSeen()
+	b.device = b.session.device
+	b.domain = b.session.domain
+	b.port = b.session.port
+	b.password = b.session.password
+	b.remotePath = b.session.remotePath
+	b.verbose = b.verbose || b.session.verbose
+	b.debug = b.session.debug
 }
 
-// Connect initializes the connection to RepRapFirmware
-func (b *BaseOptions) Connect(ctx context.Context) {
+// Connect initializes the connection to RepRapFirmware. The returned error
+// wraps ErrUnavailable if the device cannot be reached.
+func (b *BaseOptions) Connect(ctx context.Context) error {
+	if b.session != nil {
+		b.Rfm = b.session.Rfm
+		b.Machine = b.session.Machine
+		return nil
+	}
 	b.Rfm = librfm.New(b.domain, b.port, b.debug)
+	b.Machine = rfm.NewMachine(b.domain, b.port, b.debug)
 	if err := b.Rfm.Connect(ctx, b.password); err != nil {
-		log.Println("Duet currently not available")
-		os.Exit(0)
+		return fmt.Errorf("%s %w: %s", b.domain, ErrUnavailable, err)
 	}
 	// Save config after successful connect
 	err := rfm.SaveConfigs()
 	// Inform user about problem saving file but don't stop
 	if err != nil {
-		log.Printf("Unable to save configuration for %s to %s: %s", b.device, rfm.ConfigFileName, err)
+		log.Printf("Unable to save configuration for %s to %s: %s", b.device, rfm.ConfigPath(), err)
+	}
+	return nil
+}
+
+// deviceOptions creates the basic parameters for a device from the config
+// without parsing any command-line parameters
+func deviceOptions(device string, verbose, debug bool) *BaseOptions {
+	b := &BaseOptions{
+		device:      device,
+		port:        rfm.DefaultPort,
+		password:    rfm.DefaultPassword,
+		verbose:     verbose,
+		debug:       debug,
+		optionsSeen: make(map[string]bool),
+	}
+	if d := rfm.GetDevice(device); d != nil {
+		b.domain = d.Domain
+		if d.Port != 0 {
+			b.port = d.Port
+		}
+		if d.Password != "" {
+			b.password = d.Password
+		}
+		b.remotePath = d.RemotePath
 	}
+	return b
 }
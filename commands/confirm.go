@@ -0,0 +1,82 @@
+package commands
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/wilriker/librfm/v2"
+	"github.com/wilriker/rfm"
+	"golang.org/x/term"
+)
+
+// ErrAborted is returned if the user did not confirm a destructive operation
+var ErrAborted = errors.New("Aborted")
+
+// confirm asks the user whether to continue with a destructive operation
+// unless assumeYes is set. Without a terminal to ask on it refuses to continue.
+func confirm(question string, assumeYes bool) error {
+	if assumeYes {
+		return nil
+	}
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return fmt.Errorf("%s Use -y to confirm when not running interactively", question)
+	}
+	fmt.Fprintf(os.Stderr, "%s [y/N] ", question)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return nil
+	}
+	return ErrAborted
+}
+
+// countFiles returns the number of files and their total size in fl and
+// all its subdirectories
+func countFiles(fl *librfm.Filelist) (uint64, uint64) {
+	var count, size uint64
+	for _, f := range fl.Files {
+		if !f.IsDir() {
+			count++
+			size += f.Size
+		}
+	}
+	for _, sub := range fl.Subdirs {
+		c, s := countFiles(sub)
+		count += c
+		size += s
+	}
+	return count, size
+}
+
+// protectedError is returned if a protected path would be modified
+type protectedError struct {
+	path   string
+	device string
+}
+
+func (e *protectedError) Error() string {
+	return fmt.Sprintf("%s is protected by the configuration of device %s. Use -force-protected to modify it anyway", e.path, e.device)
+}
+
+// checkProtected returns an error if remotePath is protected by the config of
+// the device, i.e. it is or lies below a protected path or contains one,
+// unless force is set
+func (b *BaseOptions) checkProtected(remotePath string, force bool) error {
+	if force {
+		return nil
+	}
+	d := rfm.GetDevice(b.device)
+	if d == nil {
+		return nil
+	}
+	for _, p := range d.Protected {
+		p = rfm.CleanRemotePath(p)
+		if remotePath == p || strings.HasPrefix(remotePath, p+"/") || strings.HasPrefix(p, remotePath+"/") {
+			return &protectedError{path: p, device: b.device}
+		}
+	}
+	return nil
+}
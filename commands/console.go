@@ -0,0 +1,144 @@
+package commands
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/term"
+)
+
+const (
+	consolePrompt = "> "
+)
+
+// ConsoleOptions holds the specific parameters for console
+type ConsoleOptions struct {
+	*BaseOptions
+	timeout time.Duration
+}
+
+// Check checks all parameters for valid values
+func (c *ConsoleOptions) Check() error {
+	return c.BaseOptions.Check()
+}
+
+// InitConsoleOptions initializes a ConsoleOptions instance from command-line parameters
+func InitConsoleOptions(ctx context.Context, session *BaseOptions, arguments []string) (*ConsoleOptions, error) {
+	c := ConsoleOptions{BaseOptions: &BaseOptions{session: session}}
+
+	fs := c.GetFlagSet()
+	fs.DurationVar(&c.timeout, "timeout", defaultReplyTimeout, "Time to wait for a reply")
+	if err := fs.Parse(arguments); err != nil {
+		return nil, err
+	}
+
+	if err := c.Check(); err != nil {
+		return nil, err
+	}
+
+	if err := c.Connect(ctx); err != nil {
+		return nil, err
+	}
+
+	return &c, nil
+}
+
+// DoConsole is a convenience function to run console from command-line parameters
+func DoConsole(ctx context.Context, session *BaseOptions, arguments []string) error {
+	co, err := InitConsoleOptions(ctx, session, arguments)
+	if err != nil {
+		return err
+	}
+	return NewConsole(co).Console(ctx, os.Stdin, os.Stdout, co.timeout)
+}
+
+// console implements the Console interface
+type console struct {
+	o *ConsoleOptions
+}
+
+// NewConsole creates a new instance of the Console interface
+func NewConsole(co *ConsoleOptions) *console {
+	return &console{
+		o: co,
+	}
+}
+
+// Console reads G-code commands line by line and prints their replies until
+// EOF or "exit" is entered. If in is a terminal previous commands can be
+// recalled with the arrow keys.
+func (c *console) Console(ctx context.Context, in *os.File, out io.Writer, timeout time.Duration) error {
+	readLine, out, restore, err := c.lineReader(in, out)
+	if err != nil {
+		return err
+	}
+	defer restore()
+
+	for {
+		line, err := readLine()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if line == "exit" || line == "quit" {
+			return nil
+		}
+
+		// Show replies that arrived after the last command finished
+		pending, err := c.o.Machine.Reply(ctx)
+		if err != nil {
+			return err
+		}
+		if pending != "" {
+			fmt.Fprintln(out, pending)
+		}
+
+		reply, err := c.o.Machine.Gcode(ctx, line, timeout)
+		if err != nil {
+			return err
+		}
+		if reply != "" {
+			fmt.Fprintln(out, reply)
+		}
+	}
+}
+
+// lineReader returns a function to read a line of input. On a terminal this provides
+// line editing and history. The returned writer has to be used for all output.
+func (c *console) lineReader(in *os.File, out io.Writer) (func() (string, error), io.Writer, func(), error) {
+	fd := int(in.Fd())
+	if !term.IsTerminal(fd) {
+		s := bufio.NewScanner(in)
+		return func() (string, error) {
+			if !s.Scan() {
+				if s.Err() != nil {
+					return "", s.Err()
+				}
+				return "", io.EOF
+			}
+			return s.Text(), nil
+		}, out, func() {}, nil
+	}
+
+	oldState, err := term.MakeRaw(fd)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	t := term.NewTerminal(struct {
+		io.Reader
+		io.Writer
+	}{in, out}, consolePrompt)
+	fmt.Fprintln(t, "Connected to", c.o.domain, "- enter \"exit\" or press Ctrl-D to quit")
+	return t.ReadLine, t, func() { term.Restore(fd, oldState) }, nil
+}
@@ -0,0 +1,383 @@
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/wilriker/rfm"
+)
+
+const (
+	daemonStatusFileName = "daemon-status.json"
+	defaultRetry         = 5 * time.Minute
+)
+
+// backupStatus is the outcome of the scheduled backups of a single device
+type backupStatus struct {
+	LastAttempt  time.Time  `json:"lastAttempt"`
+	LastSuccess  *time.Time `json:"lastSuccess,omitempty"`
+	LastDuration float64    `json:"lastDurationSeconds"`
+	LastError    string     `json:"lastError,omitempty"`
+	Failures     int        `json:"consecutiveFailures"`
+	NextRun      time.Time  `json:"nextRun"`
+
+	// Totals over all runs
+	BytesTransferred   uint64 `json:"bytesTransferred"`
+	FilesChanged       uint64 `json:"filesChanged"`
+	ConnectionFailures uint64 `json:"connectionFailures"`
+
+	// Values of the last successful run. Throughput is only updated by runs
+	// that downloaded anything.
+	Throughput float64 `json:"throughputKiBs"`
+	Volume     uint64  `json:"volume"`
+	FreeSpace  *uint64 `json:"freeSpace,omitempty"`
+}
+
+// daemonStatus is the status of all devices the daemon backups. It is
+// written to a file after each change.
+type daemonStatus struct {
+	mu      sync.Mutex
+	path    string
+	Devices map[string]*backupStatus `json:"devices"`
+}
+
+// loadDaemonStatus reads the status file of a previous run. A missing or
+// unreadable file results in an empty status.
+func loadDaemonStatus(path string) *daemonStatus {
+	s := &daemonStatus{path: path, Devices: make(map[string]*backupStatus)}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return s
+	}
+	if err = json.Unmarshal(content, s); err != nil || s.Devices == nil {
+		s.Devices = make(map[string]*backupStatus)
+	}
+	return s
+}
+
+// get returns a copy of the status of a device
+func (s *daemonStatus) get(device string) backupStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if bs, ok := s.Devices[device]; ok {
+		return *bs
+	}
+	return backupStatus{}
+}
+
+// update changes the status of a device and writes the status file
+func (s *daemonStatus) update(device string, update func(bs *backupStatus)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	bs, ok := s.Devices[device]
+	if !ok {
+		bs = &backupStatus{}
+		s.Devices[device] = bs
+	}
+	update(bs)
+	if err := s.write(); err != nil {
+		log.Println("Unable to write status file:", err)
+	}
+}
+
+// write stores the status atomically so readers never see a partial file
+func (s *daemonStatus) write() error {
+	content, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(s.path)
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, filepath.Base(s.path))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err = f.Write(content); err != nil {
+		return err
+	}
+	f.Close()
+	return os.Rename(f.Name(), s.path)
+}
+
+// DaemonOptions holds the specific parameters for daemon
+type DaemonOptions struct {
+	*BaseOptions
+	statusFile  string
+	retry       time.Duration
+	compare     string
+	removeLocal bool
+	git         bool
+	metrics     string
+	devices     []string
+}
+
+// Check checks all parameters for valid values
+func (d *DaemonOptions) Check() error {
+
+	// The connection parameters of each device are taken from the config
+	d.initOptionsSeen()
+
+	if d.statusFile == "" {
+		dir, err := rfm.ConfigDir()
+		if err != nil {
+			return err
+		}
+		d.statusFile = filepath.Join(dir, daemonStatusFileName)
+	}
+	d.statusFile = rfm.GetAbsPath(d.statusFile)
+
+	if d.retry <= 0 {
+		return fmt.Errorf("Invalid value for -retry: %s", d.retry)
+	}
+
+	switch d.compare {
+	case compareMtime, compareSize, compareChecksum:
+	default:
+		return fmt.Errorf("Invalid value for -compare: %s", d.compare)
+	}
+
+	if d.git {
+		if err := checkGit(); err != nil {
+			return err
+		}
+	}
+
+	// Devices named explicitly have to be scheduled, otherwise all scheduled
+	// devices are used
+	explicit := len(d.devices) > 0
+	if !explicit {
+		d.devices = rfm.DeviceNames()
+	}
+	scheduled := make([]string, 0, len(d.devices))
+	for _, name := range d.devices {
+		dev := rfm.GetDevice(name)
+		if dev == nil {
+			return fmt.Errorf("Unknown device: %s", name)
+		}
+		if dev.BackupEvery == "" {
+			if explicit {
+				return fmt.Errorf("backup_every is mandatory for %s", name)
+			}
+			continue
+		}
+		every, err := parseAge(dev.BackupEvery)
+		if err != nil || every <= 0 {
+			return fmt.Errorf("Invalid value for backup_every of %s: %s", name, dev.BackupEvery)
+		}
+		if dev.BackupDir == "" {
+			return fmt.Errorf("backup_dir is mandatory for %s", name)
+		}
+		if dev.Domain == "" {
+			return fmt.Errorf("domain is mandatory for %s", name)
+		}
+		scheduled = append(scheduled, name)
+	}
+	if len(scheduled) == 0 {
+		return errors.New("No device has a backup schedule. Set backup_every and backup_dir in the config")
+	}
+	d.devices = scheduled
+	return nil
+}
+
+// InitDaemonOptions initializes a DaemonOptions instance from command-line parameters
+func InitDaemonOptions(ctx context.Context, arguments []string) (*DaemonOptions, error) {
+	d := DaemonOptions{BaseOptions: &BaseOptions{}}
+
+	fs := d.GetFlagSet()
+	fs.StringVar(&d.statusFile, "status", "", "Write the status of all devices to this file")
+	fs.DurationVar(&d.retry, "retry", defaultRetry, "Wait this long before retrying a failed backup")
+	fs.StringVar(&d.compare, "compare", compareMtime, "Strategy to detect changed files: size, mtime or checksum")
+	fs.BoolVar(&d.removeLocal, "removeLocal", false, "Remove files locally that have been deleted on the Duet")
+	fs.BoolVar(&d.git, "git", false, "Commit all changes of each backup to a git repository in backup_dir")
+	fs.StringVar(&d.metrics, "metrics", "", "Serve Prometheus metrics on this address, e.g. :9110")
+	if err := fs.Parse(arguments); err != nil {
+		return nil, err
+	}
+
+	d.devices = fs.Args()
+
+	// Devices are connected to on each run so offline ones can be retried
+	if err := d.Check(); err != nil {
+		return nil, err
+	}
+
+	return &d, nil
+}
+
+// DoDaemon is a convenience function to run the daemon from command-line parameters
+func DoDaemon(ctx context.Context, arguments []string) error {
+	do, err := InitDaemonOptions(ctx, arguments)
+	if err != nil {
+		return err
+	}
+	return NewDaemon(do).Run(ctx, do.devices, do.metrics)
+}
+
+// daemon implements the Daemon interface
+type daemon struct {
+	o      *DaemonOptions
+	status *daemonStatus
+}
+
+// NewDaemon creates a new instance of the Daemon interface
+func NewDaemon(do *DaemonOptions) *daemon {
+	return &daemon{
+		o:      do,
+		status: loadDaemonStatus(do.statusFile),
+	}
+}
+
+// Run backups all given devices on their schedule concurrently until ctx
+// is cancelled. Failed backups, e.g. because a device is turned off, are
+// retried after the retry interval. If metrics is not empty the status is
+// served as Prometheus metrics on this address.
+func (d *daemon) Run(ctx context.Context, devices []string, metrics string) error {
+	if metrics != "" {
+		if err := d.status.serveMetrics(ctx, metrics); err != nil {
+			return err
+		}
+	}
+	var wg sync.WaitGroup
+	for _, name := range devices {
+		every, _ := parseAge(rfm.GetDevice(name).BackupEvery)
+		log.Printf("Backing up %s every %s to %s", name, every, rfm.GetDevice(name).BackupDir)
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			d.schedule(ctx, name, every)
+		}(name)
+	}
+	wg.Wait()
+	return nil
+}
+
+// schedule runs the backups of a single device
+func (d *daemon) schedule(ctx context.Context, name string, every time.Duration) {
+
+	// Do not backup again right away after a restart
+	next := time.Now()
+	if last := d.status.get(name).LastSuccess; last != nil {
+		next = last.Add(every)
+	}
+
+	for {
+		d.status.update(name, func(bs *backupStatus) {
+			bs.NextRun = next
+		})
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		start := time.Now()
+		run, err := d.backup(ctx, name)
+		if ctx.Err() != nil {
+			return
+		}
+		duration := time.Since(start)
+		d.status.update(name, func(bs *backupStatus) {
+			bs.LastAttempt = start
+			bs.LastDuration = duration.Seconds()
+			bs.BytesTransferred += run.stats.bytes
+			bs.FilesChanged += run.stats.files
+			if err != nil {
+				bs.LastError = err.Error()
+				bs.Failures++
+				if errors.Is(err, ErrUnavailable) {
+					bs.ConnectionFailures++
+				}
+				return
+			}
+			bs.LastSuccess = &start
+			bs.LastError = ""
+			bs.Failures = 0
+			if run.stats.downloadTime > 0 {
+				bs.Throughput = run.stats.throughput()
+			}
+			bs.Volume = run.volume
+			bs.FreeSpace = run.freeSpace
+		})
+
+		next = start.Add(every)
+		if err != nil {
+			log.Printf("Backup of %s failed: %s", name, err)
+			if every > d.o.retry {
+				next = time.Now().Add(d.o.retry)
+			}
+			continue
+		}
+		log.Printf("Backup of %s finished in %s: %d files changed, %s transferred (%.1f KiB/s)",
+			name, duration.Round(time.Second), run.stats.files, humanSize(run.stats.bytes), run.stats.throughput())
+	}
+}
+
+// backupRun is the outcome of a single backup
+type backupRun struct {
+	stats     backupStats
+	volume    uint64
+	freeSpace *uint64
+}
+
+// backup runs a single backup of a device. Whatever has been transferred is
+// reported even if the backup fails.
+func (d *daemon) backup(ctx context.Context, name string) (backupRun, error) {
+	var run backupRun
+	dev := rfm.GetDevice(name)
+	bo := &BackupOptions{
+		BaseOptions: deviceOptions(name, d.o.verbose, d.o.debug),
+		outDir:      dev.BackupDir,
+		compare:     d.o.compare,
+		removeLocal: d.o.removeLocal,
+		git:         d.o.git,
+	}
+
+	// Backups of several devices run concurrently so their output is prefixed
+	bo.log = log.New(log.Writer(), name+": ", log.Flags()|log.Lmsgprefix)
+	if err := bo.resolve(); err != nil {
+		return run, err
+	}
+	if err := bo.Connect(ctx); err != nil {
+		return run, err
+	}
+	defer d.disconnect(name, bo.BaseOptions)
+	b := NewBackup(bo)
+	err := b.Backup(ctx, bo.dirToBackup, bo.outDir, bo.excls, bo.removeLocal)
+	run.stats = b.stats
+	if err != nil {
+		return run, err
+	}
+
+	// Free space is only informational so a failure is not fatal
+	run.volume = rfm.RemoteVolume(bo.dirToBackup)
+	if free, err := remoteFreeSpace(ctx, bo.Machine, bo.dirToBackup); err == nil {
+		run.freeSpace = &free
+	} else if d.o.verbose {
+		log.Printf("Unable to determine free space of %s: %s", name, err)
+	}
+	return run, nil
+}
+
+// disconnect ends the session of a backup run so idle sessions do not pile up
+// on the device between runs
+func (d *daemon) disconnect(name string, bo *BaseOptions) {
+
+	// The run might have ended because ctx was cancelled
+	ctx, cancel := context.WithTimeout(context.Background(), disconnectTimeout)
+	defer cancel()
+	if err := bo.Machine.Disconnect(ctx); err != nil {
+		log.Printf("Unable to disconnect from %s: %s", name, err)
+	}
+}
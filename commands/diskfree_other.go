@@ -0,0 +1,10 @@
+//go:build !linux && !darwin && !freebsd && !windows
+
+package commands
+
+import "errors"
+
+// localFreeSpace is not supported on this platform
+func localFreeSpace(path string) (uint64, error) {
+	return 0, errors.New("Determining free space is not supported on this platform")
+}
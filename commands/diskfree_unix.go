@@ -0,0 +1,15 @@
+//go:build linux || darwin || freebsd
+
+package commands
+
+import "golang.org/x/sys/unix"
+
+// localFreeSpace returns the number of bytes available to the user on
+// the file system containing path
+func localFreeSpace(path string) (uint64, error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+	return uint64(st.Bavail) * uint64(st.Bsize), nil
+}
@@ -2,6 +2,7 @@ package commands
 
 import (
 	"context"
+	"errors"
 	"log"
 	"os"
 
@@ -18,12 +19,14 @@ type DownloadOptions struct {
 }
 
 // Check checks all parameters for valid values
-func (d *DownloadOptions) Check() {
-	d.BaseOptions.Check()
+func (d *DownloadOptions) Check() error {
+	if err := d.BaseOptions.Check(); err != nil {
+		return err
+	}
 
 	d.remotePath = rfm.CleanRemotePath(d.remotePath)
 	if d.remotePath == "" {
-		log.Fatal("<remote/file> is mandatory")
+		return errors.New("<remote/file> is mandatory")
 	}
 
 	// Use same name as remote file if nothing is specified here
@@ -32,14 +35,17 @@ func (d *DownloadOptions) Check() {
 		d.localName = s[len(s)-1]
 	}
 	d.localName = rfm.GetAbsPath(d.localName)
+	return nil
 }
 
 // InitDownloadOptions initializes a DownloadOptions instance from command-line parameters
-func InitDownloadOptions(ctx context.Context, arguments []string) *DownloadOptions {
-	d := DownloadOptions{BaseOptions: &BaseOptions{}}
+func InitDownloadOptions(ctx context.Context, session *BaseOptions, arguments []string) (*DownloadOptions, error) {
+	d := DownloadOptions{BaseOptions: &BaseOptions{session: session}}
 
 	fs := d.GetFlagSet()
-	fs.Parse(arguments)
+	if err := fs.Parse(arguments); err != nil {
+		return nil, err
+	}
 
 	l := fs.NArg()
 	if l > 0 {
@@ -49,16 +55,23 @@ func InitDownloadOptions(ctx context.Context, arguments []string) *DownloadOptio
 		}
 	}
 
-	d.Check()
+	if err := d.Check(); err != nil {
+		return nil, err
+	}
 
-	d.Connect(ctx)
+	if err := d.Connect(ctx); err != nil {
+		return nil, err
+	}
 
-	return &d
+	return &d, nil
 }
 
 // DoDownload is a convenience method to run a download form command-line parameters
-func DoDownload(ctx context.Context, arguments []string) error {
-	do := InitDownloadOptions(ctx, arguments)
+func DoDownload(ctx context.Context, session *BaseOptions, arguments []string) error {
+	do, err := InitDownloadOptions(ctx, session, arguments)
+	if err != nil {
+		return err
+	}
 	return NewDownload(do).Download(ctx, do.remotePath, do.localName)
 }
 
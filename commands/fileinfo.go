@@ -2,8 +2,8 @@ package commands
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"log"
 	"strings"
 	"time"
 
@@ -19,37 +19,49 @@ type FileinfoOptions struct {
 }
 
 // Check checks all parameters for valid values
-func (f *FileinfoOptions) Check() {
-	f.BaseOptions.Check()
+func (f *FileinfoOptions) Check() error {
+	if err := f.BaseOptions.Check(); err != nil {
+		return err
+	}
 
 	if f.path == "" {
-		log.Fatal("-path is mandatory")
+		return errors.New("-path is mandatory")
 	}
 	f.path = rfm.CleanRemotePath(f.path)
+	return nil
 }
 
 // InitFileinfoOptions inializes a FileinfoOptions instance from command-line parameters
-func InitFileinfoOptions(ctx context.Context, arguments []string) *FileinfoOptions {
-	f := FileinfoOptions{BaseOptions: &BaseOptions{}}
+func InitFileinfoOptions(ctx context.Context, session *BaseOptions, arguments []string) (*FileinfoOptions, error) {
+	f := FileinfoOptions{BaseOptions: &BaseOptions{session: session}}
 
 	fs := f.GetFlagSet()
 	fs.BoolVar(&f.humanReadable, "h", false, "Display size in human readable units")
-	fs.Parse(arguments)
+	if err := fs.Parse(arguments); err != nil {
+		return nil, err
+	}
 
 	if fs.NArg() > 0 {
 		f.path = fs.Arg(0)
 	}
 
-	f.Check()
+	if err := f.Check(); err != nil {
+		return nil, err
+	}
 
-	f.Connect(ctx)
+	if err := f.Connect(ctx); err != nil {
+		return nil, err
+	}
 
-	return &f
+	return &f, nil
 }
 
 // DoFileinfo is a convenience function to run a download from command-line parameters
-func DoFileinfo(ctx context.Context, arguments []string) error {
-	fo := InitFileinfoOptions(ctx, arguments)
+func DoFileinfo(ctx context.Context, session *BaseOptions, arguments []string) error {
+	fo, err := InitFileinfoOptions(ctx, session, arguments)
+	if err != nil {
+		return err
+	}
 	return NewFileinfo(fo).Fileinfo(ctx, fo.path)
 }
 
@@ -100,14 +112,24 @@ func (f *fileinfo) print(path string, fi *librfm.Fileinfo) {
 }
 
 func (f *fileinfo) getPrintTime(seconds uint64) string {
-	if f.o.humanReadable {
+	return formatPrintTime(seconds, f.o.humanReadable)
+}
+
+func (f *fileinfo) getFilamentUsage(filaments []float64) string {
+	return formatFilamentUsage(filaments)
+}
+
+// formatPrintTime formats the estimated print time of a file
+func formatPrintTime(seconds uint64, humanReadable bool) string {
+	if humanReadable {
 		d := time.Duration(time.Duration(seconds) * time.Second)
 		return d.String()
 	}
 	return fmt.Sprintf("%ds", seconds)
 }
 
-func (f *fileinfo) getFilamentUsage(filaments []float64) string {
+// formatFilamentUsage formats the filament usage per extruder of a file
+func formatFilamentUsage(filaments []float64) string {
 	if len(filaments) == 1 {
 		return fmt.Sprintf("%.1fmm", filaments[0])
 	}
@@ -0,0 +1,346 @@
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/wilriker/librfm/v2"
+	"github.com/wilriker/rfm"
+)
+
+const (
+	// FirmwareDir is the location of firmware binaries in RepRapFirmware 3
+	FirmwareDir = "0:/firmware"
+	// firmwareDirLegacy is used by older firmware versions
+	firmwareDirLegacy      = "0:/sys"
+	boardMain              = "main"
+	boardWifi              = "wifi"
+	boardExpansionPrefix   = "expansion:"
+	firmwareUpdateSubcmd   = "update"
+	defaultRestartTimeout  = 5 * time.Minute
+	firmwareRestartDelay   = 5 * time.Second
+	firmwareReconnectDelay = 2 * time.Second
+	// defaultWifiFirmwareFile is the binary M997 S1 installs if the firmware
+	// does not report it
+	defaultWifiFirmwareFile = "DuetWiFiServer.bin"
+	// expansionFirmwareFormat is the binary M997 B<n> installs if the firmware
+	// does not report it. It takes the short name of the board.
+	expansionFirmwareFormat = "Duet3Firmware_%s.bin"
+)
+
+// FirmwareOptions holds the specific parameters for firmware
+type FirmwareOptions struct {
+	*BaseOptions
+	localFile      string
+	board          string
+	canAddr        uint64
+	timeout        time.Duration
+	forceProtected bool
+}
+
+// Check checks all parameters for valid values
+func (f *FirmwareOptions) Check() error {
+	if err := f.BaseOptions.Check(); err != nil {
+		return err
+	}
+
+	if f.localFile == "" {
+		return errors.New("<local/firmware.bin> is mandatory")
+	}
+	f.localFile = rfm.GetAbsPath(f.localFile)
+
+	switch {
+	case f.board == boardMain, f.board == boardWifi:
+	case strings.HasPrefix(f.board, boardExpansionPrefix):
+		addr, err := strconv.ParseUint(strings.TrimPrefix(f.board, boardExpansionPrefix), 10, 8)
+		if err != nil {
+			return fmt.Errorf("Invalid CAN address for -board: %s", f.board)
+		}
+		f.canAddr = addr
+	default:
+		return fmt.Errorf("Invalid value for -board: %s", f.board)
+	}
+	return nil
+}
+
+// InitFirmwareOptions initializes a FirmwareOptions instance from command-line parameters
+func InitFirmwareOptions(ctx context.Context, session *BaseOptions, arguments []string) (*FirmwareOptions, error) {
+	f := FirmwareOptions{BaseOptions: &BaseOptions{session: session}}
+
+	if len(arguments) == 0 || arguments[0] != firmwareUpdateSubcmd {
+		return nil, errors.New("Usage: rfm firmware update <local/firmware.bin>")
+	}
+
+	fs := f.GetFlagSet()
+	fs.StringVar(&f.board, "board", boardMain, "Board to update: main, wifi or expansion:<CAN address>")
+	fs.DurationVar(&f.timeout, "timeout", defaultRestartTimeout, "Time to wait for the new firmware version")
+	fs.BoolVar(&f.forceProtected, "force-protected", false, "Also overwrite firmware files protected by the config")
+	if err := fs.Parse(arguments[1:]); err != nil {
+		return nil, err
+	}
+
+	// Allow options to follow the firmware file
+	if fs.NArg() > 0 {
+		f.localFile = fs.Arg(0)
+		if err := fs.Parse(fs.Args()[1:]); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := f.Check(); err != nil {
+		return nil, err
+	}
+
+	if err := f.Connect(ctx); err != nil {
+		return nil, err
+	}
+
+	return &f, nil
+}
+
+// DoFirmware is a convenience function to run firmware from command-line parameters
+func DoFirmware(ctx context.Context, session *BaseOptions, arguments []string) error {
+	fo, err := InitFirmwareOptions(ctx, session, arguments)
+	if err != nil {
+		return err
+	}
+	return NewFirmware(fo).Update(ctx, fo.localFile)
+}
+
+// firmware implements the Firmware interface
+type firmware struct {
+	o *FirmwareOptions
+}
+
+// NewFirmware creates a new instance of the Firmware interface
+func NewFirmware(fo *FirmwareOptions) *firmware {
+	return &firmware{
+		o: fo,
+	}
+}
+
+// Update uploads a firmware binary, verifies it, installs it via M997 and
+// waits for the device to report a new firmware version
+func (f *firmware) Update(ctx context.Context, localFile string) error {
+	fi, err := os.Stat(localFile)
+	if err != nil {
+		return err
+	}
+
+	// Only the main board can be updated from a binary of any name
+	expected, err := f.firmwareFileName(ctx)
+	if err != nil {
+		return err
+	}
+	if expected != "" && !strings.EqualFold(filepath.Base(localFile), expected) {
+		return fmt.Errorf("The firmware installs the %s binary from %s, not %s. Rename the file before updating", f.o.board, expected, filepath.Base(localFile))
+	}
+
+	oldVersion, err := f.version(ctx)
+	if err != nil {
+		return err
+	}
+	log.Printf("Current firmware version of %s: %s", f.o.board, oldVersion)
+
+	dir, err := f.firmwareDir(ctx)
+	if err != nil {
+		return err
+	}
+	remotePath := fmt.Sprintf("%s/%s", dir, filepath.Base(localFile))
+
+	log.Println("Uploading", localFile, "to", remotePath)
+	uo := &UploadOptions{BaseOptions: f.o.BaseOptions, forceProtected: f.o.forceProtected}
+	if err = NewUpload(uo).Upload(ctx, localFile, dir); err != nil {
+		return err
+	}
+
+	// Make sure the binary arrived completely before flashing it
+	rfi, err := f.o.Rfm.Fileinfo(ctx, remotePath)
+	if err != nil {
+		return err
+	}
+	if rfi.Size != uint64(fi.Size()) {
+		return fmt.Errorf("Uploaded firmware has %d bytes instead of %d. Not installing it", rfi.Size, fi.Size())
+	}
+
+	code := f.updateCode(remotePath)
+	log.Println("Installing firmware with", code)
+	if err = f.o.Machine.SendGcode(ctx, code); err != nil {
+		return err
+	}
+
+	newVersion, err := f.waitForNewVersion(ctx, oldVersion)
+	if err != nil {
+		return err
+	}
+	log.Printf("New firmware version of %s: %s", f.o.board, newVersion)
+	return nil
+}
+
+// firmwareDir returns the directory firmware binaries are expected in
+func (f *firmware) firmwareDir(ctx context.Context) (string, error) {
+	_, err := f.o.Rfm.Filelist(ctx, FirmwareDir, false)
+	if err == librfm.ErrDirectoryNotFound {
+		return firmwareDirLegacy, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return FirmwareDir, nil
+}
+
+// firmwareFileName returns the file name M997 installs for the selected board
+// or an empty string if it can be given explicitly
+func (f *firmware) firmwareFileName(ctx context.Context) (string, error) {
+	switch f.o.board {
+	case boardMain:
+		return "", nil
+	case boardWifi:
+		result, err := f.o.Machine.Model(ctx, "boards[0].wifiFirmwareFileName", rfm.ModelFlagsDefault)
+		if errors.Is(err, rfm.ErrNoSuchKey) {
+			return defaultWifiFirmwareFile, nil
+		}
+		if err != nil {
+			return "", err
+		}
+		var name string
+		if err = json.Unmarshal(result, &name); err != nil || name == "" {
+			return defaultWifiFirmwareFile, nil
+		}
+		return name, nil
+	default:
+		b, err := f.expansionBoard(ctx)
+		if err != nil {
+			return "", err
+		}
+		if b.FirmwareFileName != "" {
+			return b.FirmwareFileName, nil
+		}
+		return fmt.Sprintf(expansionFirmwareFormat, b.ShortName), nil
+	}
+}
+
+// updateCode returns the M997 command to update the selected board
+func (f *firmware) updateCode(remotePath string) string {
+	switch f.o.board {
+	case boardWifi:
+		return "M997 S1"
+	case boardMain:
+		return "M997 S0 P" + quoteGcodeString(remotePath)
+	default:
+		return fmt.Sprintf("M997 B%d", f.o.canAddr)
+	}
+}
+
+// waitForNewVersion waits for the device to come back after the update and
+// returns the new firmware version of the selected board. The version is
+// polled until it changes as the main board keeps answering with the old one
+// until it resets and does not reset at all for updates of other boards. A
+// main board that was gone and comes back with the old version had the same
+// version installed again. Otherwise the update failed if the version does
+// not change within the timeout.
+func (f *firmware) waitForNewVersion(ctx context.Context, oldVersion string) (string, error) {
+	deadline := time.Now().Add(f.o.timeout)
+	delay := firmwareRestartDelay
+	restarted := false
+	for {
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(delay):
+		}
+		version, err := f.version(ctx)
+		if err != nil {
+
+			// The session is gone after a reset
+			restarted = true
+			if err = f.o.Rfm.Connect(ctx, f.o.password); err == nil {
+				version, err = f.version(ctx)
+			}
+		}
+		if err == nil && version != oldVersion {
+			return version, nil
+		}
+		if err == nil && restarted && f.o.board == boardMain {
+			log.Printf("Device restarted with the same firmware version %s", version)
+			return version, nil
+		}
+		if f.o.verbose {
+			if err != nil {
+				log.Println("Waiting for device:", err)
+			} else {
+				log.Println("Waiting for new firmware version. Still running", version)
+			}
+		}
+		if time.Now().After(deadline) {
+			if err != nil {
+				return "", fmt.Errorf("Device did not come back within %s", f.o.timeout)
+			}
+			return "", fmt.Errorf("Firmware version of %s is still %s after %s. The update failed or installed the same version", f.o.board, version, f.o.timeout)
+		}
+		delay = firmwareReconnectDelay
+	}
+}
+
+// version reads the firmware version of the selected board from the object model
+func (f *firmware) version(ctx context.Context) (string, error) {
+	key := "boards[0].firmwareVersion"
+	switch f.o.board {
+	case boardWifi:
+		key = "network.interfaces[0].firmwareVersion"
+	case boardMain:
+	default:
+		return f.expansionVersion(ctx)
+	}
+	result, err := f.o.Machine.Model(ctx, key, rfm.ModelFlagsDefault)
+	if err != nil {
+		return "", err
+	}
+	var version string
+	err = json.Unmarshal(result, &version)
+	return version, err
+}
+
+// expansionBoard describes an expansion board in the object model
+type expansionBoard struct {
+	CanAddress       uint64
+	ShortName        string
+	FirmwareFileName string
+	FirmwareVersion  string
+}
+
+// expansionVersion returns the firmware version of the expansion board with
+// the selected CAN address
+func (f *firmware) expansionVersion(ctx context.Context) (string, error) {
+	b, err := f.expansionBoard(ctx)
+	if err != nil {
+		return "", err
+	}
+	return b.FirmwareVersion, nil
+}
+
+// expansionBoard finds the expansion board with the selected CAN address
+func (f *firmware) expansionBoard(ctx context.Context) (*expansionBoard, error) {
+	result, err := f.o.Machine.Model(ctx, "boards", rfm.ModelFlagsDefault)
+	if err != nil {
+		return nil, err
+	}
+	var boards []expansionBoard
+	if err = json.Unmarshal(result, &boards); err != nil {
+		return nil, err
+	}
+	for _, b := range boards {
+		if b.CanAddress == f.o.canAddr {
+			return &b, nil
+		}
+	}
+	return nil, fmt.Errorf("No expansion board with CAN address %d", f.o.canAddr)
+}
@@ -0,0 +1,80 @@
+package commands
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/wilriker/rfm"
+)
+
+// FuseOptions holds the specific parameters for fuse
+type FuseOptions struct {
+	*BaseOptions
+	mountpoint string
+	cacheTime  time.Duration
+}
+
+// Check checks all parameters for valid values
+func (f *FuseOptions) Check() error {
+	if err := f.BaseOptions.Check(); err != nil {
+		return err
+	}
+
+	if f.mountpoint == "" {
+		return errors.New("<mountpoint> is mandatory")
+	}
+	f.mountpoint = rfm.GetAbsPath(f.mountpoint)
+	if fi, err := os.Stat(f.mountpoint); err != nil || !fi.IsDir() {
+		return fmt.Errorf("Invalid mountpoint: %s", f.mountpoint)
+	}
+	if f.cacheTime < 0 {
+		return fmt.Errorf("Invalid value for -cache: %s", f.cacheTime)
+	}
+	return nil
+}
+
+// InitFuseOptions initializes a FuseOptions instance from command-line parameters
+func InitFuseOptions(ctx context.Context, session *BaseOptions, arguments []string) (*FuseOptions, error) {
+	f := FuseOptions{BaseOptions: &BaseOptions{session: session}}
+
+	fs := f.GetFlagSet()
+	fs.DurationVar(&f.cacheTime, "cache", defaultCacheTime, "Reuse directory listings and attributes for this long")
+	if err := fs.Parse(arguments); err != nil {
+		return nil, err
+	}
+	f.mountpoint = fs.Arg(0)
+
+	if err := f.Check(); err != nil {
+		return nil, err
+	}
+
+	if err := f.Connect(ctx); err != nil {
+		return nil, err
+	}
+
+	return &f, nil
+}
+
+// DoFuse is a convenience function to run fuse from command-line parameters
+func DoFuse(ctx context.Context, session *BaseOptions, arguments []string) error {
+	fo, err := InitFuseOptions(ctx, session, arguments)
+	if err != nil {
+		return err
+	}
+	return NewFuseMount(fo).Mount(ctx, fo.mountpoint)
+}
+
+// fuseMount implements the FuseMount interface
+type fuseMount struct {
+	o *FuseOptions
+}
+
+// NewFuseMount creates a new instance of the FuseMount interface
+func NewFuseMount(fo *FuseOptions) *fuseMount {
+	return &fuseMount{
+		o: fo,
+	}
+}
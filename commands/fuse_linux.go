@@ -0,0 +1,469 @@
+//go:build linux
+
+package commands
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	fusefs "github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/wilriker/librfm/v2"
+	"github.com/wilriker/rfm"
+	"golang.org/x/sys/unix"
+)
+
+// fuseNode is a file or directory in a FUSE mount of the device. Its remote
+// path is derived from its position in the tree so it stays valid across
+// renames.
+type fuseNode struct {
+	fusefs.Inode
+	rfs *remoteFS
+	ttl time.Duration
+}
+
+var (
+	_ fusefs.NodeGetattrer = (*fuseNode)(nil)
+	_ fusefs.NodeSetattrer = (*fuseNode)(nil)
+	_ fusefs.NodeLookuper  = (*fuseNode)(nil)
+	_ fusefs.NodeReaddirer = (*fuseNode)(nil)
+	_ fusefs.NodeOpener    = (*fuseNode)(nil)
+	_ fusefs.NodeCreater   = (*fuseNode)(nil)
+	_ fusefs.NodeMkdirer   = (*fuseNode)(nil)
+	_ fusefs.NodeUnlinker  = (*fuseNode)(nil)
+	_ fusefs.NodeRmdirer   = (*fuseNode)(nil)
+	_ fusefs.NodeRenamer   = (*fuseNode)(nil)
+)
+
+// toErrno converts an error of a remote operation into the matching errno.
+// Unexpected errors are logged because the caller only gets EIO.
+func toErrno(err error) syscall.Errno {
+	var pe *protectedError
+	switch {
+	case err == nil:
+		return 0
+	case isNotExist(err):
+		return syscall.ENOENT
+	case errors.Is(err, fs.ErrExist):
+		return syscall.EEXIST
+	case errors.Is(err, fs.ErrPermission):
+		return syscall.EPERM
+	case errors.As(err, &pe):
+		log.Println(err)
+		return syscall.EACCES
+	}
+	log.Println(err)
+	return syscall.EIO
+}
+
+// fillAttr sets the attributes of a remote file or directory
+func fillAttr(file *librfm.File, out *fuse.Attr) {
+	if file.IsDir() {
+		out.Mode = syscall.S_IFDIR | 0755
+	} else {
+		out.Mode = syscall.S_IFREG | 0644
+	}
+	out.Size = file.Size
+	out.Blocks = (file.Size + 511) / 512
+	out.Nlink = 1
+	mtime := file.Date()
+	out.SetTimes(&mtime, &mtime, &mtime)
+}
+
+// remotePath returns the path of the node on the device. The root of the
+// mount results in an empty path.
+func (n *fuseNode) remotePath() (string, error) {
+	return remotePathOf(n.Path(nil))
+}
+
+// childPath returns the path of a child of the node on the device
+func (n *fuseNode) childPath(name string) (string, error) {
+	return remotePathOf(path.Join(n.Path(nil), name))
+}
+
+// newChild returns the inode for a child reusing an existing one if possible
+func (n *fuseNode) newChild(ctx context.Context, name string, isDir bool) *fusefs.Inode {
+	mode := uint32(syscall.S_IFREG)
+	if isDir {
+		mode = syscall.S_IFDIR
+	}
+	if child := n.GetChild(name); child != nil && child.Mode() == mode {
+		return child
+	}
+	return n.NewInode(ctx, &fuseNode{rfs: n.rfs, ttl: n.ttl}, fusefs.StableAttr{Mode: mode})
+}
+
+// stat returns the remote file or directory of the node
+func (n *fuseNode) stat(ctx context.Context) (*librfm.File, error) {
+	remotePath, err := n.remotePath()
+	if err != nil {
+		return nil, err
+	}
+	if remotePath == "" {
+		return &librfm.File{Type: remoteTypeDir}, nil
+	}
+	return n.rfs.stat(ctx, remotePath)
+}
+
+func (n *fuseNode) Getattr(ctx context.Context, fh fusefs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	if f, ok := fh.(*fuseFile); ok {
+		return f.Getattr(ctx, out)
+	}
+	file, err := n.stat(ctx)
+	if err != nil {
+		return toErrno(err)
+	}
+	fillAttr(file, &out.Attr)
+	out.SetTimeout(n.ttl)
+	return 0
+}
+
+// Setattr only supports changing the size. Other changes like times or
+// permissions cannot be stored on the device and are ignored so tools like
+// rsync or cp -p do not fail.
+func (n *fuseNode) Setattr(ctx context.Context, fh fusefs.FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	if size, ok := in.GetSize(); ok {
+		f, ok := fh.(*fuseFile)
+		if !ok {
+			f = &fuseFile{n: n}
+		}
+		if errno := f.truncate(ctx, size); errno != 0 {
+			return errno
+		}
+		if !ok {
+			if errno := f.Flush(ctx); errno != 0 {
+				return errno
+			}
+		}
+	}
+	return n.Getattr(ctx, fh, out)
+}
+
+func (n *fuseNode) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fusefs.Inode, syscall.Errno) {
+	childPath, err := n.childPath(name)
+	if err != nil {
+		return nil, toErrno(err)
+	}
+	file, err := n.rfs.stat(ctx, childPath)
+	if err != nil {
+		return nil, toErrno(err)
+	}
+	fillAttr(file, &out.Attr)
+	out.SetEntryTimeout(n.ttl)
+	out.SetAttrTimeout(n.ttl)
+	return n.newChild(ctx, name, file.IsDir()), 0
+}
+
+// Readdir lists a remote directory. The root contains the mounted volumes.
+func (n *fuseNode) Readdir(ctx context.Context) (fusefs.DirStream, syscall.Errno) {
+	remotePath, err := n.remotePath()
+	if err != nil {
+		return nil, toErrno(err)
+	}
+	entries := make([]fuse.DirEntry, 0)
+	if remotePath == "" {
+		vols, err := n.rfs.volumes(ctx)
+		if err != nil {
+			return nil, toErrno(err)
+		}
+		for _, v := range vols {
+			entries = append(entries, fuse.DirEntry{Name: strconv.FormatUint(v, 10), Mode: syscall.S_IFDIR})
+		}
+		return fusefs.NewListDirStream(entries), 0
+	}
+	files, err := n.rfs.list(ctx, remotePath)
+	if err != nil {
+		return nil, toErrno(err)
+	}
+	for _, f := range files {
+		mode := uint32(syscall.S_IFREG)
+		if f.IsDir() {
+			mode = syscall.S_IFDIR
+		}
+		entries = append(entries, fuse.DirEntry{Name: f.Name, Mode: mode})
+	}
+	return fusefs.NewListDirStream(entries), 0
+}
+
+func (n *fuseNode) Open(ctx context.Context, flags uint32) (fusefs.FileHandle, uint32, syscall.Errno) {
+	f := &fuseFile{n: n}
+	if flags&syscall.O_TRUNC != 0 && flags&syscall.O_ACCMODE != syscall.O_RDONLY {
+		f.content = make([]byte, 0)
+		f.loaded = true
+		f.dirty = true
+	}
+	return f, 0, 0
+}
+
+// Create creates an empty file that is uploaded once it is closed
+func (n *fuseNode) Create(ctx context.Context, name string, flags uint32, mode uint32, out *fuse.EntryOut) (*fusefs.Inode, fusefs.FileHandle, uint32, syscall.Errno) {
+	childPath, err := n.childPath(name)
+	if err != nil {
+		return nil, nil, 0, toErrno(err)
+	}
+	if _, err = n.rfs.stat(ctx, childPath); err == nil && flags&syscall.O_EXCL != 0 {
+		return nil, nil, 0, syscall.EEXIST
+	}
+	child := n.newChild(ctx, name, false)
+	f := &fuseFile{n: child.Operations().(*fuseNode), content: make([]byte, 0), loaded: true, dirty: true}
+	fillAttr(&librfm.File{Name: name}, &out.Attr)
+	now := time.Now()
+	out.SetTimes(&now, &now, &now)
+	return child, f, 0, 0
+}
+
+func (n *fuseNode) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.EntryOut) (*fusefs.Inode, syscall.Errno) {
+	childPath, err := n.childPath(name)
+	if err != nil {
+		return nil, toErrno(err)
+	}
+	if err = n.rfs.mkdir(ctx, childPath); err != nil {
+		return nil, toErrno(err)
+	}
+	now := time.Now()
+	fillAttr(&librfm.File{Type: remoteTypeDir, Name: name}, &out.Attr)
+	out.SetTimes(&now, &now, &now)
+	return n.newChild(ctx, name, true), 0
+}
+
+func (n *fuseNode) Unlink(ctx context.Context, name string) syscall.Errno {
+	childPath, err := n.childPath(name)
+	if err != nil {
+		return toErrno(err)
+	}
+	file, err := n.rfs.stat(ctx, childPath)
+	if err != nil {
+		return toErrno(err)
+	}
+	if file.IsDir() {
+		return syscall.EISDIR
+	}
+	return toErrno(n.rfs.remove(ctx, childPath))
+}
+
+func (n *fuseNode) Rmdir(ctx context.Context, name string) syscall.Errno {
+	childPath, err := n.childPath(name)
+	if err != nil {
+		return toErrno(err)
+	}
+	files, err := n.rfs.list(ctx, childPath)
+	if err != nil {
+		return toErrno(err)
+	}
+	if len(files) > 0 {
+		return syscall.ENOTEMPTY
+	}
+	return toErrno(n.rfs.remove(ctx, childPath))
+}
+
+// Rename replaces existing files like rename(2) does because editors and
+// rsync rely on that to update files
+func (n *fuseNode) Rename(ctx context.Context, name string, newParent fusefs.InodeEmbedder, newName string, flags uint32) syscall.Errno {
+	if flags&unix.RENAME_EXCHANGE != 0 {
+		return syscall.ENOTSUP
+	}
+	oldPath, err := n.childPath(name)
+	if err != nil {
+		return toErrno(err)
+	}
+	newPath, err := remotePathOf(path.Join(newParent.EmbeddedInode().Path(nil), newName))
+	if err != nil {
+		return toErrno(err)
+	}
+	return toErrno(n.rfs.rename(ctx, oldPath, newPath, flags&unix.RENAME_NOREPLACE == 0))
+}
+
+// fuseFile is an open file. Its content is downloaded on first access and
+// uploaded when it is closed after it has been changed. A shared content
+// belongs to the cache and is copied before it is changed.
+type fuseFile struct {
+	mu      sync.Mutex
+	n       *fuseNode
+	content []byte
+	shared  bool
+	loaded  bool
+	dirty   bool
+}
+
+var (
+	_ fusefs.FileReader    = (*fuseFile)(nil)
+	_ fusefs.FileWriter    = (*fuseFile)(nil)
+	_ fusefs.FileFlusher   = (*fuseFile)(nil)
+	_ fusefs.FileFsyncer   = (*fuseFile)(nil)
+	_ fusefs.FileGetattrer = (*fuseFile)(nil)
+)
+
+// load fetches the content of the file. f.mu must be held.
+func (f *fuseFile) load(ctx context.Context) syscall.Errno {
+	if f.loaded {
+		return 0
+	}
+	remotePath, err := f.n.remotePath()
+	if err != nil {
+		return toErrno(err)
+	}
+	content, err := f.n.rfs.read(ctx, remotePath)
+	if err != nil {
+		return toErrno(err)
+	}
+	f.content = content
+	f.shared = true
+	f.loaded = true
+	return 0
+}
+
+// unshare copies the content if it belongs to the cache so it can be
+// changed. f.mu must be held.
+func (f *fuseFile) unshare() {
+	if f.shared {
+		f.content = append(make([]byte, 0, len(f.content)), f.content...)
+		f.shared = false
+	}
+}
+
+func (f *fuseFile) Read(ctx context.Context, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if errno := f.load(ctx); errno != 0 {
+		return nil, errno
+	}
+	if off >= int64(len(f.content)) {
+		return fuse.ReadResultData(nil), 0
+	}
+	end := off + int64(len(dest))
+	if end > int64(len(f.content)) {
+		end = int64(len(f.content))
+	}
+	return fuse.ReadResultData(f.content[off:end]), 0
+}
+
+func (f *fuseFile) Write(ctx context.Context, data []byte, off int64) (uint32, syscall.Errno) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if errno := f.load(ctx); errno != 0 {
+		return 0, errno
+	}
+	f.unshare()
+	if end := off + int64(len(data)); end > int64(len(f.content)) {
+		f.content = append(f.content, make([]byte, end-int64(len(f.content)))...)
+	}
+	copy(f.content[off:], data)
+	f.dirty = true
+	return uint32(len(data)), 0
+}
+
+// truncate changes the size of the file
+func (f *fuseFile) truncate(ctx context.Context, size uint64) syscall.Errno {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if size == 0 {
+		f.content = make([]byte, 0)
+		f.shared = false
+		f.loaded = true
+	} else if errno := f.load(ctx); errno != 0 {
+		return errno
+	}
+	f.unshare()
+	if size < uint64(len(f.content)) {
+		f.content = f.content[:size]
+	} else {
+		f.content = append(f.content, make([]byte, size-uint64(len(f.content)))...)
+	}
+	f.dirty = true
+	return 0
+}
+
+// Flush uploads the file if it has been changed. It is called on each close
+// of the file.
+func (f *fuseFile) Flush(ctx context.Context) syscall.Errno {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.dirty {
+		return 0
+	}
+	remotePath, err := f.n.remotePath()
+	if err != nil {
+		return toErrno(err)
+	}
+	if err = f.n.rfs.write(ctx, remotePath, f.content); err != nil {
+		return toErrno(err)
+	}
+	f.dirty = false
+	return 0
+}
+
+func (f *fuseFile) Fsync(ctx context.Context, flags uint32) syscall.Errno {
+	return f.Flush(ctx)
+}
+
+func (f *fuseFile) Getattr(ctx context.Context, out *fuse.AttrOut) syscall.Errno {
+	f.mu.Lock()
+	loaded, dirty, size := f.loaded, f.dirty, uint64(len(f.content))
+	f.mu.Unlock()
+
+	file, err := f.n.stat(ctx)
+	if err != nil && !(dirty && isNotExist(err)) {
+		return toErrno(err)
+	}
+	if file == nil {
+		file = &librfm.File{}
+	}
+	fillAttr(file, &out.Attr)
+	if loaded {
+		out.Size = size
+		out.Blocks = (size + 511) / 512
+	}
+	if dirty {
+		now := time.Now()
+		out.SetTimes(nil, &now, nil)
+	}
+	out.SetTimeout(f.n.ttl)
+	return 0
+}
+
+// Mount mounts the volumes of the device at mountpoint and serves the
+// filesystem until ctx is cancelled
+func (m *fuseMount) Mount(ctx context.Context, mountpoint string) error {
+	ttl := m.o.cacheTime
+	root := &fuseNode{
+		rfs: newRemoteFS(m.o.BaseOptions, ttl, rfm.GetDevice(m.o.device).TrashEnabled()),
+		ttl: ttl,
+	}
+	server, err := fusefs.Mount(mountpoint, root, &fusefs.Options{
+		MountOptions: fuse.MountOptions{
+			FsName: "rfm:" + m.o.device,
+			Name:   "rfm",
+			Debug:  m.o.debug,
+
+			// Works without fusermount if run as root
+			DirectMount: true,
+		},
+		EntryTimeout:    &ttl,
+		AttrTimeout:     &ttl,
+		NegativeTimeout: &ttl,
+		UID:             uint32(os.Getuid()),
+		GID:             uint32(os.Getgid()),
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("Mounted %s at %s. Interrupt to unmount", m.o.device, mountpoint)
+
+	go func() {
+		<-ctx.Done()
+		for server.Unmount() != nil {
+			log.Println("Unable to unmount", mountpoint, "as it is still in use. Retrying")
+			time.Sleep(time.Second)
+		}
+	}()
+	server.Wait()
+	return nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package commands
+
+import (
+	"context"
+	"errors"
+)
+
+// Mount is only available on Linux
+func (m *fuseMount) Mount(ctx context.Context, mountpoint string) error {
+	return errors.New("Mounting the device as a filesystem is only supported on Linux")
+}
@@ -0,0 +1,102 @@
+package commands
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultReplyTimeout is how long to wait for the reply to a G-code command
+	defaultReplyTimeout = 2 * time.Second
+)
+
+// GcodeOptions holds the specific parameters for gcode
+type GcodeOptions struct {
+	*BaseOptions
+	codes   []string
+	timeout time.Duration
+}
+
+// Check checks all parameters for valid values
+func (g *GcodeOptions) Check() error {
+	if err := g.BaseOptions.Check(); err != nil {
+		return err
+	}
+
+	if len(g.codes) == 0 {
+		return errors.New("<gcode> is mandatory")
+	}
+	return nil
+}
+
+// InitGcodeOptions initializes a GcodeOptions instance from command-line parameters
+func InitGcodeOptions(ctx context.Context, session *BaseOptions, arguments []string) (*GcodeOptions, error) {
+	g := GcodeOptions{BaseOptions: &BaseOptions{session: session}}
+
+	fs := g.GetFlagSet()
+	fs.DurationVar(&g.timeout, "timeout", defaultReplyTimeout, "Time to wait for a reply")
+	if err := fs.Parse(arguments); err != nil {
+		return nil, err
+	}
+
+	g.codes = fs.Args()
+
+	if err := g.Check(); err != nil {
+		return nil, err
+	}
+
+	if err := g.Connect(ctx); err != nil {
+		return nil, err
+	}
+
+	return &g, nil
+}
+
+// DoGcode is a convenience function to run gcode from command-line parameters
+func DoGcode(ctx context.Context, session *BaseOptions, arguments []string) error {
+	gco, err := InitGcodeOptions(ctx, session, arguments)
+	if err != nil {
+		return err
+	}
+	return NewGcode(gco).Gcode(ctx, gco.codes, gco.timeout)
+}
+
+// gcode implements the Gcode interface
+type gcode struct {
+	o *GcodeOptions
+}
+
+// NewGcode creates a new instance of the Gcode interface
+func NewGcode(gco *GcodeOptions) *gcode {
+	return &gcode{
+		o: gco,
+	}
+}
+
+// Gcode sends each of the given commands to the device and prints
+// its reply to stdout
+func (g *gcode) Gcode(ctx context.Context, codes []string, timeout time.Duration) error {
+	for _, code := range codes {
+		if g.o.verbose {
+			log.Println("Sending", code)
+		}
+		reply, err := g.o.Machine.Gcode(ctx, code, timeout)
+		if err != nil {
+			return err
+		}
+		if reply != "" {
+			fmt.Println(reply)
+		}
+	}
+	return nil
+}
+
+// quoteGcodeString quotes s as a G-code string parameter. Quotes inside of s
+// are doubled as this is how RepRapFirmware escapes them.
+func quoteGcodeString(s string) string {
+	return `"` + strings.ReplaceAll(s, `"`, `""`) + `"`
+}
@@ -0,0 +1,20 @@
+package commands
+
+import "testing"
+
+func TestQuoteGcodeString(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"0:/gcodes/part.gcode", `"0:/gcodes/part.gcode"`},
+		{"", `""`},
+		{`0:/gcodes/6" part.gcode`, `"0:/gcodes/6"" part.gcode"`},
+		{`""`, `""""""`},
+	}
+	for _, tt := range tests {
+		if got := quoteGcodeString(tt.in); got != tt.want {
+			t.Errorf("quoteGcodeString(%q) = %s, want %s", tt.in, got, tt.want)
+		}
+	}
+}
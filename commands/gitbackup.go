@@ -0,0 +1,189 @@
+package commands
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	gitBinary        = "git"
+	gitDirName       = ".git"
+	gitExcludeFile   = "info/exclude"
+	gitFallbackName  = "rfm"
+	gitFallbackEmail = "rfm@localhost"
+)
+
+// gitIgnoredFiles are files of rfm itself that change on every run and are
+// therefore not committed
+var gitIgnoredFiles = []string{managedDirMarker, manifestFileName, hashCacheFileName}
+
+// checkGit makes sure the git binary is installed so a missing one is noticed
+// before a backup instead of after it
+func checkGit() error {
+	if _, err := exec.LookPath(gitBinary); err != nil {
+		return fmt.Errorf("-git needs git to be installed: %w", err)
+	}
+	return nil
+}
+
+// gitRepo runs the local git binary on a backup directory
+type gitRepo struct {
+	dir     string
+	verbose bool
+	log     *log.Logger
+
+	// config holds settings passed to every git command
+	config []string
+}
+
+// git runs a git command in the repository and returns its output. stdin
+// may be nil if the command does not read any input.
+func (g *gitRepo) git(ctx context.Context, stdin io.Reader, args ...string) ([]byte, error) {
+	cmdArgs := []string{"-C", g.dir}
+	for _, c := range g.config {
+		cmdArgs = append(cmdArgs, "-c", c)
+	}
+	cmd := exec.CommandContext(ctx, gitBinary, append(cmdArgs, args...)...)
+	cmd.Stdin = stdin
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if msg == "" {
+			msg = strings.TrimSpace(string(out))
+		}
+		if msg == "" {
+			msg = err.Error()
+		}
+		return nil, fmt.Errorf("git %s: %s", args[0], msg)
+	}
+	return out, nil
+}
+
+// isSet checks whether a git setting has a value
+func (g *gitRepo) isSet(ctx context.Context, key string) bool {
+	out, err := g.git(ctx, nil, "config", key)
+	return err == nil && len(bytes.TrimSpace(out)) > 0
+}
+
+// init creates the repository if it does not exist yet and makes sure the
+// files of rfm are ignored
+func (g *gitRepo) init(ctx context.Context) error {
+	if _, err := os.Stat(filepath.Join(g.dir, gitDirName)); os.IsNotExist(err) {
+		if g.verbose {
+			g.log.Println("Initializing git repository in", g.dir)
+		}
+		if _, err = g.git(ctx, nil, "init", "--quiet"); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+	return g.ignore(filepath.Join(g.dir, gitDirName, gitExcludeFile), gitIgnoredFiles)
+}
+
+// ignore adds all patterns to the exclude file that are not in it already.
+// The exclude file is used instead of a .gitignore so the backup only
+// contains files of the device.
+func (g *gitRepo) ignore(excludeFile string, patterns []string) error {
+	existing := make(map[string]bool)
+	if f, err := os.Open(excludeFile); err == nil {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			existing[strings.TrimSpace(scanner.Text())] = true
+		}
+		f.Close()
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	var missing strings.Builder
+	for _, p := range patterns {
+		if !existing[p] {
+			fmt.Fprintln(&missing, p)
+		}
+	}
+	if missing.Len() == 0 {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(excludeFile), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(excludeFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.WriteString(missing.String())
+	return err
+}
+
+// commit stages all changes and commits them with a message listing the
+// added, updated and removed paths. Nothing is committed if nothing changed.
+func (g *gitRepo) commit(ctx context.Context, device, domain string) error {
+	if _, err := g.git(ctx, nil, "add", "--all"); err != nil {
+		return err
+	}
+	out, err := g.git(ctx, nil, "diff", "--cached", "--name-status", "--no-renames")
+	if err != nil {
+		return err
+	}
+	var added, updated, removed []string
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		status, path, ok := strings.Cut(scanner.Text(), "\t")
+		if !ok {
+			continue
+		}
+		switch status {
+		case "A":
+			added = append(added, path)
+		case "D":
+			removed = append(removed, path)
+		default:
+			updated = append(updated, path)
+		}
+	}
+	if len(added)+len(updated)+len(removed) == 0 {
+		g.log.Println("No changes to commit in", g.dir)
+		return nil
+	}
+
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "Backup of %s: %d added, %d updated, %d removed\n\n", device, len(added), len(updated), len(removed))
+	fmt.Fprintf(&msg, "Device: %s (%s)\n", device, domain)
+	for _, section := range []struct {
+		title string
+		paths []string
+	}{{"Added", added}, {"Updated", updated}, {"Removed", removed}} {
+		if len(section.paths) == 0 {
+			continue
+		}
+		fmt.Fprintf(&msg, "\n%s:\n", section.title)
+		for _, p := range section.paths {
+			fmt.Fprintf(&msg, "  %s\n", p)
+		}
+	}
+
+	// Do not fail on machines where git has never been set up
+	if !g.isSet(ctx, "user.name") {
+		g.config = append(g.config, "user.name="+gitFallbackName)
+	}
+	if !g.isSet(ctx, "user.email") {
+		g.config = append(g.config, "user.email="+gitFallbackEmail)
+	}
+	if _, err = g.git(ctx, strings.NewReader(msg.String()), "commit", "--quiet", "--no-verify", "-F", "-"); err != nil {
+		return err
+	}
+	g.log.Printf("Committed %d added, %d updated, %d removed files in %s", len(added), len(updated), len(removed), g.dir)
+	return nil
+}
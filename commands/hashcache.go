@@ -0,0 +1,82 @@
+package commands
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	hashCacheFileName = ".rfmhashcache.json"
+)
+
+// unsetDate is the latest date considered to be the FAT epoch of a device
+// without a set clock. Such dates do not change when a file is modified,
+// so cached checksums of these files are never used.
+var unsetDate = time.Date(1980, time.January, 2, 0, 0, 0, 0, time.UTC)
+
+// hashCacheEntry is a remote checksum that is valid as long as size
+// and date of the remote file do not change
+type hashCacheEntry struct {
+	Size uint64    `json:"size"`
+	Date time.Time `json:"date"`
+	SHA1 string    `json:"sha1"`
+}
+
+// hashCache remembers checksums of remote files keyed by their path
+type hashCache struct {
+	entries map[string]hashCacheEntry
+}
+
+// loadHashCache reads the cache from the given directory. A missing or
+// unreadable cache results in an empty one.
+func loadHashCache(dir string) *hashCache {
+	h := &hashCache{entries: make(map[string]hashCacheEntry)}
+	content, err := os.ReadFile(filepath.Join(dir, hashCacheFileName))
+	if err != nil {
+		return h
+	}
+	if err = json.Unmarshal(content, &h.entries); err != nil {
+		h.entries = make(map[string]hashCacheEntry)
+	}
+	return h
+}
+
+// get returns the cached checksum if the remote file did not change. Files
+// of devices without a clock always miss because a change that keeps the
+// size cannot be detected.
+func (h *hashCache) get(path string, size uint64, date time.Time) (string, bool) {
+	e, ok := h.entries[path]
+	if !ok || e.Size != size || !e.Date.Equal(date) || date.Before(unsetDate) {
+		return "", false
+	}
+	return e.SHA1, true
+}
+
+// put stores the checksum of a remote file
+func (h *hashCache) put(path string, size uint64, date time.Time, sum string) {
+	h.entries[path] = hashCacheEntry{
+		Size: size,
+		Date: date,
+		SHA1: sum,
+	}
+}
+
+// save writes the cache to the given directory
+func (h *hashCache) save(dir string) error {
+	content, err := json.MarshalIndent(h.entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, hashCacheFileName), content, 0644)
+}
+
+// sha1Sum returns the hex encoded SHA-1 checksum of content as it is
+// reported by M38
+func sha1Sum(content []byte) string {
+	sum := sha1.Sum(content)
+	return hex.EncodeToString(sum[:])
+}
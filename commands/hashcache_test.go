@@ -0,0 +1,69 @@
+package commands
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHashCacheGet(t *testing.T) {
+	date := time.Date(2024, time.March, 1, 12, 0, 0, 0, time.UTC)
+	unset := time.Date(1980, time.January, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		putSize  uint64
+		putDate  time.Time
+		path     string
+		size     uint64
+		date     time.Time
+		wantSum  string
+		wantHave bool
+	}{
+		{"unchanged", 10, date, "0:/sys/config.g", 10, date, "sum", true},
+		{"other path", 10, date, "0:/sys/homeall.g", 10, date, "", false},
+		{"size changed", 10, date, "0:/sys/config.g", 11, date, "", false},
+		{"date changed", 10, date, "0:/sys/config.g", 10, date.Add(time.Second), "", false},
+		{"unset clock and same size", 10, unset, "0:/sys/config.g", 10, unset, "", false},
+		{"unset clock and other size", 10, unset, "0:/sys/config.g", 11, unset, "", false},
+		{"clock set since", 10, unset, "0:/sys/config.g", 10, date, "", false},
+		{"clock lost since", 10, date, "0:/sys/config.g", 10, unset, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &hashCache{entries: make(map[string]hashCacheEntry)}
+			h.put("0:/sys/config.g", tt.putSize, tt.putDate, "sum")
+			sum, ok := h.get(tt.path, tt.size, tt.date)
+			if sum != tt.wantSum || ok != tt.wantHave {
+				t.Errorf("get() = %q, %v, want %q, %v", sum, ok, tt.wantSum, tt.wantHave)
+			}
+		})
+	}
+}
+
+func TestHashCacheSaveLoad(t *testing.T) {
+	dir := t.TempDir()
+	date := time.Date(2024, time.March, 1, 12, 0, 0, 0, time.UTC)
+	h := loadHashCache(dir)
+	h.put("0:/sys/config.g", 10, date, "sum")
+	if err := h.save(dir); err != nil {
+		t.Fatal(err)
+	}
+	if sum, ok := loadHashCache(dir).get("0:/sys/config.g", 10, date); !ok || sum != "sum" {
+		t.Errorf("get() after reload = %q, %v", sum, ok)
+	}
+
+	// A broken cache is ignored
+	if err := os.WriteFile(filepath.Join(dir, hashCacheFileName), []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := loadHashCache(dir).get("0:/sys/config.g", 10, date); ok {
+		t.Error("get() found an entry in a broken cache")
+	}
+}
+
+func TestSha1Sum(t *testing.T) {
+	if got, want := sha1Sum([]byte("abc")), "a9993e364706816aba3e25717850c26c9cd0d89d"; got != want {
+		t.Errorf("sha1Sum() = %s, want %s", got, want)
+	}
+}
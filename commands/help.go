@@ -24,7 +24,8 @@ Common options to all commands:
                                 in combination with the above options) or load
                                 an already configured device. This makes multi-
                                 device environments easier to handle.
-                                (default "default")
+                                (default "default" or the device set in a
+                                project-local .rfm.toml)
         -verbose                Output more details
         -debug                  Output details on underlying HTTP requests
 
@@ -34,44 +35,156 @@ The commands are:
         mkdir        Create a new directory on the device
         mv           Rename/move a file/directory on the device
         rm           Remove a file/directory on the device
+        trash        List, restore or empty the trash on the device
         download     Download a single file from the device
         fileinfo     Get information on a file
         ls           Show the file tree of a given path
+        verify       Verify a local backup against its manifest
+        gcode        Send G-code commands and print their replies
+        console      Interactive G-code console
+        print        Start printing a file on the device
+        pause        Pause the current print
+        resume       Resume a paused print
+        cancel       Cancel the current print
+        status       Show machine state and progress of the current job
+        model        Query the object model
+        firmware     Update the firmware of the device
+        volumes      List volumes with mount state and free space
+        mount        Mount a volume
+        unmount      Unmount a volume
+        fuse         Mount the device as a local filesystem
+        plan         Show changes needed to match a provisioning manifest
+        apply        Apply a provisioning manifest to the device
+        render       Render a template with the variables of a device
+        run          Run a script of rfm commands over one connection
+        daemon       Backup all scheduled devices periodically
+        serve-webdav Serve the volumes of the device over WebDAV
+        proxy        Share one session to the device with local clients
 
 Use "rfm help <command>" for more information about a command.`
-	backupHelp = `Usage: rfm backup <common-options> [-removeLocal] [-exclude <excludepattern>]*
+	backupHelp = `Usage: rfm backup <common-options> [-removeLocal] [-compare <strategy>] [-force] [-git]
+                  [-exclude <excludepattern>]* [-include <includepattern>]*
                   [<local/path> [<remote/path>]]
+       rfm backup <common-options> -archive <archive> [-force]
+                  [-exclude <excludepattern>]* [-include <includepattern>]*
+                  [<remote/path>]
 
 backup will download a directory structure from the device to a local directory.
 Each locally created directory will contain a marker file named .rfmbackup.
 This is important for the flag -removeLocal (see below). Directories not having
 this marker file will not be removed in any case.
 
+With -archive the directory structure is instead written directly into a
+compressed archive. Remote modification times are preserved and a manifest
+named .rfmmanifest.json listing all files, their sizes and the source device
+is added to the archive.
+
+A manifest named .rfmmanifest.json listing all backuped files with their sizes,
+remote modification times and SHA-256 checksums is written to <local/path> on
+each run. It can be used with "rfm verify" to check the backup for corruption.
+
+Before downloading anything backup checks that there is enough free space on
+the local disk for all files that will be fetched.
+
+With -git <local/path> is a git repository. It is created if necessary and after
+each successful backup all changes are committed using the local git binary.
+The commit message lists the added, updated and removed paths and the device.
+The files of rfm itself are excluded in .git/info/exclude. No remote is needed.
+git has to be installed, otherwise backup fails before connecting.
+
 Options:
         -removeLocal                 Remove files locally that have been
                                      removed remote
-        -exclude <excludepattern>    Exclude paths starting with this string
+        -compare <strategy>          How to detect files that need to be
+                                     updated (default "mtime"):
+                                     mtime: remote file is newer than local one
+                                     size: sizes of remote and local file differ
+                                     checksum: SHA-1 checksums differ. The remote
+                                     checksum is calculated by the firmware (M38)
+                                     or by downloading the file and it is cached
+                                     in .rfmhashcache.json. Use this for devices
+                                     without a correctly set clock.
+        -archive <archive>           Write the backup into this archive. The
+                                     format is chosen by the extension: .tar.gz,
+                                     .tgz or .zip
+        -force                       Backup even if there is not enough free
+                                     space locally
+        -git                         Commit all changes to a git repository in
+                                     <local/path>
+        -exclude <excludepattern>    Exclude paths matching this pattern
+                                     (can be used multiple times)
+        -include <includepattern>    Include paths matching this pattern even
+                                     if they are excluded by an earlier pattern
                                      (can be used multiple times)
 
 Parameters:
         <local/path>     Path where the download is stored locally. If omitted
                          the current diretory is used.
         <remote/path>    Remote path to be backuped. If this is changed the
-                         local path has to be provided also. (default "0:/sys")`
-	uploadHelp = `Usage: rfm upload <common-options> [-exclude <excludepattern>]*
+                         local path has to be provided also. (default: the
+                         device's remote_path from the config or "0:/sys")
+
+Patterns:
+Patterns follow the rules of .gitignore and are matched against paths relative
+to the backuped remote directory. "*" and "?" do not match "/", "**" matches any
+number of directories, a trailing "/" only matches directories and a leading "!"
+negates a pattern. Patterns containing a "/" at the beginning or in the middle
+are anchored at the remote directory, all others match at any level. The last
+matching pattern wins. Additional patterns are read from a file named .rfmignore
+in <local/path>.`
+	uploadHelp = `Usage: rfm upload <common-options> [-watch] [-force] [-atomic] [-bak] [-force-protected]
+                  [-exclude <excludepattern>]* [-include <includepattern>]*
                   [<local/path> [<remote/path>]]
 
-upload will upload a file or directory to the remote device.
+upload will upload a file or directory to the remote device. Before the first
+file is transferred the total size of all files is compared to the free space
+of the target volume and the upload is aborted if they do not fit.
+
+With -watch upload keeps running after the upload and watches <local/path>
+for changes until it is interrupted. Modified and new files are uploaded, new
+directories are created and removed files and directories are deleted on the
+device. Changes are collected until nothing changed for half a second.
+
+Files ending in .tmpl are templates. They are rendered with the variables of the
+device before upload and stored without the .tmpl suffix. See "rfm help render".
+
+Files below 0:/sys are always uploaded atomically: they are first written to
+a temporary file named <name>.rfmtmp, its size is verified and only then it
+replaces the existing file. The existing file is moved to <name>.rfmold and
+only deleted once the new version is in place. An interrupted upload thus
+never leaves a truncated file behind.
 
 Options:
-        -exclude <excludepattern>    Exclude paths starting with this string
+        -watch                       Keep uploading changes of the directory
+                                     <local/path>
+        -force                       Upload even if there is not enough free
+                                     space on the device
+        -atomic                      Upload all files atomically
+        -bak                         Keep the previous version of replaced
+                                     files as <name>.bak (implies -atomic)
+        -force-protected             Also overwrite paths that are protected
+                                     by the config. See "rfm help protected".
+        -exclude <excludepattern>    Exclude paths matching this pattern
+                                     (can be used multiple times)
+        -include <includepattern>    Include paths matching this pattern even
+                                     if they are excluded by an earlier pattern
                                      (can be used multiple times)
 
 Parameters:
         <local/path>     Local path of the file or directory to be uploaded
                          (default: current directory)
         <remote/path>    Remote path to store the file(s)/directory at
-                         (default: 0:/)`
+                         (default: the device's remote_path from the config
+                         or 0:/)
+
+Patterns:
+Patterns follow the rules of .gitignore and are matched against paths relative
+to the uploaded local directory. "*" and "?" do not match "/", "**" matches any
+number of directories, a trailing "/" only matches directories and a leading "!"
+negates a pattern. Patterns containing a "/" at the beginning or in the middle
+are anchored at the local directory, all others match at any level. The last
+matching pattern wins. Additional patterns are read from a file named .rfmignore
+in <local/path>.`
 	mkdirHelp = `Usage: rfm mkdir <common-options> <remote/path>
 
 mkdir will create a new directory on the device.
@@ -83,13 +196,22 @@ Errors:
 This will return an error in both cases where the directory could not be created
 or the directory already exists. Since both cases return the same error they
 cannot be differtiated by rfm.`
-	mvHelp = `Usage: rfm mv <common-options> [-f] <old/path> <new/path>
+	mvHelp = `Usage: rfm mv <common-options> [-f] [-trash] [-y] [-force-protected]
+              <old/path> <new/path>
 
 mv will move or rename a file or directory withing one mounted volume.
+Before overwriting a file with -f the user is asked for confirmation.
 
 Options:
-        -f    Overwrite the target file if it exists.
-              This will not delete existing directories.
+        -f        Overwrite the target file if it exists.
+                  This will not delete existing directories.
+        -trash    Move an overwritten target file to the trash instead of
+                  deleting it (default: the device's trash setting from the
+                  config). See "rfm help trash".
+        -y        Overwrite without asking for confirmation
+        -force-protected
+                  Also move or overwrite paths that are protected by the
+                  config. See "rfm help protected".
 
 Parameters:
         <old/path>    Current path of the file or directory to be
@@ -100,16 +222,268 @@ Errors:
 Trying to move files or directories across volumes will return an error.
 Another source of error might be trying to rename a file to a name of an
 existing directory.`
-	rmHelp = `Usage: rfm rm <common-options> [-r] <remote/path>
+	rmHelp = `Usage: rfm rm <common-options> [-r] [-trash] [-y] [-force-protected]
+              <remote/path>
 
 rm will delete a remote file or directory. Directories can only be deleted if
 they are empty or the option "-r" is given which enables recursive delete.
+Before deleting a directory recursively the number of affected files and their
+total size is shown and the user is asked for confirmation.
 
 Options:
-        -r    Delete directories recursively, i.e. including ALL their contents
+        -r        Delete directories recursively, i.e. including ALL their
+                  contents
+        -trash    Move the file or directory to the trash instead of deleting
+                  it permanently (default: the device's trash setting from the
+                  config). See "rfm help trash".
+        -y        Delete without asking for confirmation
+        -force-protected
+                  Also delete paths that are protected by the config.
+                  See "rfm help protected".
 
 Parameters:
         <remote/path>    Path of the remote file or directory`
+	applyHelp = `Usage: rfm plan <common-options> <manifest.toml>
+       rfm apply <common-options> [-y] [-force-protected] <manifest.toml>
+
+plan compares the device to the desired state declared in a manifest and shows
+the changes that are necessary to reach it. apply shows the same changes, asks
+for confirmation and then executes them. Only missing directories are created,
+only missing or changed files are uploaded and only existing paths are deleted.
+
+A manifest looks like this:
+
+        # Directories that have to exist
+        dirs = ["0:/macros/Maintenance", "0:/filaments/PLA"]
+
+        # Files or directories that must not exist
+        absent = ["0:/sys/old-config.g", "0:/macros/Obsolete"]
+
+        # Files with their content taken from a local file relative to
+        # the manifest...
+        [[files]]
+        path = "0:/sys/config.g"
+        source = "sys/config.g"
+
+        # ...or given inline
+        [[files]]
+        path = "0:/filaments/PLA/load.g"
+        content = """
+        M104 S210
+        """
+
+Sources ending in .tmpl are rendered like upload does. Files below 0:/sys are
+uploaded atomically. Absent directories are deleted
+recursively and go to the trash if it is enabled for the device.
+
+Options:
+        -y                  Apply without asking for confirmation
+        -force-protected    Also modify paths that are protected by the config.
+                            See "rfm help protected".
+
+Parameters:
+        <manifest.toml>    Path of the manifest`
+	daemonHelp = `Usage: rfm daemon [-status <file>] [-retry <duration>] [-compare <strategy>]
+                  [-removeLocal] [-git] [-metrics <address>] [<device>]*
+
+daemon keeps running and backups all devices that have a schedule in the config
+file. Devices are backuped concurrently, each to its own local directory:
+
+[Devices.p1]
+  domain = "p1.local"
+  backup_every = "6h"
+  backup_dir = "/srv/backups/p1"
+
+backup_every accepts durations like 30m, 6h or 1d. The directory to backup and
+the excludes are the same as for "rfm backup" with this device.
+
+Each line of output of a backup is prefixed with the name of its device.
+Devices that cannot be reached, e.g. because they are turned off, do not stop
+the daemon. Their backup is retried after the retry interval instead.
+
+The time of the last attempt, the last successful backup, its duration, the
+last error and the next scheduled run of each device are written to a JSON
+status file. After a restart devices are only backuped once their interval
+since the last successful backup has passed.
+
+With -metrics the status is additionally served for Prometheus on
+http://<address>/metrics:
+
+        rfm_backup_last_attempt_timestamp_seconds     Time of the last attempt
+        rfm_backup_last_success_timestamp_seconds     Time of the last success
+        rfm_backup_last_success                       1 if the last attempt
+                                                      succeeded, 0 otherwise
+        rfm_backup_last_duration_seconds              Duration of the last attempt
+        rfm_backup_next_run_timestamp_seconds         Next scheduled backup
+        rfm_backup_transferred_bytes_total            Bytes downloaded
+        rfm_backup_changed_files_total                Files added, updated or
+                                                      removed locally
+        rfm_backup_throughput_kibibytes_per_second    Download speed of the last
+                                                      backup that downloaded
+                                                      files
+        rfm_connection_failures_total                 Attempts that failed
+                                                      because the device was
+                                                      not available
+        rfm_volume_free_bytes                         Free space on the volume
+                                                      that is backuped
+
+Options:
+        -status <file>          Status file (default daemon-status.json in the
+                                config directory)
+        -retry <duration>       Wait this long before retrying a failed backup
+                                (default 5m)
+        -compare <strategy>     Strategy to detect changed files: size, mtime
+                                or checksum (default mtime)
+        -removeLocal            Remove files locally that have been deleted on
+                                the device
+        -git                    Commit the changes of each backup to a git
+                                repository in backup_dir
+        -metrics <address>      Serve Prometheus metrics on this address,
+                                e.g. :9110
+
+Parameters:
+        <device>    Only backup these devices instead of all scheduled ones.
+                    Each of them needs a backup_every setting.`
+	serveWebdavHelp = `Usage: rfm serve-webdav <common-options> [-listen <address>] [-cache <duration>]
+
+serve-webdav exposes the volumes of the device through a local WebDAV server so
+file managers and editors can use the SD card like a network drive. The root
+contains one directory per mounted volume, e.g. /0/sys/config.g is 0:/sys/config.g.
+
+Directory listings are cached for a short time. File contents are cached until
+the file changes on the device. Changed files are uploaded when they are closed,
+files in 0:/sys always via a temporary file. Deleted paths go to the trash if it
+is enabled for the device and protected paths cannot be changed.
+
+The server runs until it is interrupted. It does not require authentication so
+only listen on addresses other people cannot reach.
+
+Options:
+        -listen <address>     Address to serve WebDAV on (default
+                              "127.0.0.1:8080")
+        -cache <duration>     Reuse directory listings for this long
+                              (default 2s)`
+	proxyHelp = `Usage: rfm proxy <common-options> [-listen <address>] [-cache <duration>]
+
+proxy logs in to the device once and forwards the requests of any number of
+local clients like DWC, other tools or rfm itself over this one session. The
+firmware of standalone boards only supports a few sessions so this keeps clients
+from pushing each other out.
+
+Clients are told they are connected without the device being asked and they
+cannot end the shared session. If the session expires the proxy logs in again.
+Uploads are sent one at a time. File lists are reused for a short time unless a
+request changed files on the device in the meantime.
+
+Point clients at the proxy instead of the device, e.g. with
+"rfm -domain 127.0.0.1 -port 8081 ...". The password of the clients is not
+checked. G-code replies go to whichever client asks for them first.
+
+The proxy runs until it is interrupted. It does not require authentication so
+only listen on addresses other people cannot reach.
+
+Options:
+        -listen <address>     Address to accept clients on (default
+                              "127.0.0.1:8081")
+        -cache <duration>     Reuse file lists for this long (default 2s)`
+	renderHelp = `Usage: rfm render <common-options> [-o <local/file>] <local/file.tmpl>
+
+render shows how a template is rendered for a device without uploading it.
+It does not connect to the device so -domain is not mandatory.
+
+Templates use the syntax of Go's text/template package. The variables of a
+device are set in the config file
+
+[Devices.p1.vars]
+  hostname = "p1"
+  bed_x = 300
+
+and used like {{ .Vars.hostname }}. Additionally {{ .Device }} is the name of the
+device and {{ .Domain }} its network address. Using a variable that is not set
+is an error.
+
+Options:
+        -o <local/file>    Write the result to this file instead of stdout
+
+Parameters:
+        <local/file.tmpl>    Path of the template`
+	runHelp = `Usage: rfm run <common-options> [-e] [<script>]
+
+run executes a script of rfm commands over a single connection. Each line
+contains one command with its options and parameters but without the common
+options, e.g.
+
+        # Provision macros
+        DIR=0:/macros/new
+        set -e
+        mkdir $DIR
+        upload ./x.g $DIR
+        gcode M98 P"${DIR}/x.g"
+
+Words are separated by whitespace. Double or single quotes at the beginning of
+a word group words containing whitespace; quotes anywhere else are passed on
+unchanged. Lines starting with # are comments. Everything following the options
+of gcode is sent as a single G-code command.
+
+Variables are assigned with NAME=value and used as $NAME or ${NAME}. Variables
+not assigned in the script are taken from the environment. There is no
+substitution in single-quoted words.
+
+By default all lines are executed even if some fail. After "set -e" the script
+stops at the first failing command, "set +e" switches back. At the end a
+summary of succeeded, failed and skipped commands is printed.
+
+The commands console and run cannot be used in scripts. Commands asking for
+confirmation need -y unless the script is given as file and rfm runs in a
+terminal.
+
+Options:
+        -e    Stop at the first failing command (same as "set -e" at the
+              beginning of the script)
+
+Parameters:
+        <script>    Path of the script file or - to read it from standard input
+                    (default -)`
+	protectedHelp = `Paths can be protected against accidental modification by listing them
+for a device in the config file:
+
+[Devices.p1]
+  protected = ["0:/sys/config.g", "0:/firmware"]
+
+rm, mv, upload and firmware update refuse to delete, move or overwrite a
+protected path, anything below it or a directory containing it unless the
+option -force-protected is given.`
+	trashHelp = `Usage: rfm trash list <common-options> [-volume <volume>]
+       rfm trash restore <common-options> [-volume <volume>] <timestamp>
+                 [<remote/path>]
+       rfm trash empty <common-options> [-volume <volume>] [-older <age>] [-y]
+
+rm and mv -f can move paths into a trash instead of deleting them permanently.
+This is enabled by the option -trash or for all operations on a device by
+setting "trash = true" for it in the config file. Each volume has its own trash
+in the directory <volume>:/.rfmtrash. All paths removed by one command are
+collected below a directory named after the time of removal, e.g.
+20061019-150405, keeping their original location.
+
+trash list shows all trashed files with their original paths.
+
+trash restore moves the contents of the trash directory <timestamp> back to
+their original location. Directories are merged into existing ones but
+existing files are never overwritten.
+
+trash empty permanently deletes the contents of the trash after asking the
+user for confirmation.
+
+Options:
+        -volume <volume>    Number of the volume whose trash to use
+                            (default 0)
+        -older <age>        Only delete paths that have been trashed at least
+                            this long ago, e.g. 7d or 12h
+        -y                  Empty the trash without asking for confirmation
+
+Parameters:
+        <timestamp>      Name of the trash directory to restore
+        <remote/path>    Only restore this original path`
 	downloadHelp = `Usage: rfm download <common-options> <remote/file> [<local/name>]
 
 Download downloads a single file from the device to a local directory. The name
@@ -152,6 +526,175 @@ Parameters:
 Errors:
 This will return an error in case a remote file is given as <remote/dir>
 or for the first path that is not found remote.`
+	verifyHelp = `Usage: rfm verify [<common-options>] [-remote] <local/backup>
+
+verify checks the files of a backup against the manifest .rfmmanifest.json
+that has been written by "rfm backup". It reports files that are missing or
+whose size or SHA-256 checksum does not match the manifest.
+
+Options:
+        -remote    Also download all files listed in the manifest from the
+                   device and compare them to the manifest. Only in this case
+                   the common options are used. The device defaults to the
+                   one the backup was made from.
+
+Parameters:
+        <local/backup>    Local backup directory or archive created with
+                          "rfm backup -archive"
+
+Errors:
+This will return an error if any file could not be verified.`
+	gcodeHelp = `Usage: rfm gcode <common-options> [-timeout <duration>] <gcode>+
+
+gcode sends G-code commands to the device and prints their replies.
+
+Options:
+        -timeout <duration>    Time to wait for the reply of each command,
+                               e.g. 500ms or 1m (default 2s). Commands without
+                               a reply return once the device is no longer
+                               busy executing them.
+
+Parameters:
+        <gcode>    G-code command to send. Quote commands containing spaces.
+                   Can be used multiple times to send several commands in
+                   order, e.g. rfm gcode "M98 P\"0:/macros/test.g\"" M999`
+	consoleHelp = `Usage: rfm console <common-options> [-timeout <duration>]
+
+console starts an interactive G-code console. Each line entered is sent to the
+device and its reply is printed, including replies that arrive later. On a
+terminal previous commands can be recalled with the arrow keys. Enter "exit" or
+press Ctrl-D to quit.
+
+Commands can also be piped to console, e.g. from a file.
+
+Options:
+        -timeout <duration>    Time to wait for the reply of each command,
+                               e.g. 500ms or 1m (default 2s). Commands without
+                               a reply return once the device is no longer
+                               busy executing them.`
+	printHelp = `Usage: rfm print <common-options> [-timeout <duration>] <remote/file>
+       rfm print <common-options> [-timeout <duration>] -upload <local/file>
+                 [<remote/dir>]
+
+print checks that a job file exists on the device, shows its estimated print
+time and filament usage and starts printing it (M32).
+
+Options:
+        -upload <local/file>    Upload this file to <remote/dir> first and
+                                then start printing it
+        -timeout <duration>     Time to wait for the reply of the device,
+                                e.g. 500ms or 1m (default 2s)
+
+Parameters:
+        <remote/file>    Path of the job file to print
+        <remote/dir>     Directory to upload the job file to when -upload is
+                         used (default: 0:/gcodes)
+
+Errors:
+If the job file does not exist there will be an error.`
+	jobControlHelp = `Usage: rfm pause|resume|cancel <common-options> [-timeout <duration>]
+
+pause pauses the current print (M25), resume resumes a paused print (M24) and
+cancel cancels the current print. Since RepRapFirmware only cancels paused
+prints cancel will pause the print first, wait up to 2 minutes for it to be
+paused and then cancel it (M0). If nothing is printing cancel fails without
+sending anything since M0 would also run stop.g.
+
+Options:
+        -timeout <duration>    Time to wait for the reply of the device,
+                               e.g. 500ms or 1m (default 2s)`
+	statusHelp = `Usage: rfm status <common-options> [-watch|-wait-idle] [-interval <duration>]
+                  [-o text|json]
+
+status shows the machine state, the current job file, its progress, layer and
+estimated time of completion as well as all heater temperatures.
+
+Options:
+        -watch                  Refresh the status every interval until
+                                interrupted
+        -wait-idle              Do not print anything but block until the
+                                device is no longer busy, e.g. the current print
+                                has finished. Fails if the print is paused.
+        -interval <duration>    Refresh interval for -watch and -wait-idle,
+                                e.g. 500ms or 1m (default 2s)
+        -o <format>             Output format: text or json. With -watch one
+                                JSON object is printed per line.
+                                (default "text")`
+	modelHelp = `Usage: rfm model <common-options> [-f] [<key/path>]
+
+model fetches the object model of RepRapFirmware and prints the requested
+subtree as JSON.
+
+Options:
+        -f    Only fetch frequently changing (live) values
+
+Parameters:
+        <key/path>    Path into the object model with dots separating keys and
+                      brackets selecting array elements, e.g. "boards[0]",
+                      "volumes" or "heat.heaters[0].current". (default: the
+                      complete object model)
+
+Errors:
+This will return an error if the path does not exist in the object model.`
+	firmwareHelp = `Usage: rfm firmware update <common-options> [-board <board>] [-timeout <duration>]
+                           [-force-protected] <local/firmware.bin>
+
+firmware update installs a new firmware binary. It uploads the binary to 0:/firmware
+(or 0:/sys for older firmware versions), verifies the size of the upload, starts
+the update with M997 and then waits until the object model reports a different
+firmware version for the board. If the version does not change within the
+timeout the update is reported as failed. Installing the version that is
+already running is only recognized for the main board as it restarts. For the
+WiFi module and expansion boards it is reported as failed.
+
+The WiFi module and expansion boards are always updated from the file name the
+firmware expects, e.g. DuetWiFiServer.bin for the WiFi module or
+Duet3Firmware_EXP3HC.bin for an EXP3HC expansion board. Binaries with a
+different name are rejected before uploading them.
+
+Options:
+        -board <board>          Board to update: main, wifi or
+                                expansion:<CAN address> (default "main")
+        -timeout <duration>     Time to wait for the new firmware version after
+                                the update, e.g. 90s or 10m (default 5m)
+        -force-protected        Overwrite the binary even if it is protected
+                                by the config
+
+Parameters:
+        <local/firmware.bin>    Local path of the firmware binary`
+	volumesHelp = `Usage: rfm volumes <common-options> [-h]
+
+volumes lists all volumes of the device with their mount state, capacity, free
+space, interface speed and, if the firmware reports it, filesystem as reported
+by the object model.
+
+Options:
+        -h    List sizes in human-readble units instead of byte sizes`
+	mountHelp = `Usage: rfm mount|unmount <common-options> <volume>
+
+mount mounts a volume (M21), unmount unmounts it (M22). Use "rfm volumes" to
+see which volumes are mounted.
+
+Parameters:
+        <volume>    Number of the volume, e.g. 1 for 1:/`
+	fuseHelp = `Usage: rfm fuse <common-options> [-cache <duration>] <mountpoint>
+
+fuse mounts the volumes of the device as a FUSE filesystem at the local
+directory <mountpoint> (Linux only). It contains one directory per mounted
+volume, e.g. <mountpoint>/0/sys/config.g is 0:/sys/config.g, so tools like
+rsync, grep or editors work directly on the device. Files are read completely
+on first access and cached until they change. Changed files are uploaded when
+they are closed, files in 0:/sys always via a temporary file. Deleted paths go
+to the trash if it is enabled for the device and protected paths cannot be
+changed. Permissions and times cannot be set. The filesystem stays mounted
+until rfm is interrupted.
+
+Options:
+        -cache <duration>    Reuse directory listings and attributes for this
+                             long (default 2s)
+
+Parameters:
+        <mountpoint>    Existing local directory to mount the device at`
 	unknownTopic = `rfm help %s: unknown help topic. Run 'rfm help'`
 )
 
@@ -177,12 +720,50 @@ func PrintHelp(arguments []string, exitCode int) {
 		fmt.Println(mvHelp)
 	case "rm":
 		fmt.Println(rmHelp)
+	case "trash":
+		fmt.Println(trashHelp)
+	case "run":
+		fmt.Println(runHelp)
+	case "daemon":
+		fmt.Println(daemonHelp)
+	case "serve-webdav":
+		fmt.Println(serveWebdavHelp)
+	case "proxy":
+		fmt.Println(proxyHelp)
+	case "plan", "apply":
+		fmt.Println(applyHelp)
+	case "render":
+		fmt.Println(renderHelp)
+	case "protected":
+		fmt.Println(protectedHelp)
 	case "download":
 		fmt.Println(downloadHelp)
 	case "fileinfo":
 		fmt.Println(fileinfoHelp)
 	case "ls":
 		fmt.Println(lsHelp)
+	case "verify":
+		fmt.Println(verifyHelp)
+	case "gcode":
+		fmt.Println(gcodeHelp)
+	case "console":
+		fmt.Println(consoleHelp)
+	case "print":
+		fmt.Println(printHelp)
+	case "pause", "resume", "cancel":
+		fmt.Println(jobControlHelp)
+	case "status":
+		fmt.Println(statusHelp)
+	case "model":
+		fmt.Println(modelHelp)
+	case "firmware":
+		fmt.Println(firmwareHelp)
+	case "volumes":
+		fmt.Println(volumesHelp)
+	case "mount", "unmount":
+		fmt.Println(mountHelp)
+	case "fuse":
+		fmt.Println(fuseHelp)
 	default:
 		fmt.Printf(unknownTopic, arguments[0])
 		os.Exit(1)
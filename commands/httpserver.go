@@ -0,0 +1,38 @@
+package commands
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"time"
+)
+
+const (
+	// serverShutdownWait is how long running requests may take to finish
+	// once a server is stopped
+	serverShutdownWait = 5 * time.Second
+)
+
+// startServer serves handler on the address listen until ctx is cancelled.
+// It returns the address actually listened on as soon as the listener is
+// ready so a busy port is reported right away.
+func startServer(ctx context.Context, listen string, handler http.Handler) (net.Addr, error) {
+	l, err := net.Listen("tcp", listen)
+	if err != nil {
+		return nil, err
+	}
+	srv := &http.Server{Handler: handler}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), serverShutdownWait)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+	go func() {
+		if err := srv.Serve(l); err != http.ErrServerClosed {
+			log.Println("Server stopped:", err)
+		}
+	}()
+	return l.Addr(), nil
+}
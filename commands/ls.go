@@ -24,37 +24,49 @@ type LsOptions struct {
 }
 
 // Check checks all parameters for valid values
-func (l *LsOptions) Check() {
-	l.BaseOptions.Check()
+func (l *LsOptions) Check() error {
+	if err := l.BaseOptions.Check(); err != nil {
+		return err
+	}
 	if len(l.paths) == 0 {
-		l.paths = append(l.paths, "")
+		l.paths = append(l.paths, l.getRemotePath(""))
 	}
 	for i := 0; i < len(l.paths); i++ {
 		l.paths[i] = rfm.CleanRemotePath(l.paths[i])
 	}
+	return nil
 }
 
 // InitLsOptions initializes a LsOptions instance from command-line parameters
-func InitLsOptions(ctx context.Context, arguments []string) *LsOptions {
-	l := LsOptions{BaseOptions: &BaseOptions{}}
+func InitLsOptions(ctx context.Context, session *BaseOptions, arguments []string) (*LsOptions, error) {
+	l := LsOptions{BaseOptions: &BaseOptions{session: session}}
 
 	fs := l.GetFlagSet()
 	fs.BoolVar(&l.recursive, "r", false, "List recursively")
 	fs.BoolVar(&l.humanReadable, "h", false, "List sizes in human readable units")
-	fs.Parse(arguments)
+	if err := fs.Parse(arguments); err != nil {
+		return nil, err
+	}
 
 	l.paths = fs.Args()
 
-	l.Check()
+	if err := l.Check(); err != nil {
+		return nil, err
+	}
 
-	l.Connect(ctx)
+	if err := l.Connect(ctx); err != nil {
+		return nil, err
+	}
 
-	return &l
+	return &l, nil
 }
 
 // DoLs is a convenience function to run ls from command-line parameters
-func DoLs(ctx context.Context, arguments []string) error {
-	lo := InitLsOptions(ctx, arguments)
+func DoLs(ctx context.Context, session *BaseOptions, arguments []string) error {
+	lo, err := InitLsOptions(ctx, session, arguments)
+	if err != nil {
+		return err
+	}
 	return NewLs(lo).Ls(ctx, lo.paths, lo.recursive)
 }
 
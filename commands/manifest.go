@@ -0,0 +1,102 @@
+package commands
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	manifestFileName = ".rfmmanifest.json"
+)
+
+// manifest describes the contents of a backup
+type manifest struct {
+	Device  string          `json:"device"`
+	Domain  string          `json:"domain"`
+	Root    string          `json:"root"`
+	Created time.Time       `json:"created"`
+	Files   []manifestEntry `json:"files"`
+}
+
+// manifestEntry describes a single backuped file. Path is relative to the
+// root of the backup and always uses forward slashes.
+type manifestEntry struct {
+	Path   string    `json:"path"`
+	Size   uint64    `json:"size"`
+	Date   time.Time `json:"date"`
+	SHA256 string    `json:"sha256"`
+}
+
+// newManifest creates an empty manifest for the given backup root
+func newManifest(o *BaseOptions, root string) *manifest {
+	return &manifest{
+		Device:  o.device,
+		Domain:  o.domain,
+		Root:    root,
+		Created: time.Now(),
+		Files:   make([]manifestEntry, 0),
+	}
+}
+
+// add records a file in the manifest
+func (m *manifest) add(path string, date time.Time, content []byte) {
+	m.Files = append(m.Files, manifestEntry{
+		Path:   path,
+		Size:   uint64(len(content)),
+		Date:   date,
+		SHA256: sha256Sum(content),
+	})
+}
+
+// marshal returns the indented JSON representation of the manifest
+func (m *manifest) marshal() ([]byte, error) {
+	return json.MarshalIndent(m, "", "  ")
+}
+
+// write stores the manifest in the given directory
+func (m *manifest) write(dir string) error {
+	content, err := m.marshal()
+	if err != nil {
+		return err
+	}
+
+	// Create a temporary file to not kill the previous manifest in case of error
+	f, err := os.CreateTemp(dir, manifestFileName)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err = f.Write(content); err != nil {
+		return err
+	}
+	f.Close()
+	return os.Rename(f.Name(), filepath.Join(dir, manifestFileName))
+}
+
+// readManifest reads the manifest from the given directory
+func readManifest(dir string) (*manifest, error) {
+	content, err := os.ReadFile(filepath.Join(dir, manifestFileName))
+	if err != nil {
+		return nil, err
+	}
+	return unmarshalManifest(content)
+}
+
+// unmarshalManifest parses a manifest from its JSON representation
+func unmarshalManifest(content []byte) (*manifest, error) {
+	var m manifest
+	if err := json.Unmarshal(content, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// sha256Sum returns the hex encoded SHA-256 checksum of content
+func sha256Sum(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,84 @@
+package commands
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestManifestWriteRead(t *testing.T) {
+	dir := t.TempDir()
+	date := time.Date(2024, time.March, 1, 12, 0, 0, 0, time.UTC)
+	m := newManifest(&BaseOptions{device: "printer", domain: "printer.local"}, "0:/sys")
+	m.add("config.g", date, []byte("M550 P\"printer\""))
+	m.add("macros/home.g", date, nil)
+	if err := m.write(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	read, err := readManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if read.Device != "printer" || read.Domain != "printer.local" || read.Root != "0:/sys" || !read.Created.Equal(m.Created) {
+		t.Errorf("readManifest() = %+v", read)
+	}
+	if len(read.Files) != 2 {
+		t.Fatalf("readManifest() returned %d files, want 2", len(read.Files))
+	}
+	e := read.Files[0]
+	if e.Path != "config.g" || e.Size != 15 || !e.Date.Equal(date) || e.SHA256 != sha256Sum([]byte("M550 P\"printer\"")) {
+		t.Errorf("first entry = %+v", e)
+	}
+
+	// No temporary files are left behind
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("%d files in backup directory, want 1", len(entries))
+	}
+}
+
+func TestSha256Sum(t *testing.T) {
+	if got := sha256Sum([]byte("abc")); got != "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad" {
+		t.Errorf("sha256Sum() = %s", got)
+	}
+}
+
+func TestAddUnchangedToManifest(t *testing.T) {
+	dir := t.TempDir()
+	fileName := filepath.Join(dir, "config.g")
+	if err := os.WriteFile(fileName, []byte("local"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	date := time.Date(2024, time.March, 1, 12, 0, 0, 0, time.UTC)
+	previous := manifestEntry{Path: "config.g", Size: 5, Date: date, SHA256: "previous"}
+
+	tests := []struct {
+		name    string
+		size    uint64
+		date    time.Time
+		wantSum string
+	}{
+		{"unchanged reuses previous entry", 5, date, "previous"},
+		{"changed size hashes local file", 6, date, sha256Sum([]byte("local"))},
+		{"changed date hashes local file", 5, date.Add(time.Second), sha256Sum([]byte("local"))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &backup{
+				manifest:         newManifest(&BaseOptions{}, "0:/sys"),
+				previousManifest: map[string]manifestEntry{"config.g": previous},
+			}
+			if err := b.addUnchangedToManifest("config.g", fileName, *remoteFile(tt.size, tt.date)); err != nil {
+				t.Fatal(err)
+			}
+			if len(b.manifest.Files) != 1 || b.manifest.Files[0].SHA256 != tt.wantSum {
+				t.Errorf("manifest files = %+v, want checksum %s", b.manifest.Files, tt.wantSum)
+			}
+		})
+	}
+}
@@ -0,0 +1,117 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	metricsPath        = "/metrics"
+	metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+)
+
+// labelEscaper escapes label values as required by the Prometheus text format
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// metric is a single metric family of the Prometheus text format
+type metric struct {
+	name  string
+	help  string
+	typ   string
+	value func(bs *backupStatus) (float64, bool)
+}
+
+// backupMetrics are exported for each device. Metrics without a value for a
+// device, e.g. before the first successful backup, are left out.
+var backupMetrics = []metric{
+	{"rfm_backup_last_attempt_timestamp_seconds", "Time of the last backup attempt.", "gauge",
+		func(bs *backupStatus) (float64, bool) { return unixSeconds(bs.LastAttempt), !bs.LastAttempt.IsZero() }},
+	{"rfm_backup_last_success_timestamp_seconds", "Time of the last successful backup.", "gauge",
+		func(bs *backupStatus) (float64, bool) {
+			if bs.LastSuccess == nil {
+				return 0, false
+			}
+			return unixSeconds(*bs.LastSuccess), true
+		}},
+	{"rfm_backup_last_success", "Whether the last backup attempt succeeded.", "gauge",
+		func(bs *backupStatus) (float64, bool) {
+			if bs.LastError != "" {
+				return 0, !bs.LastAttempt.IsZero()
+			}
+			return 1, !bs.LastAttempt.IsZero()
+		}},
+	{"rfm_backup_last_duration_seconds", "Duration of the last backup attempt.", "gauge",
+		func(bs *backupStatus) (float64, bool) { return bs.LastDuration, !bs.LastAttempt.IsZero() }},
+	{"rfm_backup_next_run_timestamp_seconds", "Time the next backup is scheduled for.", "gauge",
+		func(bs *backupStatus) (float64, bool) { return unixSeconds(bs.NextRun), !bs.NextRun.IsZero() }},
+	{"rfm_backup_transferred_bytes_total", "Bytes downloaded by backups.", "counter",
+		func(bs *backupStatus) (float64, bool) { return float64(bs.BytesTransferred), true }},
+	{"rfm_backup_changed_files_total", "Files added, updated or removed locally by backups.", "counter",
+		func(bs *backupStatus) (float64, bool) { return float64(bs.FilesChanged), true }},
+	{"rfm_backup_throughput_kibibytes_per_second", "Average download speed of the last backup that downloaded files.", "gauge",
+		func(bs *backupStatus) (float64, bool) { return bs.Throughput, bs.Throughput > 0 }},
+	{"rfm_connection_failures_total", "Backup attempts that failed because the device was not available.", "counter",
+		func(bs *backupStatus) (float64, bool) { return float64(bs.ConnectionFailures), true }},
+}
+
+func unixSeconds(t time.Time) float64 {
+	return float64(t.UnixNano()) / float64(time.Second)
+}
+
+// writeMetrics writes the status of all devices in the Prometheus text format
+func (s *daemonStatus) writeMetrics(w io.Writer) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	devices := make([]string, 0, len(s.Devices))
+	for name := range s.Devices {
+		devices = append(devices, name)
+	}
+	sort.Strings(devices)
+
+	var sb strings.Builder
+	for _, m := range backupMetrics {
+		fmt.Fprintf(&sb, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.typ)
+		for _, name := range devices {
+			if v, ok := m.value(s.Devices[name]); ok {
+				fmt.Fprintf(&sb, "%s{device=\"%s\"} %g\n", m.name, labelEscaper.Replace(name), v)
+			}
+		}
+	}
+
+	// Free space additionally depends on the volume that is backuped
+	fmt.Fprint(&sb, "# HELP rfm_volume_free_bytes Free space on the backuped volume of the device.\n# TYPE rfm_volume_free_bytes gauge\n")
+	for _, name := range devices {
+		bs := s.Devices[name]
+		if bs.FreeSpace != nil {
+			fmt.Fprintf(&sb, "rfm_volume_free_bytes{device=\"%s\",volume=\"%d\"} %d\n", labelEscaper.Replace(name), bs.Volume, *bs.FreeSpace)
+		}
+	}
+
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+// serveMetrics exposes the status as Prometheus metrics on listen until ctx
+// is cancelled. It returns once the listener is ready.
+func (s *daemonStatus) serveMetrics(ctx context.Context, listen string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc(metricsPath, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", metricsContentType)
+		if err := s.writeMetrics(w); err != nil {
+			log.Println("Unable to write metrics:", err)
+		}
+	})
+	addr, err := startServer(ctx, listen, mux)
+	if err != nil {
+		return err
+	}
+	log.Printf("Serving metrics on http://%s%s", addr, metricsPath)
+	return nil
+}
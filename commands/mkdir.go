@@ -2,6 +2,7 @@ package commands
 
 import (
 	"context"
+	"errors"
 	"log"
 
 	"github.com/wilriker/rfm"
@@ -14,36 +15,48 @@ type MkdirOptions struct {
 }
 
 // Check checks all parameters for valid values
-func (m *MkdirOptions) Check() {
-	m.BaseOptions.Check()
+func (m *MkdirOptions) Check() error {
+	if err := m.BaseOptions.Check(); err != nil {
+		return err
+	}
 
 	if m.path == "" {
-		log.Fatal("remote path is mandatory")
+		return errors.New("remote path is mandatory")
 	}
 	m.path = rfm.CleanRemotePath(m.path)
+	return nil
 }
 
 // InitMkdirOptions inialies a MkdirOptions instance from command-line parameters
-func InitMkdirOptions(ctx context.Context, arguments []string) *MkdirOptions {
-	m := MkdirOptions{BaseOptions: &BaseOptions{}}
+func InitMkdirOptions(ctx context.Context, session *BaseOptions, arguments []string) (*MkdirOptions, error) {
+	m := MkdirOptions{BaseOptions: &BaseOptions{session: session}}
 
 	fs := m.GetFlagSet()
-	fs.Parse(arguments)
+	if err := fs.Parse(arguments); err != nil {
+		return nil, err
+	}
 
 	if fs.NArg() > 0 {
 		m.path = fs.Arg(0)
 	}
 
-	m.Check()
+	if err := m.Check(); err != nil {
+		return nil, err
+	}
 
-	m.Connect(ctx)
+	if err := m.Connect(ctx); err != nil {
+		return nil, err
+	}
 
-	return &m
+	return &m, nil
 }
 
 // DoMkdir is a convenience function to run mkdir from command-line parameters
-func DoMkdir(ctx context.Context, arguments []string) error {
-	mo := InitMkdirOptions(ctx, arguments)
+func DoMkdir(ctx context.Context, session *BaseOptions, arguments []string) error {
+	mo, err := InitMkdirOptions(ctx, session, arguments)
+	if err != nil {
+		return err
+	}
 	return NewMkdir(mo).Mkdir(ctx, mo.path)
 }
 
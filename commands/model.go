@@ -0,0 +1,88 @@
+package commands
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/wilriker/rfm"
+)
+
+// ModelOptions holds the specific parameters for model
+type ModelOptions struct {
+	*BaseOptions
+	key      string
+	frequent bool
+}
+
+// Check checks all parameters for valid values
+func (m *ModelOptions) Check() error {
+	return m.BaseOptions.Check()
+}
+
+// InitModelOptions initializes a ModelOptions instance from command-line parameters
+func InitModelOptions(ctx context.Context, session *BaseOptions, arguments []string) (*ModelOptions, error) {
+	m := ModelOptions{BaseOptions: &BaseOptions{session: session}}
+
+	fs := m.GetFlagSet()
+	fs.BoolVar(&m.frequent, "f", false, "Only fetch frequently changing values")
+	if err := fs.Parse(arguments); err != nil {
+		return nil, err
+	}
+
+	if fs.NArg() > 0 {
+		m.key = fs.Arg(0)
+	}
+
+	if err := m.Check(); err != nil {
+		return nil, err
+	}
+
+	if err := m.Connect(ctx); err != nil {
+		return nil, err
+	}
+
+	return &m, nil
+}
+
+// DoModel is a convenience function to run model from command-line parameters
+func DoModel(ctx context.Context, session *BaseOptions, arguments []string) error {
+	mo, err := InitModelOptions(ctx, session, arguments)
+	if err != nil {
+		return err
+	}
+	return NewModel(mo).Model(ctx, mo.key, mo.frequent)
+}
+
+// model implements the Model interface
+type model struct {
+	o *ModelOptions
+}
+
+// NewModel creates a new instance of the Model interface
+func NewModel(mo *ModelOptions) *model {
+	return &model{
+		o: mo,
+	}
+}
+
+// Model prints the subtree of the object model denoted by key as JSON.
+// If frequent is true only frequently changing values are included.
+func (m *model) Model(ctx context.Context, key string, frequent bool) error {
+	flags := rfm.ModelFlagsDefault
+	if frequent {
+		flags = rfm.ModelFlagsFrequent
+	}
+	result, err := m.o.Machine.Model(ctx, key, flags)
+	if err != nil {
+		return err
+	}
+
+	var out bytes.Buffer
+	if err = json.Indent(&out, result, "", "  "); err != nil {
+		return err
+	}
+	fmt.Println(out.String())
+	return nil
+}
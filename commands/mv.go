@@ -2,6 +2,8 @@ package commands
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log"
 
 	"github.com/wilriker/rfm"
@@ -10,29 +12,43 @@ import (
 // MvOptions holds the specific parameters for mv
 type MvOptions struct {
 	*BaseOptions
-	oldpath      string
-	newpath      string
-	removeTarget bool
+	oldpath        string
+	newpath        string
+	removeTarget   bool
+	trash          bool
+	assumeYes      bool
+	forceProtected bool
 }
 
 // Check checks ll parameters for valid values
-func (m *MvOptions) Check() {
-	m.BaseOptions.Check()
+func (m *MvOptions) Check() error {
+	if err := m.BaseOptions.Check(); err != nil {
+		return err
+	}
 
 	if m.oldpath == "" || m.newpath == "" {
-		log.Fatal("<old/path> and <new/path> are mandatory")
+		return errors.New("<old/path> and <new/path> are mandatory")
 	}
 	m.oldpath = rfm.CleanRemotePath(m.oldpath)
 	m.newpath = rfm.CleanRemotePath(m.newpath)
+	if !m.optionsSeen["trash"] {
+		m.trash = rfm.GetDevice(m.device).TrashEnabled()
+	}
+	return nil
 }
 
 // InitMvOptions initializes a new MvOptions instance from command-line parameters
-func InitMvOptions(ctx context.Context, arguments []string) *MvOptions {
-	m := MvOptions{BaseOptions: &BaseOptions{}}
+func InitMvOptions(ctx context.Context, session *BaseOptions, arguments []string) (*MvOptions, error) {
+	m := MvOptions{BaseOptions: &BaseOptions{session: session}}
 
 	fs := m.GetFlagSet()
 	fs.BoolVar(&m.removeTarget, "f", false, "Overwrite the file with <newname>")
-	fs.Parse(arguments)
+	fs.BoolVar(&m.trash, "trash", false, "Move an overwritten file to the trash instead of deleting it")
+	fs.BoolVar(&m.assumeYes, "y", false, "Do not ask for confirmation before overwriting")
+	fs.BoolVar(&m.forceProtected, "force-protected", false, "Also move or overwrite paths protected by the config")
+	if err := fs.Parse(arguments); err != nil {
+		return nil, err
+	}
 
 	l := fs.NArg()
 	if l > 0 {
@@ -42,16 +58,23 @@ func InitMvOptions(ctx context.Context, arguments []string) *MvOptions {
 		}
 	}
 
-	m.Check()
+	if err := m.Check(); err != nil {
+		return nil, err
+	}
 
-	m.Connect(ctx)
+	if err := m.Connect(ctx); err != nil {
+		return nil, err
+	}
 
-	return &m
+	return &m, nil
 }
 
 // DoMv is a convenience function to run mv from command-line parameters
-func DoMv(ctx context.Context, arguments []string) error {
-	mo := InitMvOptions(ctx, arguments)
+func DoMv(ctx context.Context, session *BaseOptions, arguments []string) error {
+	mo, err := InitMvOptions(ctx, session, arguments)
+	if err != nil {
+		return err
+	}
 	return NewMv(mo).Mv(ctx, mo.oldpath, mo.newpath, mo.removeTarget)
 }
 
@@ -69,17 +92,31 @@ func NewMv(mo *MvOptions) *mv {
 
 // Mv renames or moves a file or directory within a drive
 func (m *mv) Mv(ctx context.Context, oldpath, newpath string, removeTarget bool) error {
+	if err := m.o.checkProtected(oldpath, m.o.forceProtected); err != nil {
+		return err
+	}
 	if !removeTarget {
 		return m.o.Rfm.Move(ctx, oldpath, newpath)
 	}
 	if m.o.verbose {
 		log.Println("Checking existence of", newpath)
 	}
-	if _, err := m.o.Rfm.Fileinfo(ctx, newpath); err == nil {
-		if m.o.verbose {
-			log.Println("Deleting", newpath)
+	if fi, err := m.o.Rfm.Fileinfo(ctx, newpath); err == nil {
+		if err = m.o.checkProtected(newpath, m.o.forceProtected); err != nil {
+			return err
+		}
+		if m.o.trash {
+			err = newTrashCan(m.o.BaseOptions).Put(ctx, newpath)
+		} else {
+			if err = confirm(fmt.Sprintf("Overwrite %s (%s)?", newpath, humanSize(fi.Size)), m.o.assumeYes); err != nil {
+				return err
+			}
+			if m.o.verbose {
+				log.Println("Deleting", newpath)
+			}
+			err = m.o.Rfm.Delete(ctx, newpath)
 		}
-		if err := m.o.Rfm.Delete(ctx, newpath); err != nil {
+		if err != nil {
 			return err
 		}
 	}
@@ -0,0 +1,305 @@
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/wilriker/rfm"
+)
+
+const (
+	// GcodesDir is the default location of job files
+	GcodesDir = "0:/gcodes"
+	// cancelPauseTimeout is how long cancel waits for the print to pause
+	cancelPauseTimeout = 2 * time.Minute
+	pausePollInterval  = 500 * time.Millisecond
+)
+
+// PrintOptions holds the specific parameters for print
+type PrintOptions struct {
+	*BaseOptions
+	path       string
+	uploadFile string
+	timeout    time.Duration
+}
+
+// Check checks all parameters for valid values
+func (p *PrintOptions) Check() error {
+	if err := p.BaseOptions.Check(); err != nil {
+		return err
+	}
+
+	if p.uploadFile != "" {
+		p.uploadFile = rfm.GetAbsPath(p.uploadFile)
+
+		// The positional parameter is the directory to upload to
+		if p.path == "" {
+			p.path = GcodesDir
+		}
+		p.path = fmt.Sprintf("%s/%s", rfm.CleanRemotePath(p.path), filepath.Base(p.uploadFile))
+	}
+	if p.path == "" {
+		return errors.New("<remote/file> is mandatory")
+	}
+	p.path = rfm.CleanRemotePath(p.path)
+	return nil
+}
+
+// InitPrintOptions initializes a PrintOptions instance from command-line parameters
+func InitPrintOptions(ctx context.Context, session *BaseOptions, arguments []string) (*PrintOptions, error) {
+	p := PrintOptions{BaseOptions: &BaseOptions{session: session}}
+
+	fs := p.GetFlagSet()
+	fs.StringVar(&p.uploadFile, "upload", "", "Upload this local file before starting it")
+	fs.DurationVar(&p.timeout, "timeout", defaultReplyTimeout, "Time to wait for a reply")
+	if err := fs.Parse(arguments); err != nil {
+		return nil, err
+	}
+
+	if fs.NArg() > 0 {
+		p.path = fs.Arg(0)
+	}
+
+	if err := p.Check(); err != nil {
+		return nil, err
+	}
+
+	if err := p.Connect(ctx); err != nil {
+		return nil, err
+	}
+
+	return &p, nil
+}
+
+// DoPrint is a convenience function to run print from command-line parameters
+func DoPrint(ctx context.Context, session *BaseOptions, arguments []string) error {
+	po, err := InitPrintOptions(ctx, session, arguments)
+	if err != nil {
+		return err
+	}
+	if po.uploadFile != "" {
+		uo := &UploadOptions{BaseOptions: po.BaseOptions}
+		if err := NewUpload(uo).Upload(ctx, po.uploadFile, path.Dir(po.path)); err != nil {
+			return err
+		}
+	}
+	return NewPrint(po).Print(ctx, po.path)
+}
+
+// printJob implements the Print interface
+type printJob struct {
+	o *PrintOptions
+}
+
+// NewPrint creates a new instance of the Print interface
+func NewPrint(po *PrintOptions) *printJob {
+	return &printJob{
+		o: po,
+	}
+}
+
+// Print checks that the given remote file exists, shows its estimated print time
+// and filament usage and starts printing it
+func (p *printJob) Print(ctx context.Context, remotePath string) error {
+	fi, err := p.o.Rfm.Fileinfo(ctx, remotePath)
+	if err != nil {
+		return fmt.Errorf("%s: %w", remotePath, err)
+	}
+
+	fmt.Println(remotePath)
+	if fi.PrintTime > 0 {
+		fmt.Printf("Print time:         %s\n", formatPrintTime(fi.PrintTime, true))
+	}
+	if len(fi.Filament) > 0 {
+		fmt.Printf("Filament usage:     %s\n", formatFilamentUsage(fi.Filament))
+	}
+
+	if p.o.verbose {
+		log.Println("Starting print of", remotePath)
+	}
+	reply, err := p.o.Machine.Gcode(ctx, "M32 "+quoteGcodeString(remotePath), p.o.timeout)
+	if err != nil {
+		return err
+	}
+	if reply != "" {
+		fmt.Println(reply)
+	}
+	return nil
+}
+
+// JobControlOptions holds the specific parameters for pause, resume and cancel
+type JobControlOptions struct {
+	*BaseOptions
+	timeout time.Duration
+}
+
+// Check checks all parameters for valid values
+func (j *JobControlOptions) Check() error {
+	return j.BaseOptions.Check()
+}
+
+// InitJobControlOptions initializes a JobControlOptions instance from command-line parameters
+func InitJobControlOptions(ctx context.Context, session *BaseOptions, arguments []string) (*JobControlOptions, error) {
+	j := JobControlOptions{BaseOptions: &BaseOptions{session: session}}
+
+	fs := j.GetFlagSet()
+	fs.DurationVar(&j.timeout, "timeout", defaultReplyTimeout, "Time to wait for a reply")
+	if err := fs.Parse(arguments); err != nil {
+		return nil, err
+	}
+
+	if err := j.Check(); err != nil {
+		return nil, err
+	}
+
+	if err := j.Connect(ctx); err != nil {
+		return nil, err
+	}
+
+	return &j, nil
+}
+
+// DoPause is a convenience function to run pause from command-line parameters
+func DoPause(ctx context.Context, session *BaseOptions, arguments []string) error {
+	jo, err := InitJobControlOptions(ctx, session, arguments)
+	if err != nil {
+		return err
+	}
+	return NewJobControl(jo).Pause(ctx)
+}
+
+// DoResume is a convenience function to run resume from command-line parameters
+func DoResume(ctx context.Context, session *BaseOptions, arguments []string) error {
+	jo, err := InitJobControlOptions(ctx, session, arguments)
+	if err != nil {
+		return err
+	}
+	return NewJobControl(jo).Resume(ctx)
+}
+
+// DoCancel is a convenience function to run cancel from command-line parameters
+func DoCancel(ctx context.Context, session *BaseOptions, arguments []string) error {
+	jo, err := InitJobControlOptions(ctx, session, arguments)
+	if err != nil {
+		return err
+	}
+	return NewJobControl(jo).Cancel(ctx)
+}
+
+// jobControl implements the JobControl interface
+type jobControl struct {
+	o *JobControlOptions
+}
+
+// NewJobControl creates a new instance of the JobControl interface
+func NewJobControl(jo *JobControlOptions) *jobControl {
+	return &jobControl{
+		o: jo,
+	}
+}
+
+// Pause pauses the current print
+func (j *jobControl) Pause(ctx context.Context) error {
+	return j.send(ctx, "M25")
+}
+
+// Resume resumes a paused print
+func (j *jobControl) Resume(ctx context.Context) error {
+	return j.send(ctx, "M24")
+}
+
+// Cancel cancels the current print. RepRapFirmware only cancels paused prints
+// so the print is paused first. Since M0 also runs stop.g it is only sent if
+// there is a print to cancel.
+func (j *jobControl) Cancel(ctx context.Context) error {
+	state, err := j.state(ctx)
+	if err != nil {
+		return err
+	}
+	switch state {
+	case machineStatusPause:
+	case machineStatusPrinting, machineStatusSimulating, machineStatusResuming:
+		if err = j.send(ctx, "M25"); err != nil {
+			return err
+		}
+		fallthrough
+	case machineStatusPausing:
+		if err = j.waitPaused(ctx); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("Device is %s. There is no print to cancel", state)
+	}
+	return j.send(ctx, "M0")
+}
+
+// waitPaused blocks until the print is paused. Single failed requests are
+// retried.
+func (j *jobControl) waitPaused(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, cancelPauseTimeout)
+	defer cancel()
+	ticker := time.NewTicker(pausePollInterval)
+	defer ticker.Stop()
+	failures := 0
+	for {
+		select {
+		case <-ctx.Done():
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return fmt.Errorf("Print did not pause within %s", cancelPauseTimeout)
+			}
+			return ctx.Err()
+		case <-ticker.C:
+		}
+		state, err := j.state(ctx)
+		switch {
+		case err != nil:
+			if ctx.Err() != nil {
+				continue
+			}
+			failures++
+			if failures >= maxFetchErrors {
+				return err
+			}
+		case state == machineStatusPause:
+			return nil
+		case state != machineStatusPausing && state != machineStatusPrinting && state != machineStatusSimulating:
+			return fmt.Errorf("Device is %s instead of paused. Not cancelling", state)
+		default:
+			failures = 0
+			if j.o.verbose {
+				log.Println("Waiting for the print to pause. Device is", state)
+			}
+		}
+	}
+}
+
+// state returns the machine state of the device
+func (j *jobControl) state(ctx context.Context) (string, error) {
+	result, err := j.o.Machine.Model(ctx, "state.status", rfm.ModelFlagsDefault)
+	if err != nil {
+		return "", err
+	}
+	var state string
+	err = json.Unmarshal(result, &state)
+	return state, err
+}
+
+func (j *jobControl) send(ctx context.Context, code string) error {
+	if j.o.verbose {
+		log.Println("Sending", code)
+	}
+	reply, err := j.o.Machine.Gcode(ctx, code, j.o.timeout)
+	if err != nil {
+		return err
+	}
+	if reply != "" {
+		fmt.Println(reply)
+	}
+	return nil
+}
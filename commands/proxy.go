@@ -0,0 +1,434 @@
+package commands
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wilriker/librfm/v2"
+	"github.com/wilriker/rfm"
+)
+
+const (
+	defaultProxyListen = "127.0.0.1:8081"
+	// proxyMaxConns limits the parallel requests to the device as the
+	// firmware can only handle a few at a time
+	proxyMaxConns    = 3
+	sessionKeyHeader = "X-Session-Key"
+	rrPrefix         = "/rr_"
+	// maxBufferedBody is the size up to which request bodies are kept in
+	// memory so they can be sent again after logging in again. Larger ones,
+	// e.g. uploads of jobs, are spooled to a temporary file.
+	maxBufferedBody   = 1 << 20
+	disconnectTimeout = 5 * time.Second
+)
+
+// rrNoError is the reply of the firmware to a successful request
+var rrNoError = []byte(`{"err":0}`)
+
+// rrConnectReply is the part of the reply to rr_connect the proxy needs
+type rrConnectReply struct {
+	Err        int         `json:"err"`
+	SessionKey json.Number `json:"sessionKey"`
+}
+
+// cachedReply is a reply of the device that is reused for a short time
+type cachedReply struct {
+	contentType string
+	body        []byte
+	fetched     time.Time
+}
+
+// replayBody is the body of a client request that can be sent more than once
+type replayBody struct {
+	io.ReadSeeker
+	size int64
+	file *os.File
+}
+
+// newReplayBody reads body into memory or into a temporary file if it is
+// large. Close has to be called to remove the temporary file.
+func newReplayBody(body io.Reader) (*replayBody, error) {
+	buf, err := io.ReadAll(io.LimitReader(body, maxBufferedBody+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(buf) <= maxBufferedBody {
+		return &replayBody{ReadSeeker: bytes.NewReader(buf), size: int64(len(buf))}, nil
+	}
+	f, err := os.CreateTemp("", "rfm-proxy-")
+	if err != nil {
+		return nil, err
+	}
+	b := &replayBody{ReadSeeker: f, file: f}
+	if b.size, err = io.Copy(f, io.MultiReader(bytes.NewReader(buf), body)); err != nil {
+		b.Close()
+		return nil, err
+	}
+	return b, nil
+}
+
+// Close removes the temporary file if there is one
+func (b *replayBody) Close() error {
+	if b.file == nil {
+		return nil
+	}
+	b.file.Close()
+	return os.Remove(b.file.Name())
+}
+
+// ProxyOptions holds the specific parameters for proxy
+type ProxyOptions struct {
+	*BaseOptions
+	listen    string
+	cacheTime time.Duration
+}
+
+// Check checks all parameters for valid values
+func (p *ProxyOptions) Check() error {
+	if err := p.BaseOptions.Check(); err != nil {
+		return err
+	}
+
+	if p.cacheTime < 0 {
+		return fmt.Errorf("Invalid value for -cache: %s", p.cacheTime)
+	}
+	return nil
+}
+
+// InitProxyOptions initializes a ProxyOptions instance from command-line parameters
+func InitProxyOptions(ctx context.Context, session *BaseOptions, arguments []string) (*ProxyOptions, error) {
+	p := ProxyOptions{BaseOptions: &BaseOptions{session: session}}
+
+	fs := p.GetFlagSet()
+	fs.StringVar(&p.listen, "listen", defaultProxyListen, "Address to accept clients on")
+	fs.DurationVar(&p.cacheTime, "cache", defaultCacheTime, "Reuse file lists for this long")
+	if err := fs.Parse(arguments); err != nil {
+		return nil, err
+	}
+
+	if err := p.Check(); err != nil {
+		return nil, err
+	}
+
+	return &p, nil
+}
+
+// DoProxy is a convenience function to run proxy from command-line parameters
+func DoProxy(ctx context.Context, session *BaseOptions, arguments []string) error {
+	po, err := InitProxyOptions(ctx, session, arguments)
+	if err != nil {
+		return err
+	}
+	return NewProxy(po).Serve(ctx, po.listen)
+}
+
+// proxy implements the Proxy interface
+type proxy struct {
+	o       *ProxyOptions
+	baseURL string
+	client  *http.Client
+
+	// mu guards the session and the cache. generation counts the logins so
+	// a session is only renewed once no matter how many requests failed.
+	mu           sync.Mutex
+	sessionKey   string
+	generation   uint64
+	connectReply []byte
+	cache        map[string]cachedReply
+
+	// connectMu serializes logins
+	connectMu sync.Mutex
+
+	// uploadMu serializes uploads
+	uploadMu sync.Mutex
+}
+
+// NewProxy creates a new instance of the Proxy interface
+func NewProxy(po *ProxyOptions) *proxy {
+	return &proxy{
+		o:       po,
+		baseURL: fmt.Sprintf("http://%s:%d", po.domain, po.port),
+		client: &http.Client{
+			Transport: &http.Transport{
+				DisableCompression: true,
+				MaxConnsPerHost:    proxyMaxConns,
+			},
+		},
+		cache: make(map[string]cachedReply),
+	}
+}
+
+// Serve logs in to the device once and forwards the requests of all clients
+// over this session until ctx is cancelled. The session is ended afterwards.
+func (p *proxy) Serve(ctx context.Context, listen string) error {
+
+	// Connect is not used as the proxy has to know the session it shares
+	if err := p.connect(ctx); err != nil {
+		return err
+	}
+	defer p.disconnect()
+
+	// Save config after successful connect
+	if err := rfm.SaveConfigs(); err != nil {
+		log.Printf("Unable to save configuration for %s to %s: %s", p.o.device, rfm.ConfigPath(), err)
+	}
+
+	addr, err := startServer(ctx, listen, p)
+	if err != nil {
+		return err
+	}
+	log.Printf("Proxying %s on http://%s/", p.o.device, addr)
+	<-ctx.Done()
+	return nil
+}
+
+// connect logs in to the device and remembers the session
+func (p *proxy) connect(ctx context.Context) error {
+	vals := url.Values{}
+	vals.Set("password", p.o.password)
+	vals.Set("time", time.Now().Format(librfm.TimeFormat))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.baseURL+"/rr_connect?"+vals.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	var reply rrConnectReply
+	if err = json.Unmarshal(body, &reply); err != nil {
+		return fmt.Errorf("Unexpected reply to rr_connect: %s", err)
+	}
+	switch reply.Err {
+	case 0:
+	case 1:
+		return fmt.Errorf("Wrong password for %s", p.o.domain)
+	case 2:
+		return fmt.Errorf("%s has no more free sessions", p.o.domain)
+	default:
+		return fmt.Errorf("Unable to connect to %s (error %d)", p.o.domain, reply.Err)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.sessionKey = reply.SessionKey.String()
+	p.generation++
+	p.connectReply = body
+	if p.o.verbose {
+		log.Println("Connected to", p.o.domain)
+	}
+	return nil
+}
+
+// reconnect logs in again after a request of the given session generation
+// has been rejected. Requests that fail at the same time would otherwise
+// open one new session each, so the session is only renewed if no other
+// request has done so already.
+func (p *proxy) reconnect(ctx context.Context, generation uint64) error {
+	p.connectMu.Lock()
+	defer p.connectMu.Unlock()
+	p.mu.Lock()
+	renewed := p.generation != generation
+	p.mu.Unlock()
+	if renewed {
+		return nil
+	}
+	if p.o.verbose {
+		log.Println("Session expired. Reconnecting to", p.o.domain)
+	}
+	return p.connect(ctx)
+}
+
+// disconnect ends the session of the proxy
+func (p *proxy) disconnect() {
+	ctx, cancel := context.WithTimeout(context.Background(), disconnectTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.baseURL+"/rr_disconnect", nil)
+	if err != nil {
+		return
+	}
+	p.mu.Lock()
+	if p.sessionKey != "" {
+		req.Header.Set(sessionKeyHeader, p.sessionKey)
+	}
+	p.mu.Unlock()
+	resp, err := p.client.Do(req)
+	if err != nil {
+		log.Printf("Unable to disconnect from %s: %s", p.o.domain, err)
+		return
+	}
+	resp.Body.Close()
+	if p.o.verbose {
+		log.Println("Disconnected from", p.o.domain)
+	}
+}
+
+func (p *proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if p.o.verbose {
+		log.Println(r.Method, r.URL.RequestURI())
+	}
+	switch strings.TrimPrefix(r.URL.Path, rrPrefix) {
+	case "connect":
+
+		// Clients share the session of the proxy
+		p.mu.Lock()
+		reply := p.connectReply
+		p.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(reply)
+	case "disconnect":
+
+		// Disconnecting would end the session for all clients
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(rrNoError)
+	case "filelist", "files":
+		p.cached(w, r)
+	case "upload":
+		p.uploadMu.Lock()
+		defer p.uploadMu.Unlock()
+		p.forward(w, r, true)
+	case "delete", "move", "mkdir", "gcode":
+		p.forward(w, r, true)
+	default:
+		p.forward(w, r, false)
+	}
+}
+
+// cached answers file list requests from the cache if possible
+func (p *proxy) cached(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	query.Del("time")
+	key := r.URL.Path + "?" + query.Encode()
+
+	p.mu.Lock()
+	c, ok := p.cache[key]
+	p.mu.Unlock()
+	if ok && time.Since(c.fetched) < p.o.cacheTime {
+		w.Header().Set("Content-Type", c.contentType)
+		w.Write(c.body)
+		return
+	}
+
+	resp, err := p.do(r)
+	if err != nil {
+		p.fail(w, r, err)
+		return
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		p.fail(w, r, err)
+		return
+	}
+	if resp.StatusCode == http.StatusOK {
+		p.mu.Lock()
+		p.cache[key] = cachedReply{contentType: resp.Header.Get("Content-Type"), body: body, fetched: time.Now()}
+		p.mu.Unlock()
+	}
+	copyReplyHeader(w, resp)
+	w.Write(body)
+}
+
+// forward passes a request on to the device and streams the reply to the
+// client. If invalidate is set the request might change files so cached file
+// lists are dropped.
+func (p *proxy) forward(w http.ResponseWriter, r *http.Request, invalidate bool) {
+	resp, err := p.do(r)
+	if invalidate {
+		p.mu.Lock()
+		p.cache = make(map[string]cachedReply)
+		p.mu.Unlock()
+	}
+	if err != nil {
+		p.fail(w, r, err)
+		return
+	}
+	defer resp.Body.Close()
+	copyReplyHeader(w, resp)
+	io.Copy(w, resp.Body)
+}
+
+// do sends a request to the device using the session of the proxy. If the
+// session has expired the proxy logs in again and repeats the request. The
+// caller has to close the body of the response.
+func (p *proxy) do(r *http.Request) (*http.Response, error) {
+	body, err := newReplayBody(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	resp, generation, err := p.send(r, body)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	resp.Body.Close()
+	if err = p.reconnect(r.Context(), generation); err != nil {
+		return nil, err
+	}
+	resp, _, err = p.send(r, body)
+	return resp, err
+}
+
+// send sends a request to the device once. It returns the generation of the
+// session that was used.
+func (p *proxy) send(r *http.Request, body *replayBody) (*http.Response, uint64, error) {
+	if _, err := body.Seek(0, io.SeekStart); err != nil {
+		return nil, 0, err
+	}
+
+	// The transport must not close the body as it might be sent again
+	var content io.Reader
+	if body.size > 0 {
+		content = io.NopCloser(body)
+	}
+	req, err := http.NewRequestWithContext(r.Context(), r.Method, p.baseURL+r.URL.RequestURI(), content)
+	if err != nil {
+		return nil, 0, err
+	}
+	req.ContentLength = body.size
+	for _, h := range []string{"Content-Type", "Accept", "If-Modified-Since", "If-None-Match"} {
+		if v := r.Header.Get(h); v != "" {
+			req.Header.Set(h, v)
+		}
+	}
+	p.mu.Lock()
+	generation := p.generation
+	if p.sessionKey != "" && strings.HasPrefix(r.URL.Path, rrPrefix) {
+		req.Header.Set(sessionKeyHeader, p.sessionKey)
+	}
+	p.mu.Unlock()
+	resp, err := p.client.Do(req)
+	return resp, generation, err
+}
+
+// copyReplyHeader copies the status and headers of the reply of the device
+// to the client
+func copyReplyHeader(w http.ResponseWriter, resp *http.Response) {
+	for _, h := range []string{"Content-Type", "Content-Length", "Content-Encoding", "Cache-Control", "ETag", "Last-Modified"} {
+		if v := resp.Header.Get(h); v != "" {
+			w.Header().Set(h, v)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+}
+
+func (p *proxy) fail(w http.ResponseWriter, r *http.Request, err error) {
+	log.Printf("%s %s: %s", r.Method, r.URL.Path, err)
+	http.Error(w, err.Error(), http.StatusBadGateway)
+}
@@ -0,0 +1,383 @@
+package commands
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wilriker/librfm/v2"
+	"github.com/wilriker/rfm"
+)
+
+const (
+	// defaultCacheTime is how long directory listings are reused
+	defaultCacheTime = 2 * time.Second
+	// maxCachedContent is the total size of file contents kept in memory.
+	// The least recently used files are dropped first.
+	maxCachedContent = 32 << 20
+	remoteTypeDir    = "d"
+)
+
+// remoteListing is a cached directory listing
+type remoteListing struct {
+	files   map[string]librfm.File
+	fetched time.Time
+}
+
+// remoteContent is a cached file content. It is valid as long as size and
+// date of the remote file do not change. The content is shared with open
+// files so it must not be changed.
+type remoteContent struct {
+	path    string
+	size    uint64
+	date    time.Time
+	content []byte
+}
+
+// remoteFS gives filesystem-like access to the volumes of a device for the
+// commands that serve it to other programs. Directory listings are cached
+// for a short time and file contents as long as the file does not change and
+// they fit into the cache. All requests to the device are serialized because
+// the firmware can only handle a few at a time.
+type remoteFS struct {
+	o        *BaseOptions
+	ttl      time.Duration
+	mu       sync.Mutex
+	listings map[string]*remoteListing
+	u        *upload
+	r        *rm
+
+	// contents holds the elements of lru by path. The most recently used
+	// content is at the front of lru.
+	contents     map[string]*list.Element
+	lru          *list.List
+	contentBytes int
+}
+
+// newRemoteFS creates a remoteFS on an established connection. Paths that
+// are deleted go to the trash if the device is configured that way and
+// protected paths cannot be changed.
+func newRemoteFS(o *BaseOptions, ttl time.Duration, trash bool) *remoteFS {
+	return &remoteFS{
+		o:        o,
+		ttl:      ttl,
+		listings: make(map[string]*remoteListing),
+		contents: make(map[string]*list.Element),
+		lru:      list.New(),
+		u:        NewUpload(&UploadOptions{BaseOptions: o}),
+		r:        NewRm(&RmOptions{BaseOptions: o, trash: trash, assumeYes: true}),
+	}
+}
+
+// isVolumeRoot checks whether remotePath is the root of a volume, e.g. "0:"
+func isVolumeRoot(remotePath string) bool {
+	return strings.HasSuffix(remotePath, ":")
+}
+
+// isNotExist checks whether err means that a remote path does not exist
+func isNotExist(err error) bool {
+	return err == fs.ErrNotExist || err == librfm.ErrFileNotFound || err == librfm.ErrDirectoryNotFound || err == librfm.ErrDriveNotMounted
+}
+
+// isSessionError checks whether err means that the device does not know the
+// session anymore. librfm does not report the HTTP status so a rejected
+// request shows up as a reply that is not valid JSON.
+func isSessionError(err error) bool {
+	var syntaxErr *json.SyntaxError
+	return errors.Is(err, rfm.ErrUnauthorized) || errors.As(err, &syntaxErr)
+}
+
+// call runs a request and repeats it once after logging in again if it
+// fails because of the session. The firmware drops sessions that have been
+// idle for a few seconds.
+func (f *remoteFS) call(ctx context.Context, request func() error) error {
+	err := request()
+	if err == nil || !isSessionError(err) || ctx.Err() != nil {
+		return err
+	}
+	if f.o.Rfm.Connect(ctx, f.o.password) != nil {
+		return err
+	}
+	return request()
+}
+
+// volumes returns the numbers of all mounted volumes
+func (f *remoteFS) volumes(ctx context.Context) ([]uint64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var vols []volume
+	err := f.call(ctx, func() (err error) {
+		vols, err = fetchVolumes(ctx, f.o.Machine)
+		return err
+	})
+	if errors.Is(err, rfm.ErrNoSuchKey) {
+		// Older firmware has no volumes in the object model
+		return []uint64{0}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	mounted := make([]uint64, 0, len(vols))
+	for i, v := range vols {
+		if v.Mounted {
+			mounted = append(mounted, uint64(i))
+		}
+	}
+	return mounted, nil
+}
+
+// list returns the contents of a remote directory
+func (f *remoteFS) list(ctx context.Context, dir string) ([]librfm.File, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	l, err := f.listing(ctx, dir)
+	if err != nil {
+		return nil, err
+	}
+	files := make([]librfm.File, 0, len(l.files))
+	for _, file := range l.files {
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+// listing returns the cached listing of dir or fetches it. f.mu must be held.
+func (f *remoteFS) listing(ctx context.Context, dir string) (*remoteListing, error) {
+	if l, ok := f.listings[dir]; ok && time.Since(l.fetched) < f.ttl {
+		return l, nil
+	}
+	listDir := dir
+	if isVolumeRoot(listDir) {
+		listDir += "/"
+	}
+	var fl *librfm.Filelist
+	err := f.call(ctx, func() (err error) {
+		fl, err = f.o.Rfm.Filelist(ctx, listDir, false)
+		return err
+	})
+	if isNotExist(err) {
+		delete(f.listings, dir)
+		return nil, fs.ErrNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+	l := &remoteListing{files: make(map[string]librfm.File), fetched: time.Now()}
+	for _, file := range fl.Files {
+		l.files[file.Name] = file
+	}
+	f.listings[dir] = l
+	return l, nil
+}
+
+// stat returns the file or directory at remotePath
+func (f *remoteFS) stat(ctx context.Context, remotePath string) (*librfm.File, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.statLocked(ctx, remotePath)
+}
+
+func (f *remoteFS) statLocked(ctx context.Context, remotePath string) (*librfm.File, error) {
+	if isVolumeRoot(remotePath) {
+		if _, err := f.listing(ctx, remotePath); err != nil {
+			return nil, err
+		}
+		return &librfm.File{Type: remoteTypeDir, Name: strings.TrimSuffix(remotePath, ":")}, nil
+	}
+	l, err := f.listing(ctx, path.Dir(remotePath))
+	if err != nil {
+		return nil, err
+	}
+	file, ok := l.files[path.Base(remotePath)]
+	if !ok {
+		return nil, fs.ErrNotExist
+	}
+	return &file, nil
+}
+
+// read returns the content of a remote file. Contents are cached until the
+// file changes. The returned content must not be changed.
+func (f *remoteFS) read(ctx context.Context, remotePath string) ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	file, err := f.statLocked(ctx, remotePath)
+	if err != nil {
+		return nil, err
+	}
+	if file.IsDir() {
+		return nil, fmt.Errorf("%s is a directory", remotePath)
+	}
+	if content, ok := f.cachedContent(remotePath, file); ok {
+		return content, nil
+	}
+	var content []byte
+	err = f.call(ctx, func() (err error) {
+		content, _, err = f.o.Rfm.Download(ctx, remotePath)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	f.cacheContent(remoteContent{path: remotePath, size: file.Size, date: file.Date(), content: content})
+	return content, nil
+}
+
+// cachedContent returns the cached content of file if it is still valid.
+// f.mu must be held.
+func (f *remoteFS) cachedContent(remotePath string, file *librfm.File) ([]byte, bool) {
+	e, ok := f.contents[remotePath]
+	if !ok {
+		return nil, false
+	}
+	c := e.Value.(remoteContent)
+	if c.size != file.Size || !c.date.Equal(file.Date()) {
+		f.dropContent(remotePath)
+		return nil, false
+	}
+	f.lru.MoveToFront(e)
+	return c.content, true
+}
+
+// cacheContent adds a file content to the cache and drops the least recently
+// used ones if the cache gets too large. f.mu must be held.
+func (f *remoteFS) cacheContent(c remoteContent) {
+	f.dropContent(c.path)
+	if len(c.content) > maxCachedContent {
+		return
+	}
+	f.contents[c.path] = f.lru.PushFront(c)
+	f.contentBytes += len(c.content)
+	for f.contentBytes > maxCachedContent {
+		f.dropContent(f.lru.Back().Value.(remoteContent).path)
+	}
+}
+
+// dropContent removes the content of remotePath from the cache. f.mu must
+// be held.
+func (f *remoteFS) dropContent(remotePath string) {
+	e, ok := f.contents[remotePath]
+	if !ok {
+		return
+	}
+	f.lru.Remove(e)
+	delete(f.contents, remotePath)
+	f.contentBytes -= len(e.Value.(remoteContent).content)
+}
+
+// write replaces the content of a remote file
+func (f *remoteFS) write(ctx context.Context, remotePath string, content []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.o.checkProtected(remotePath, false); err != nil {
+		return err
+	}
+	defer f.invalidate(remotePath)
+	return f.call(ctx, func() error {
+		return f.u.uploadContent(ctx, remotePath, content)
+	})
+}
+
+// mkdir creates a remote directory
+func (f *remoteFS) mkdir(ctx context.Context, remotePath string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, err := f.statLocked(ctx, remotePath); err == nil {
+		return fs.ErrExist
+	}
+	defer f.invalidate(remotePath)
+	return f.call(ctx, func() error {
+		return f.o.Rfm.Mkdir(ctx, remotePath)
+	})
+}
+
+// remove deletes a remote file or directory with all its contents
+func (f *remoteFS) remove(ctx context.Context, remotePath string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	file, err := f.statLocked(ctx, remotePath)
+	if err != nil {
+		return err
+	}
+	if isVolumeRoot(remotePath) {
+		return fs.ErrPermission
+	}
+	defer f.invalidate(remotePath)
+	return f.call(ctx, func() error {
+		return f.r.Rm(ctx, remotePath, file.IsDir())
+	})
+}
+
+// rename moves a remote file or directory. An existing file at newPath is
+// only replaced if replace is set. Directories are never replaced.
+func (f *remoteFS) rename(ctx context.Context, oldPath, newPath string, replace bool) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if isVolumeRoot(oldPath) || isVolumeRoot(newPath) {
+		return fs.ErrPermission
+	}
+	if err := f.o.checkProtected(oldPath, false); err != nil {
+		return err
+	}
+	if err := f.o.checkProtected(newPath, false); err != nil {
+		return err
+	}
+	defer f.invalidate(oldPath)
+	defer f.invalidate(newPath)
+	if target, err := f.statLocked(ctx, newPath); err == nil {
+		if !replace || target.IsDir() {
+			return fs.ErrExist
+		}
+
+		// Move does not overwrite so the target has to go first
+		if err = f.call(ctx, func() error {
+			return f.r.Rm(ctx, newPath, false)
+		}); err != nil {
+			return err
+		}
+	}
+	return f.call(ctx, func() error {
+		return f.o.Rfm.Move(ctx, oldPath, newPath)
+	})
+}
+
+// invalidate drops everything cached about remotePath, its parent directory
+// and its contents. f.mu must be held.
+func (f *remoteFS) invalidate(remotePath string) {
+	delete(f.listings, path.Dir(remotePath))
+	for p := range f.listings {
+		if p == remotePath || strings.HasPrefix(p, remotePath+"/") {
+			delete(f.listings, p)
+		}
+	}
+	for p := range f.contents {
+		if p == remotePath || strings.HasPrefix(p, remotePath+"/") {
+			f.dropContent(p)
+		}
+	}
+}
+
+// remotePathOf converts a slash-separated path whose first element is the
+// number of a volume, e.g. /0/sys/config.g, into a remote path. The root
+// itself results in an empty path.
+func remotePathOf(name string) (string, error) {
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	if name == "" {
+		return "", nil
+	}
+	vol, rest, _ := strings.Cut(name, "/")
+	if _, err := strconv.ParseUint(vol, 10, 64); err != nil {
+		return "", fs.ErrNotExist
+	}
+	if rest == "" {
+		return vol + ":", nil
+	}
+	return vol + ":/" + rest, nil
+}
@@ -0,0 +1,86 @@
+package commands
+
+import (
+	"errors"
+	"io/fs"
+	"testing"
+	"time"
+
+	"github.com/wilriker/librfm/v2"
+)
+
+func TestRemotePathOf(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    string
+		wantErr error
+	}{
+		{"/", "", nil},
+		{"", "", nil},
+		{"/0", "0:", nil},
+		{"/0/", "0:", nil},
+		{"/0/sys/config.g", "0:/sys/config.g", nil},
+		{"1/gcodes/../macros/x.g", "1:/macros/x.g", nil},
+		{"/../0/sys", "0:/sys", nil},
+		{"/sys/config.g", "", fs.ErrNotExist},
+		{"/0:/sys", "", fs.ErrNotExist},
+	}
+	for _, tt := range tests {
+		got, err := remotePathOf(tt.name)
+		if !errors.Is(err, tt.wantErr) || got != tt.want {
+			t.Errorf("remotePathOf(%q) = %q, %v, want %q, %v", tt.name, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+// remoteFile creates the listing entry of a remote file
+func remoteFile(size uint64, date time.Time) *librfm.File {
+	f := &librfm.File{Size: size}
+	f.Timestamp.Time = date
+	return f
+}
+
+func TestRemoteFSContentCache(t *testing.T) {
+	date := time.Date(2024, time.March, 1, 12, 0, 0, 0, time.UTC)
+	f := newRemoteFS(&BaseOptions{}, defaultCacheTime, false)
+	f.cacheContent(remoteContent{path: "0:/a", size: 3, date: date, content: []byte("abc")})
+
+	if c, ok := f.cachedContent("0:/a", remoteFile(3, date)); !ok || string(c) != "abc" {
+		t.Errorf("cachedContent() = %q, %v", c, ok)
+	}
+	if _, ok := f.cachedContent("0:/a", remoteFile(3, date.Add(time.Second))); ok {
+		t.Error("content of a changed file was returned")
+	}
+	if _, ok := f.contents["0:/a"]; ok || f.contentBytes != 0 {
+		t.Errorf("stale content was kept, %d bytes cached", f.contentBytes)
+	}
+}
+
+func TestRemoteFSContentCacheEviction(t *testing.T) {
+	date := time.Date(2024, time.March, 1, 12, 0, 0, 0, time.UTC)
+	third := make([]byte, maxCachedContent/3)
+	f := newRemoteFS(&BaseOptions{}, defaultCacheTime, false)
+	for _, p := range []string{"0:/a", "0:/b", "0:/c"} {
+		f.cacheContent(remoteContent{path: p, size: uint64(len(third)), date: date, content: third})
+	}
+
+	// Using a makes b the least recently used one
+	if _, ok := f.cachedContent("0:/a", remoteFile(uint64(len(third)), date)); !ok {
+		t.Fatal("0:/a is not cached")
+	}
+	f.cacheContent(remoteContent{path: "0:/d", size: uint64(len(third)), date: date, content: third})
+	for p, want := range map[string]bool{"0:/a": true, "0:/b": false, "0:/c": true, "0:/d": true} {
+		if _, ok := f.contents[p]; ok != want {
+			t.Errorf("%s cached = %v, want %v", p, ok, want)
+		}
+	}
+	if f.contentBytes > maxCachedContent {
+		t.Errorf("%d bytes cached, limit is %d", f.contentBytes, maxCachedContent)
+	}
+
+	// Contents larger than the cache are not kept at all
+	f.cacheContent(remoteContent{path: "0:/e", content: make([]byte, maxCachedContent+1)})
+	if _, ok := f.contents["0:/e"]; ok || f.lru.Len() != 3 {
+		t.Errorf("oversized content changed the cache: %d entries", f.lru.Len())
+	}
+}
@@ -0,0 +1,136 @@
+package commands
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"text/template"
+
+	"github.com/wilriker/rfm"
+)
+
+const (
+	// templateSuffix marks files that are rendered before upload
+	templateSuffix = ".tmpl"
+)
+
+// templateData is what templates are executed with
+type templateData struct {
+	Device string
+	Domain string
+	Vars   map[string]interface{}
+}
+
+// isTemplate checks whether the file has to be rendered before upload
+func isTemplate(name string) bool {
+	return strings.HasSuffix(name, templateSuffix)
+}
+
+// renderTemplate executes the template content with the variables of the
+// current device. Using a variable that is not set is an error.
+func (b *BaseOptions) renderTemplate(name string, content []byte) ([]byte, error) {
+	t, err := template.New(name).Option("missingkey=error").Parse(string(content))
+	if err != nil {
+		return nil, err
+	}
+	data := templateData{
+		Device: b.device,
+		Domain: b.domain,
+		Vars:   make(map[string]interface{}),
+	}
+	if d := rfm.GetDevice(b.device); d != nil && d.Vars != nil {
+		data.Vars = d.Vars
+	}
+	var out bytes.Buffer
+	if err = t.Execute(&out, data); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// RenderOptions holds the specific parameters for render
+type RenderOptions struct {
+	*BaseOptions
+	templatePath string
+	outPath      string
+}
+
+// Check checks all parameters for valid values
+func (r *RenderOptions) Check() error {
+
+	// Rendering only needs the settings of the device, not a connection, so
+	// -domain is not mandatory
+	if r.session != nil {
+		r.useSession()
+	} else {
+		r.updateFromConfig()
+	}
+
+	if r.templatePath == "" {
+		return errors.New("<local/file.tmpl> is mandatory")
+	}
+	return nil
+}
+
+// InitRenderOptions initializes a RenderOptions instance from command-line parameters
+func InitRenderOptions(ctx context.Context, session *BaseOptions, arguments []string) (*RenderOptions, error) {
+	r := RenderOptions{BaseOptions: &BaseOptions{session: session}}
+
+	fs := r.GetFlagSet()
+	fs.StringVar(&r.outPath, "o", "", "Write the result to this file instead of stdout")
+	if err := fs.Parse(arguments); err != nil {
+		return nil, err
+	}
+
+	if fs.NArg() > 0 {
+		r.templatePath = fs.Arg(0)
+	}
+
+	// Rendering happens locally so there is no need to connect
+	if err := r.Check(); err != nil {
+		return nil, err
+	}
+
+	return &r, nil
+}
+
+// DoRender is a convenience function to run render from command-line parameters
+func DoRender(ctx context.Context, session *BaseOptions, arguments []string) error {
+	ro, err := InitRenderOptions(ctx, session, arguments)
+	if err != nil {
+		return err
+	}
+	return NewRender(ro).Render(ro.templatePath, ro.outPath)
+}
+
+// render implements the Render interface
+type render struct {
+	o *RenderOptions
+}
+
+// NewRender creates a new instance of the Render interface
+func NewRender(ro *RenderOptions) *render {
+	return &render{
+		o: ro,
+	}
+}
+
+// Render renders a template with the variables of the selected device exactly
+// as upload would and writes it to outPath or stdout if outPath is empty
+func (r *render) Render(templatePath, outPath string) error {
+	content, err := os.ReadFile(templatePath)
+	if err != nil {
+		return err
+	}
+	rendered, err := r.o.renderTemplate(templatePath, content)
+	if err != nil {
+		return err
+	}
+	if outPath == "" {
+		_, err = os.Stdout.Write(rendered)
+		return err
+	}
+	return os.WriteFile(outPath, rendered, 0644)
+}
@@ -2,6 +2,7 @@ package commands
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 
@@ -12,42 +13,63 @@ import (
 // RmOptions holds the specific parameters for rm
 type RmOptions struct {
 	*BaseOptions
-	path      string
-	recursive bool
+	path           string
+	recursive      bool
+	trash          bool
+	assumeYes      bool
+	forceProtected bool
 }
 
 // Check checks all parameters for valid values
-func (r *RmOptions) Check() {
-	r.BaseOptions.Check()
+func (r *RmOptions) Check() error {
+	if err := r.BaseOptions.Check(); err != nil {
+		return err
+	}
 
 	if r.path == "" {
-		log.Fatal("<remote/path> is mandatory")
+		return errors.New("<remote/path> is mandatory")
 	}
 	r.path = rfm.CleanRemotePath(r.path)
+	if !r.optionsSeen["trash"] {
+		r.trash = rfm.GetDevice(r.device).TrashEnabled()
+	}
+	return nil
 }
 
 // InitRmOptions initializes a new RmOptions instance from command-line parameters
-func InitRmOptions(ctx context.Context, arguments []string) *RmOptions {
-	r := RmOptions{BaseOptions: &BaseOptions{}}
+func InitRmOptions(ctx context.Context, session *BaseOptions, arguments []string) (*RmOptions, error) {
+	r := RmOptions{BaseOptions: &BaseOptions{session: session}}
 
 	fs := r.GetFlagSet()
 	fs.BoolVar(&r.recursive, "r", false, "Remove recursively")
-	fs.Parse(arguments)
+	fs.BoolVar(&r.trash, "trash", false, "Move to the trash instead of deleting permanently")
+	fs.BoolVar(&r.assumeYes, "y", false, "Do not ask for confirmation")
+	fs.BoolVar(&r.forceProtected, "force-protected", false, "Also remove paths protected by the config")
+	if err := fs.Parse(arguments); err != nil {
+		return nil, err
+	}
 
 	if fs.NArg() > 0 {
 		r.path = fs.Arg(0)
 	}
 
-	r.Check()
+	if err := r.Check(); err != nil {
+		return nil, err
+	}
 
-	r.Connect(ctx)
+	if err := r.Connect(ctx); err != nil {
+		return nil, err
+	}
 
-	return &r
+	return &r, nil
 }
 
 // DoRm is a convenience function to run rm from command-line parameters
-func DoRm(ctx context.Context, arguments []string) error {
-	ro := InitRmOptions(ctx, arguments)
+func DoRm(ctx context.Context, session *BaseOptions, arguments []string) error {
+	ro, err := InitRmOptions(ctx, session, arguments)
+	if err != nil {
+		return err
+	}
 	return NewRm(ro).Rm(ctx, ro.path, ro.recursive)
 }
 
@@ -66,7 +88,19 @@ func NewRm(r *RmOptions) *rm {
 // Rm deletes a file or directory.
 // Directorries will only be removed if empty or together
 // with all their contents if recursive is true.
+// In trash mode it is moved into the trash instead.
 func (r *rm) Rm(ctx context.Context, path string, recursive bool) error {
+	if err := r.o.checkProtected(path, r.o.forceProtected); err != nil {
+		return err
+	}
+	if r.o.trash {
+		if !recursive {
+			if fl, err := r.o.Rfm.Filelist(ctx, path, false); err == nil && len(fl.Files) > 0 {
+				return fmt.Errorf("%s is not empty. Use -r to remove it", path)
+			}
+		}
+		return newTrashCan(r.o.BaseOptions).Put(ctx, path)
+	}
 	if !recursive {
 		if r.o.verbose {
 			log.Println("Deleting", path)
@@ -77,6 +111,10 @@ func (r *rm) Rm(ctx context.Context, path string, recursive bool) error {
 	if err != nil {
 		return err
 	}
+	count, size := countFiles(fl)
+	if err = confirm(fmt.Sprintf("Permanently delete %s with %d files (%s)?", path, count, humanSize(size)), r.o.assumeYes); err != nil {
+		return err
+	}
 	if err = r.deleteRecursive(ctx, fl); err != nil {
 		return err
 	}
@@ -0,0 +1,330 @@
+package commands
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+)
+
+const (
+	stdinScript   = "-"
+	setErrexit    = "set -e"
+	unsetErrexit  = "set +e"
+	scriptComment = "#"
+	scriptGcode   = "gcode"
+)
+
+// assignmentRegex matches variable assignments like NAME=value
+var assignmentRegex = regexp.MustCompile(`^([A-Za-z_][A-Za-z0-9_]*)=`)
+
+// scriptCommands are the commands that can be used in a script
+var scriptCommands = map[string]func(context.Context, *BaseOptions, []string) error{
+	"backup":   DoBackup,
+	"upload":   DoUpload,
+	"mkdir":    DoMkdir,
+	"mv":       DoMv,
+	"rm":       DoRm,
+	"trash":    DoTrash,
+	"download": DoDownload,
+	"fileinfo": DoFileinfo,
+	"ls":       DoLs,
+	"verify":   DoVerify,
+	"gcode":    DoGcode,
+	"print":    DoPrint,
+	"pause":    DoPause,
+	"resume":   DoResume,
+	"cancel":   DoCancel,
+	"status":   DoStatus,
+	"model":    DoModel,
+	"firmware": DoFirmware,
+	"volumes":  DoVolumes,
+	"mount":    DoMount,
+	"unmount":  DoUnmount,
+	"plan":     DoPlan,
+	"apply":    DoApply,
+	"render":   DoRender,
+}
+
+// scriptWord is a single word of a script line
+type scriptWord struct {
+	text string
+
+	// expand is false for single-quoted words
+	expand bool
+}
+
+// scriptLine is a parsed line of a script
+type scriptLine struct {
+	number int
+	text   string
+	words  []scriptWord
+}
+
+// RunOptions holds the specific parameters for run
+type RunOptions struct {
+	*BaseOptions
+	script  string
+	errexit bool
+}
+
+// Check checks all parameters for valid values
+func (r *RunOptions) Check() error {
+	return r.BaseOptions.Check()
+}
+
+// InitRunOptions initializes a RunOptions instance from command-line parameters
+func InitRunOptions(ctx context.Context, arguments []string) (*RunOptions, error) {
+	r := RunOptions{BaseOptions: &BaseOptions{}}
+
+	fs := r.GetFlagSet()
+	fs.BoolVar(&r.errexit, "e", false, "Stop at the first failing command (same as \""+setErrexit+"\")")
+	if err := fs.Parse(arguments); err != nil {
+		return nil, err
+	}
+
+	r.script = stdinScript
+	if fs.NArg() > 0 {
+		r.script = fs.Arg(0)
+	}
+
+	if err := r.Check(); err != nil {
+		return nil, err
+	}
+
+	if err := r.Connect(ctx); err != nil {
+		return nil, err
+	}
+
+	return &r, nil
+}
+
+// DoRun is a convenience function to run a script from command-line parameters
+func DoRun(ctx context.Context, arguments []string) error {
+	ro, err := InitRunOptions(ctx, arguments)
+	if err != nil {
+		return err
+	}
+	var in io.Reader = os.Stdin
+	if ro.script != stdinScript {
+		f, err := os.Open(ro.script)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+	return NewRun(ro).Run(ctx, in)
+}
+
+// run implements the Run interface
+type run struct {
+	o    *RunOptions
+	vars map[string]string
+}
+
+// NewRun creates a new instance of the Run interface
+func NewRun(ro *RunOptions) *run {
+	return &run{
+		o:    ro,
+		vars: make(map[string]string),
+	}
+}
+
+// Run executes all commands of a script over the existing connection and
+// prints a summary at the end. The script is parsed completely before the
+// first command is run.
+func (r *run) Run(ctx context.Context, script io.Reader) error {
+	lines, err := parseScript(script)
+	if err != nil {
+		return err
+	}
+
+	errexit := r.o.errexit
+	var total, succeeded int
+	failures := make([]string, 0)
+	for i, line := range lines {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		switch line.text {
+		case setErrexit:
+			errexit = true
+			continue
+		case unsetErrexit:
+			errexit = false
+			continue
+		}
+		if !line.isAssignment() {
+			total++
+		}
+		if err = r.runLine(ctx, line); err != nil {
+			failures = append(failures, fmt.Sprintf("  line %d: %s: %s", line.number, line.text, err))
+			if errexit {
+				r.summary(total, succeeded, failures, countCommands(lines[i+1:]))
+				return fmt.Errorf("Script stopped at line %d", line.number)
+			}
+			continue
+		}
+		if !line.isAssignment() {
+			succeeded++
+		}
+	}
+	r.summary(total, succeeded, failures, 0)
+	if len(failures) > 0 {
+		return fmt.Errorf("%d of %d commands failed", len(failures), total)
+	}
+	return nil
+}
+
+// runLine executes a single line. Commands use the connection of the script
+// instead of creating their own.
+func (r *run) runLine(ctx context.Context, line scriptLine) error {
+	var err error
+	words := make([]string, 0, len(line.words))
+	for _, w := range line.words {
+		text := w.text
+		if w.expand {
+			if text, err = r.expand(text); err != nil {
+				return err
+			}
+		}
+		words = append(words, text)
+	}
+
+	if line.isAssignment() {
+		m := assignmentRegex.FindStringSubmatch(words[0])
+		if len(words) > 1 {
+			return fmt.Errorf("Unexpected words after assignment of %s", m[1])
+		}
+		r.vars[m[1]] = strings.TrimPrefix(words[0], m[0])
+		return nil
+	}
+
+	cmd, ok := scriptCommands[words[0]]
+	if !ok {
+		return fmt.Errorf("Unknown command: %s", words[0])
+	}
+	if r.o.verbose {
+		log.Printf("Line %d: %s", line.number, strings.Join(words, " "))
+	}
+	args := words[1:]
+	if words[0] == scriptGcode {
+		args = joinGcode(args)
+	}
+	return cmd(ctx, r.o.BaseOptions, args)
+}
+
+// joinGcode joins all words following the options of gcode into a single
+// G-code command. This way G-code can be written as is in scripts instead of
+// quoting it as on the command-line.
+func joinGcode(args []string) []string {
+	i := 0
+	for i < len(args) && strings.HasPrefix(args[i], "-") {
+		if args[i] == "-timeout" || args[i] == "--timeout" {
+			i++
+		}
+		i++
+	}
+	if i >= len(args) {
+		return args
+	}
+	return append(args[:i:i], strings.Join(args[i:], " "))
+}
+
+// expand replaces $NAME and ${NAME} by the value of the script variable or
+// the environment variable of that name
+func (r *run) expand(text string) (string, error) {
+	var err error
+	expanded := os.Expand(text, func(name string) string {
+		if v, ok := r.vars[name]; ok {
+			return v
+		}
+		if v, ok := os.LookupEnv(name); ok {
+			return v
+		}
+		if err == nil {
+			err = fmt.Errorf("Undefined variable: %s", name)
+		}
+		return ""
+	})
+	return expanded, err
+}
+
+func (r *run) summary(total, succeeded int, failures []string, skipped int) {
+	fmt.Printf("Ran %d commands: %d succeeded, %d failed, %d skipped\n", total, succeeded, len(failures), skipped)
+	for _, f := range failures {
+		fmt.Println(f)
+	}
+}
+
+// isAssignment checks whether the line assigns a variable
+func (l scriptLine) isAssignment() bool {
+	return l.words[0].expand && assignmentRegex.MatchString(l.words[0].text)
+}
+
+// countCommands returns the number of lines that are neither set directives
+// nor assignments
+func countCommands(lines []scriptLine) int {
+	count := 0
+	for _, l := range lines {
+		if l.text != setErrexit && l.text != unsetErrexit && !l.isAssignment() {
+			count++
+		}
+	}
+	return count
+}
+
+// parseScript splits a script into lines of words skipping empty lines
+// and comments
+func parseScript(script io.Reader) ([]scriptLine, error) {
+	lines := make([]scriptLine, 0)
+	scanner := bufio.NewScanner(script)
+	number := 0
+	for scanner.Scan() {
+		number++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, scriptComment) {
+			continue
+		}
+		words, err := splitScriptLine(text)
+		if err != nil {
+			return nil, fmt.Errorf("Line %d: %s", number, err)
+		}
+		lines = append(lines, scriptLine{number: number, text: text, words: words})
+	}
+	return lines, scanner.Err()
+}
+
+// splitScriptLine splits a line into words at whitespace. Quotes only group
+// at the beginning of a word so G-code like M98 P"0:/macros/x.g" is passed
+// on unchanged.
+func splitScriptLine(line string) ([]scriptWord, error) {
+	words := make([]scriptWord, 0)
+	for i := 0; i < len(line); {
+		if line[i] == ' ' || line[i] == '\t' {
+			i++
+			continue
+		}
+		word := scriptWord{expand: true}
+		if q := line[i]; q == '"' || q == '\'' {
+			end := strings.IndexByte(line[i+1:], q)
+			if end < 0 {
+				return nil, fmt.Errorf("Missing closing %c", q)
+			}
+			word.text = line[i+1 : i+1+end]
+			word.expand = q == '"'
+			i += end + 2
+		}
+		for i < len(line) && line[i] != ' ' && line[i] != '\t' {
+			word.text += string(line[i])
+			i++
+		}
+		words = append(words, word)
+	}
+	return words, nil
+}
@@ -0,0 +1,168 @@
+package commands
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestSplitScriptLine(t *testing.T) {
+	tests := []struct {
+		line    string
+		want    []scriptWord
+		wantErr bool
+	}{
+		{
+			line: "ls  -r\t0:/sys",
+			want: []scriptWord{{"ls", true}, {"-r", true}, {"0:/sys", true}},
+		},
+		{
+			line: `upload "my file.g" 0:/gcodes`,
+			want: []scriptWord{{"upload", true}, {"my file.g", true}, {"0:/gcodes", true}},
+		},
+		{
+			line: `mkdir '0:/$DIR'`,
+			want: []scriptWord{{"mkdir", true}, {"0:/$DIR", false}},
+		},
+		{
+			line: `gcode M98 P"0:/macros/my macro.g"`,
+			want: []scriptWord{{"gcode", true}, {"M98", true}, {`P"0:/macros/my`, true}, {`macro.g"`, true}},
+		},
+		{
+			line: `rm "0:/a"b`,
+			want: []scriptWord{{"rm", true}, {"0:/ab", true}},
+		},
+		{
+			line:    `upload "unterminated`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		words, err := splitScriptLine(tt.line)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("splitScriptLine(%q) error = %v, want error %v", tt.line, err, tt.wantErr)
+			continue
+		}
+		if !slices.Equal(words, tt.want) {
+			t.Errorf("splitScriptLine(%q) = %v, want %v", tt.line, words, tt.want)
+		}
+	}
+}
+
+func TestParseScript(t *testing.T) {
+	script := "# comment\n\nset -e\n  ls 0:/sys  \nDIR=0:/gcodes\n"
+	lines, err := parseScript(strings.NewReader(script))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lines) != 3 {
+		t.Fatalf("parseScript() returned %d lines, want 3", len(lines))
+	}
+	if lines[1].number != 4 || lines[1].text != "ls 0:/sys" {
+		t.Errorf("second line = %d %q, want 4 \"ls 0:/sys\"", lines[1].number, lines[1].text)
+	}
+	if !lines[2].isAssignment() || lines[1].isAssignment() {
+		t.Error("assignments not detected")
+	}
+	if n := countCommands(lines); n != 1 {
+		t.Errorf("countCommands() = %d, want 1", n)
+	}
+
+	if _, err = parseScript(strings.NewReader("ls\nls 'open\n")); err == nil || !strings.HasPrefix(err.Error(), "Line 2:") {
+		t.Errorf("parseScript() error = %v, want error for line 2", err)
+	}
+}
+
+func TestJoinGcode(t *testing.T) {
+	tests := []struct {
+		args []string
+		want []string
+	}{
+		{[]string{"G28", "X", "Y"}, []string{"G28 X Y"}},
+		{[]string{"-timeout", "5s", "M98", `P"0:/macros/x.g"`}, []string{"-timeout", "5s", `M98 P"0:/macros/x.g"`}},
+		{[]string{"-verbose", "M115"}, []string{"-verbose", "M115"}},
+		{[]string{"-verbose"}, []string{"-verbose"}},
+		{[]string{}, []string{}},
+	}
+	for _, tt := range tests {
+		if got := joinGcode(slices.Clone(tt.args)); !slices.Equal(got, tt.want) {
+			t.Errorf("joinGcode(%q) = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+}
+
+// useScriptCommand replaces a script command for the duration of a test and
+// records the arguments it is called with
+func useScriptCommand(t *testing.T, name string, err error) *[][]string {
+	t.Helper()
+	calls := make([][]string, 0)
+	old, existed := scriptCommands[name]
+	scriptCommands[name] = func(ctx context.Context, session *BaseOptions, arguments []string) error {
+		calls = append(calls, arguments)
+		return err
+	}
+	t.Cleanup(func() {
+		if existed {
+			scriptCommands[name] = old
+		} else {
+			delete(scriptCommands, name)
+		}
+	})
+	return &calls
+}
+
+func TestRun(t *testing.T) {
+	t.Setenv("RFM_TEST_ENV", "env")
+	calls := useScriptCommand(t, "echo", nil)
+	gcodes := useScriptCommand(t, scriptGcode, nil)
+	useScriptCommand(t, "fail", errors.New("failed"))
+
+	r := NewRun(&RunOptions{BaseOptions: &BaseOptions{}})
+	script := `DIR=0:/gcodes
+echo "$DIR/a b.g" '$DIR' ${RFM_TEST_ENV}
+gcode -timeout 1s M98 P"$DIR/x.g"
+fail
+echo last
+`
+	err := r.Run(context.Background(), strings.NewReader(script))
+	if err == nil || err.Error() != "1 of 4 commands failed" {
+		t.Errorf("Run() error = %v", err)
+	}
+	want := [][]string{{"0:/gcodes/a b.g", "$DIR", "env"}, {"last"}}
+	if !slices.EqualFunc(*calls, want, slices.Equal[[]string]) {
+		t.Errorf("echo called with %q, want %q", *calls, want)
+	}
+	wantGcode := [][]string{{"-timeout", "1s", `M98 P"0:/gcodes/x.g"`}}
+	if !slices.EqualFunc(*gcodes, wantGcode, slices.Equal[[]string]) {
+		t.Errorf("gcode called with %q, want %q", *gcodes, wantGcode)
+	}
+}
+
+func TestRunErrexit(t *testing.T) {
+	calls := useScriptCommand(t, "echo", nil)
+	useScriptCommand(t, "fail", errors.New("failed"))
+
+	r := NewRun(&RunOptions{BaseOptions: &BaseOptions{}})
+	script := "echo first\nfail\nset -e\nfail\necho never\n"
+	err := r.Run(context.Background(), strings.NewReader(script))
+	if err == nil || err.Error() != "Script stopped at line 4" {
+		t.Errorf("Run() error = %v", err)
+	}
+	if len(*calls) != 1 {
+		t.Errorf("echo called %d times, want 1", len(*calls))
+	}
+}
+
+func TestRunUndefinedVariable(t *testing.T) {
+	calls := useScriptCommand(t, "echo", nil)
+	r := NewRun(&RunOptions{BaseOptions: &BaseOptions{}})
+	err := r.Run(context.Background(), strings.NewReader("echo $RFM_TEST_UNDEFINED\n"))
+	if err == nil {
+		t.Error("Run() succeeded with an undefined variable")
+	}
+	if len(*calls) != 0 {
+		t.Errorf("echo called with %q", *calls)
+	}
+}
@@ -0,0 +1,292 @@
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/wilriker/rfm"
+)
+
+const (
+	outputText         = "text"
+	outputJSON         = "json"
+	defaultInterval    = 2 * time.Second
+	clearScreen        = "\033[H\033[2J"
+	machineStatusIdle  = "idle"
+	machineStatusOff   = "off"
+	machineStatusError = "halted"
+	machineStatusPause = "paused"
+	// States of a print that can be paused
+	machineStatusPrinting   = "processing"
+	machineStatusSimulating = "simulating"
+	machineStatusPausing    = "pausing"
+	machineStatusResuming   = "resuming"
+	// maxFetchErrors is the number of consecutive failed status requests
+	// after which waiting is given up
+	maxFetchErrors = 3
+)
+
+// StatusOptions holds the specific parameters for status
+type StatusOptions struct {
+	*BaseOptions
+	watch    bool
+	waitIdle bool
+	interval time.Duration
+	output   string
+}
+
+// Check checks all parameters for valid values
+func (s *StatusOptions) Check() error {
+	if err := s.BaseOptions.Check(); err != nil {
+		return err
+	}
+
+	if s.output != outputText && s.output != outputJSON {
+		return fmt.Errorf("Invalid value for -o: %s", s.output)
+	}
+	if s.interval <= 0 {
+		return errors.New("-interval has to be positive")
+	}
+	return nil
+}
+
+// InitStatusOptions initializes a StatusOptions instance from command-line parameters
+func InitStatusOptions(ctx context.Context, session *BaseOptions, arguments []string) (*StatusOptions, error) {
+	s := StatusOptions{BaseOptions: &BaseOptions{session: session}}
+
+	fs := s.GetFlagSet()
+	fs.BoolVar(&s.watch, "watch", false, "Refresh the status continuously")
+	fs.BoolVar(&s.waitIdle, "wait-idle", false, "Block until the device is idle")
+	fs.DurationVar(&s.interval, "interval", defaultInterval, "Refresh interval for -watch and -wait-idle")
+	fs.StringVar(&s.output, "o", outputText, "Output format: text or json")
+	if err := fs.Parse(arguments); err != nil {
+		return nil, err
+	}
+
+	if err := s.Check(); err != nil {
+		return nil, err
+	}
+
+	if err := s.Connect(ctx); err != nil {
+		return nil, err
+	}
+
+	return &s, nil
+}
+
+// DoStatus is a convenience function to run status from command-line parameters
+func DoStatus(ctx context.Context, session *BaseOptions, arguments []string) error {
+	so, err := InitStatusOptions(ctx, session, arguments)
+	if err != nil {
+		return err
+	}
+	st := NewStatus(so)
+	if so.waitIdle {
+		return st.WaitIdle(ctx, so.interval)
+	}
+	if so.watch {
+		return st.Watch(ctx, so.interval)
+	}
+	return st.Status(ctx)
+}
+
+// machineStatus is a summary of the object model
+type machineStatus struct {
+	Status   string         `json:"status"`
+	File     string         `json:"file,omitempty"`
+	Progress float64        `json:"progress"`
+	Layer    uint64         `json:"layer,omitempty"`
+	Layers   uint64         `json:"layers,omitempty"`
+	TimeLeft float64        `json:"timeLeft,omitempty"`
+	Heaters  []heaterStatus `json:"heaters"`
+}
+
+type heaterStatus struct {
+	Current float64 `json:"current"`
+	Active  float64 `json:"active"`
+	State   string  `json:"state"`
+}
+
+// isBusy checks whether the device is doing something, e.g. printing a file
+func (m *machineStatus) isBusy() bool {
+	switch m.Status {
+	case machineStatusIdle, machineStatusOff, machineStatusError:
+		return false
+	}
+	return true
+}
+
+// status implements the Status interface
+type status struct {
+	o *StatusOptions
+}
+
+// NewStatus creates a new instance of the Status interface
+func NewStatus(so *StatusOptions) *status {
+	return &status{
+		o: so,
+	}
+}
+
+// Status prints the current state of the device
+func (s *status) Status(ctx context.Context) error {
+	ms, err := s.fetch(ctx)
+	if err != nil {
+		return err
+	}
+	return s.print(ms)
+}
+
+// Watch prints the state of the device every interval until ctx is cancelled
+func (s *status) Watch(ctx context.Context, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		ms, err := s.fetch(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		if s.o.output == outputText {
+			fmt.Print(clearScreen)
+		}
+		if err = s.print(ms); err != nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// WaitIdle blocks until the device is no longer busy, e.g. the current
+// print has finished. Single failed requests are retried. A paused print
+// ends the wait with an error as it will not finish on its own.
+func (s *status) WaitIdle(ctx context.Context, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	failures := 0
+	for {
+		ms, err := s.fetch(ctx)
+		switch {
+		case err != nil:
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			failures++
+			if failures >= maxFetchErrors {
+				return err
+			}
+			if s.o.verbose {
+				log.Println("Unable to fetch status:", err)
+			}
+		case ms.Status == machineStatusPause:
+			return fmt.Errorf("Device is paused at %.1f%%", ms.Progress)
+		case !ms.isBusy():
+			if s.o.verbose {
+				log.Println("Device is", ms.Status)
+			}
+			return nil
+		default:
+			failures = 0
+			if s.o.verbose {
+				log.Printf("Device is %s (%.1f%%)", ms.Status, ms.Progress)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// fetch queries the relevant parts of the object model
+func (s *status) fetch(ctx context.Context) (*machineStatus, error) {
+	var state struct {
+		Status string
+	}
+	var job struct {
+		File struct {
+			FileName  string
+			Size      uint64
+			NumLayers uint64
+		}
+		FilePosition uint64
+		Layer        uint64
+		TimesLeft    struct {
+			File   float64
+			Slicer float64
+		}
+	}
+	var heat struct {
+		Heaters []heaterStatus
+	}
+	for key, v := range map[string]interface{}{"state": &state, "job": &job, "heat": &heat} {
+		result, err := s.o.Machine.Model(ctx, key, rfm.ModelFlagsDefault)
+		if err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal(result, v); err != nil {
+			return nil, err
+		}
+	}
+
+	ms := &machineStatus{
+		Status:  state.Status,
+		Heaters: heat.Heaters,
+	}
+
+	// Job details are only meaningful while there is a job file
+	if job.File.FileName != "" {
+		ms.File = job.File.FileName
+		ms.Layer = job.Layer
+		ms.Layers = job.File.NumLayers
+		if job.File.Size > 0 {
+			ms.Progress = float64(job.FilePosition) / float64(job.File.Size) * 100
+		}
+
+		// Prefer the slicer's estimation if there is one
+		ms.TimeLeft = job.TimesLeft.Slicer
+		if ms.TimeLeft <= 0 {
+			ms.TimeLeft = job.TimesLeft.File
+		}
+	}
+	if ms.Heaters == nil {
+		ms.Heaters = make([]heaterStatus, 0)
+	}
+	return ms, nil
+}
+
+func (s *status) print(ms *machineStatus) error {
+	if s.o.output == outputJSON {
+		return json.NewEncoder(os.Stdout).Encode(ms)
+	}
+	fmt.Printf("Status:             %s\n", ms.Status)
+	if ms.File != "" {
+		fmt.Printf("Job:                %s\n", ms.File)
+		fmt.Printf("Progress:           %.1f%%\n", ms.Progress)
+		if ms.Layers > 0 {
+			fmt.Printf("Layer:              %d of %d\n", ms.Layer, ms.Layers)
+		} else if ms.Layer > 0 {
+			fmt.Printf("Layer:              %d\n", ms.Layer)
+		}
+		if ms.TimeLeft > 0 {
+			left := time.Duration(ms.TimeLeft) * time.Second
+			fmt.Printf("ETA:                %s (%s left)\n", time.Now().Add(left).Format("15:04:05"), left)
+		}
+	}
+	for i, h := range ms.Heaters {
+		fmt.Printf("Heater %d:           %.1f°C (active %.1f°C, %s)\n", i, h.Current, h.Active, h.State)
+	}
+	return nil
+}
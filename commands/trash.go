@@ -0,0 +1,401 @@
+package commands
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/wilriker/librfm/v2"
+	"github.com/wilriker/rfm"
+)
+
+const (
+	// trashDirName is the directory on each volume deleted paths are moved to
+	trashDirName    = ".rfmtrash"
+	trashTimeFormat = "20060102-150405"
+	trashList       = "list"
+	trashRestore    = "restore"
+	trashEmpty      = "empty"
+)
+
+// trashRoot returns the trash directory of the given volume
+func trashRoot(vol uint64) string {
+	return fmt.Sprintf("%d:/%s", vol, trashDirName)
+}
+
+// splitRemotePath splits a cleaned remote path into its volume and the path
+// relative to the root of that volume
+func splitRemotePath(remotePath string) (uint64, string) {
+	i := strings.Index(remotePath, ":")
+	return rfm.RemoteVolume(remotePath), strings.TrimPrefix(remotePath[i+1:], "/")
+}
+
+// trashCan moves remote paths into the trash of their volume instead of
+// deleting them
+type trashCan struct {
+	o     *BaseOptions
+	stamp string
+}
+
+// newTrashCan creates a trashCan that collects everything put into it below
+// a directory named after the current time
+func newTrashCan(o *BaseOptions) *trashCan {
+	return &trashCan{
+		o:     o,
+		stamp: time.Now().Format(trashTimeFormat),
+	}
+}
+
+// Put moves a file or directory into the trash keeping its original location
+func (t *trashCan) Put(ctx context.Context, remotePath string) error {
+	vol, rel := splitRemotePath(remotePath)
+	if rel == "" || rel == trashDirName || strings.HasPrefix(rel, trashDirName+"/") {
+		return fmt.Errorf("Refusing to move %s to the trash", remotePath)
+	}
+	target := fmt.Sprintf("%s/%s/%s", trashRoot(vol), t.stamp, rel)
+	if err := mkdirAll(ctx, t.o.Rfm, path.Dir(target)); err != nil {
+		return err
+	}
+	if t.o.verbose {
+		log.Println("Moving", remotePath, "to", target)
+	}
+	return t.o.Rfm.Move(ctx, remotePath, target)
+}
+
+// mkdirAll creates a remote directory together with all missing parents
+func mkdirAll(ctx context.Context, r *librfm.RRFFileManager, dir string) error {
+	_, err := r.Filelist(ctx, dir, false)
+	if err == nil {
+		return nil
+	}
+	if err != librfm.ErrDirectoryNotFound {
+		return err
+	}
+
+	// Stop at the root of the volume
+	if parent := path.Dir(dir); !strings.HasSuffix(parent, ":") {
+		if err = mkdirAll(ctx, r, parent); err != nil {
+			return err
+		}
+	}
+	return r.Mkdir(ctx, dir)
+}
+
+// TrashOptions holds the specific parameters for trash
+type TrashOptions struct {
+	*BaseOptions
+	subcmd     string
+	volume     uint64
+	olderStr   string
+	older      time.Duration
+	stamp      string
+	remotePath string
+	assumeYes  bool
+}
+
+// Check checks all parameters for valid values
+func (t *TrashOptions) Check() error {
+	if err := t.BaseOptions.Check(); err != nil {
+		return err
+	}
+
+	switch t.subcmd {
+	case trashList, trashEmpty:
+	case trashRestore:
+		if t.stamp == "" {
+			return errors.New("<timestamp> is mandatory")
+		}
+		if _, err := time.Parse(trashTimeFormat, t.stamp); err != nil {
+			return fmt.Errorf("Invalid timestamp: %s", t.stamp)
+		}
+		if t.remotePath != "" {
+			t.remotePath = rfm.CleanRemotePath(t.remotePath)
+			t.volume = rfm.RemoteVolume(t.remotePath)
+		}
+	default:
+		return errors.New("Usage: rfm trash list|restore|empty")
+	}
+
+	if t.olderStr != "" {
+		older, err := parseAge(t.olderStr)
+		if err != nil {
+			return fmt.Errorf("Invalid value for -older: %s", t.olderStr)
+		}
+		t.older = older
+	}
+	return nil
+}
+
+// parseAge parses a duration that can additionally be given in days, e.g. "7d"
+func parseAge(age string) (time.Duration, error) {
+	if strings.HasSuffix(age, "d") {
+		days, err := strconv.ParseUint(strings.TrimSuffix(age, "d"), 10, 32)
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(age)
+}
+
+// InitTrashOptions initializes a TrashOptions instance from command-line parameters
+func InitTrashOptions(ctx context.Context, session *BaseOptions, arguments []string) (*TrashOptions, error) {
+	t := TrashOptions{BaseOptions: &BaseOptions{session: session}}
+
+	if len(arguments) > 0 {
+		t.subcmd = arguments[0]
+		arguments = arguments[1:]
+	}
+
+	fs := t.GetFlagSet()
+	fs.Uint64Var(&t.volume, "volume", 0, "Volume whose trash to use")
+	fs.StringVar(&t.olderStr, "older", "", "Only empty trashed paths older than this, e.g. 7d or 12h")
+	fs.BoolVar(&t.assumeYes, "y", false, "Do not ask for confirmation before emptying the trash")
+	if err := fs.Parse(arguments); err != nil {
+		return nil, err
+	}
+
+	l := fs.NArg()
+	if l > 0 {
+		t.stamp = fs.Arg(0)
+		if l > 1 {
+			t.remotePath = fs.Arg(1)
+		}
+	}
+
+	if err := t.Check(); err != nil {
+		return nil, err
+	}
+
+	if err := t.Connect(ctx); err != nil {
+		return nil, err
+	}
+
+	return &t, nil
+}
+
+// DoTrash is a convenience function to run trash from command-line parameters
+func DoTrash(ctx context.Context, session *BaseOptions, arguments []string) error {
+	to, err := InitTrashOptions(ctx, session, arguments)
+	if err != nil {
+		return err
+	}
+	t := NewTrash(to)
+	switch to.subcmd {
+	case trashRestore:
+		return t.Restore(ctx, to.volume, to.stamp, to.remotePath)
+	case trashEmpty:
+		return t.Empty(ctx, to.volume, to.older)
+	default:
+		return t.List(ctx, to.volume)
+	}
+}
+
+// trash implements the Trash interface
+type trash struct {
+	o *TrashOptions
+}
+
+// NewTrash creates a new instance of the Trash interface
+func NewTrash(to *TrashOptions) *trash {
+	return &trash{
+		o: to,
+	}
+}
+
+// stamps returns the names of all timestamp directories in the trash of vol
+// sorted from oldest to newest
+func (t *trash) stamps(ctx context.Context, vol uint64) ([]string, error) {
+	fl, err := t.o.Rfm.Filelist(ctx, trashRoot(vol), false)
+	if err == librfm.ErrDirectoryNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	stamps := make([]string, 0)
+	for _, f := range fl.Files {
+		if _, err := time.Parse(trashTimeFormat, f.Name); f.IsDir() && err == nil {
+			stamps = append(stamps, f.Name)
+		}
+	}
+	sort.Strings(stamps)
+	return stamps, nil
+}
+
+// List prints all trashed files with their original location
+func (t *trash) List(ctx context.Context, vol uint64) error {
+	stamps, err := t.stamps(ctx, vol)
+	if err != nil {
+		return err
+	}
+	if len(stamps) == 0 {
+		fmt.Printf("Trash of %d:/ is empty\n", vol)
+		return nil
+	}
+	for _, stamp := range stamps {
+		dir := fmt.Sprintf("%s/%s", trashRoot(vol), stamp)
+		fl, err := t.o.Rfm.Filelist(ctx, dir, true)
+		if err != nil {
+			return err
+		}
+		fmt.Println(stamp)
+		t.listFiles(fl, dir, vol)
+	}
+	return nil
+}
+
+func (t *trash) listFiles(fl *librfm.Filelist, stampDir string, vol uint64) {
+	for _, f := range fl.Files {
+		if f.IsDir() {
+			continue
+		}
+		rel := strings.TrimPrefix(fmt.Sprintf("%s/%s", fl.Dir, f.Name), stampDir)
+		fmt.Printf("  %s  %d:%s\n", rfm.HumanReadableSize(f.Size), vol, rel)
+	}
+	for _, sub := range fl.Subdirs {
+		t.listFiles(sub, stampDir, vol)
+	}
+}
+
+// Restore moves the contents of a trash directory back to their original
+// location. If remotePath is not empty only this path is restored. Existing
+// files are never overwritten.
+func (t *trash) Restore(ctx context.Context, vol uint64, stamp, remotePath string) error {
+	stampDir := fmt.Sprintf("%s/%s", trashRoot(vol), stamp)
+	src := stampDir
+	dest := fmt.Sprintf("%d:", vol)
+	if remotePath != "" {
+		_, rel := splitRemotePath(remotePath)
+		src = fmt.Sprintf("%s/%s", stampDir, rel)
+		dest = remotePath
+	}
+	if _, err := t.o.Rfm.Filelist(ctx, src, false); err == librfm.ErrDirectoryNotFound {
+		if _, err = t.o.Rfm.Fileinfo(ctx, src); err != nil {
+			return fmt.Errorf("%s is not in the trash", src)
+		}
+	} else if err != nil {
+		return err
+	}
+
+	if err := t.restore(ctx, src, dest); err != nil {
+		return err
+	}
+
+	// Restoring single paths leaves their parent directories behind
+	_, err := t.pruneEmpty(ctx, stampDir)
+	return err
+}
+
+// restore moves src to dest. Directories are merged into existing ones.
+func (t *trash) restore(ctx context.Context, src, dest string) error {
+	fl, err := t.o.Rfm.Filelist(ctx, src, false)
+	if err == librfm.ErrDirectoryNotFound {
+		if _, err = t.o.Rfm.Fileinfo(ctx, dest); err == nil {
+			return fmt.Errorf("%s already exists. Not restoring it from %s", dest, src)
+		}
+		return t.move(ctx, src, dest)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Move the whole directory if there is nothing in the way
+	if !strings.HasSuffix(dest, ":") {
+		if _, err = t.o.Rfm.Filelist(ctx, dest, false); err == librfm.ErrDirectoryNotFound {
+			return t.move(ctx, src, dest)
+		} else if err != nil {
+			return err
+		}
+	}
+	for _, f := range fl.Files {
+		if err = t.restore(ctx, fmt.Sprintf("%s/%s", src, f.Name), fmt.Sprintf("%s/%s", dest, f.Name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *trash) move(ctx context.Context, src, dest string) error {
+	if err := mkdirAll(ctx, t.o.Rfm, path.Dir(dest)); err != nil {
+		return err
+	}
+	if t.o.verbose {
+		log.Println("Restoring", dest)
+	}
+	return t.o.Rfm.Move(ctx, src, dest)
+}
+
+// pruneEmpty removes dir and all its subdirectories if they do not contain
+// any files. It returns whether dir was removed.
+func (t *trash) pruneEmpty(ctx context.Context, dir string) (bool, error) {
+	fl, err := t.o.Rfm.Filelist(ctx, dir, false)
+	if err == librfm.ErrDirectoryNotFound {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	empty := true
+	for _, f := range fl.Files {
+		if !f.IsDir() {
+			empty = false
+			continue
+		}
+		removed, err := t.pruneEmpty(ctx, fmt.Sprintf("%s/%s", dir, f.Name))
+		if err != nil {
+			return false, err
+		}
+		empty = empty && removed
+	}
+	if !empty {
+		return false, nil
+	}
+	return true, t.o.Rfm.Delete(ctx, dir)
+}
+
+// Empty permanently deletes everything that has been in the trash for at
+// least the given duration
+func (t *trash) Empty(ctx context.Context, vol uint64, older time.Duration) error {
+	stamps, err := t.stamps(ctx, vol)
+	if err != nil {
+		return err
+	}
+	expired := make([]*librfm.Filelist, 0)
+	var count, size uint64
+	for _, stamp := range stamps {
+		trashed, _ := time.ParseInLocation(trashTimeFormat, stamp, time.Local)
+		if time.Since(trashed) < older {
+			continue
+		}
+		fl, err := t.o.Rfm.Filelist(ctx, fmt.Sprintf("%s/%s", trashRoot(vol), stamp), true)
+		if err != nil {
+			return err
+		}
+		c, s := countFiles(fl)
+		count += c
+		size += s
+		expired = append(expired, fl)
+	}
+	if len(expired) == 0 {
+		return nil
+	}
+	if err = confirm(fmt.Sprintf("Permanently delete %d trashed files (%s)?", count, humanSize(size)), t.o.assumeYes); err != nil {
+		return err
+	}
+
+	// Everything has been confirmed at once already
+	r := NewRm(&RmOptions{BaseOptions: t.o.BaseOptions, assumeYes: true})
+	for _, fl := range expired {
+		if err = r.Rm(ctx, fl.Dir, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
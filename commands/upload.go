@@ -2,6 +2,7 @@ package commands
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"os"
@@ -10,40 +11,69 @@ import (
 
 	"bytes"
 
+	"github.com/wilriker/librfm/v2"
 	"github.com/wilriker/rfm"
 )
 
 // UploadOptions hold the specific parameters for upload
 type UploadOptions struct {
 	*BaseOptions
-	localPath  string
-	remotePath string
-	excls      rfm.Excludes
+	localPath      string
+	remotePath     string
+	excls          rfm.Excludes
+	force          bool
+	atomic         bool
+	keepBackup     bool
+	forceProtected bool
+	watch          bool
 }
 
 // Check checks all parameters for valid values
-func (u *UploadOptions) Check() {
-	u.BaseOptions.Check()
+func (u *UploadOptions) Check() error {
+	if err := u.BaseOptions.Check(); err != nil {
+		return err
+	}
 
 	u.localPath = rfm.GetAbsPath(u.localPath)
-	u.remotePath = rfm.CleanRemotePath(u.remotePath)
+	u.remotePath = rfm.CleanRemotePath(u.getRemotePath(u.remotePath))
 
-	d := rfm.GetDevice(u.device)
-	if !u.optionsSeen["exclude"] {
-		u.excls = d.Excludes["upload"]
+	if !u.optionsSeen["exclude"] && !u.optionsSeen["include"] {
+		u.excls = rfm.GetDevice(u.device).Excludes["upload"]
 	} else {
-		d.Excludes["upload"] = u.excls
+		rfm.UpdateDevice(u.device, func(d *rfm.Device) {
+			d.Excludes["upload"] = u.excls
+		})
 	}
-	u.excls.ForEach(rfm.GetAbsPath)
+
+	// Earlier versions used absolute local paths as patterns
+	u.excls.Rebase(u.localPath)
+	fi, err := os.Stat(u.localPath)
+	if err == nil && fi.IsDir() {
+		if err := u.excls.LoadIgnoreFile(u.localPath); err != nil {
+			return err
+		}
+	}
+	if u.watch && (err != nil || !fi.IsDir()) {
+		return errors.New("-watch needs <local/path> to be a directory")
+	}
+	return nil
 }
 
 // InitUploadOptions intitializes a new UploadOptions instance from command-line parameters
-func InitUploadOptions(ctx context.Context, arguments []string) *UploadOptions {
-	u := UploadOptions{BaseOptions: &BaseOptions{}}
+func InitUploadOptions(ctx context.Context, session *BaseOptions, arguments []string) (*UploadOptions, error) {
+	u := UploadOptions{BaseOptions: &BaseOptions{session: session}}
 
 	fs := u.GetFlagSet()
-	fs.Var(&u.excls, "exclude", "Exclude paths starting with this string (can be passed multiple times)")
-	fs.Parse(arguments)
+	fs.Var(&u.excls, "exclude", "Exclude paths matching this pattern (can be passed multiple times)")
+	fs.Var(u.excls.Includes(), "include", "Include paths matching this pattern even if excluded (can be passed multiple times)")
+	fs.BoolVar(&u.force, "force", false, "Upload even if there is not enough free space on the device")
+	fs.BoolVar(&u.atomic, "atomic", false, "Upload to a temporary file first and rename it when complete (always done below "+SysDir+")")
+	fs.BoolVar(&u.keepBackup, "bak", false, "Keep the previous version of replaced files as <name>"+backupSuffix+" (implies -atomic)")
+	fs.BoolVar(&u.forceProtected, "force-protected", false, "Also overwrite paths protected by the config")
+	fs.BoolVar(&u.watch, "watch", false, "Keep watching <local/path> and upload changes")
+	if err := fs.Parse(arguments); err != nil {
+		return nil, err
+	}
 
 	l := fs.NArg()
 	if l > 0 {
@@ -53,16 +83,26 @@ func InitUploadOptions(ctx context.Context, arguments []string) *UploadOptions {
 		}
 	}
 
-	u.Check()
+	if err := u.Check(); err != nil {
+		return nil, err
+	}
 
-	u.Connect(ctx)
+	if err := u.Connect(ctx); err != nil {
+		return nil, err
+	}
 
-	return &u
+	return &u, nil
 }
 
 // DoUpload is a convencience function to run upload from command-line parameters
-func DoUpload(ctx context.Context, arguments []string) error {
-	uo := InitUploadOptions(ctx, arguments)
+func DoUpload(ctx context.Context, session *BaseOptions, arguments []string) error {
+	uo, err := InitUploadOptions(ctx, session, arguments)
+	if err != nil {
+		return err
+	}
+	if uo.watch {
+		return NewUpload(uo).Watch(ctx, uo.localPath, uo.remotePath)
+	}
 	return NewUpload(uo).Upload(ctx, uo.localPath, uo.remotePath)
 }
 
@@ -78,10 +118,181 @@ func NewUpload(uo *UploadOptions) *upload {
 	}
 }
 
-// Upload uploads a file or directory (structure) to the given remote path
+const (
+	uploadTempSuffix = ".rfmtmp"
+	// uploadOldSuffix is used for the previous version of a file while it
+	// is replaced and no backup is kept
+	uploadOldSuffix = ".rfmold"
+	backupSuffix    = ".bak"
+)
+
+// uploadFile is a single file to be transferred
+type uploadFile struct {
+	localPath  string
+	remotePath string
+	size       uint64
+
+	// content is only set for rendered templates
+	content []byte
+}
+
+// Upload uploads a file or directory (structure) to the given remote path.
+// Unless forced it will refuse to start if the target volume does not have
+// enough free space left for all files.
 func (u *upload) Upload(ctx context.Context, localPath, remotePath string) error {
-	return filepath.Walk(u.o.localPath, func(path string, info os.FileInfo, err error) error {
-		if u.o.excls.Contains(path) {
+	files, err := u.collect(localPath, remotePath)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if err = u.o.checkProtected(f.remotePath, u.o.forceProtected); err != nil {
+			return err
+		}
+	}
+
+	if !u.o.force {
+		if err = u.checkFreeSpace(ctx, remotePath, files); err != nil {
+			return err
+		}
+	}
+
+	for _, f := range files {
+		if err = u.transfer(ctx, f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// transfer uploads a single file
+func (u *upload) transfer(ctx context.Context, f uploadFile) error {
+	fileContent := f.content
+	if fileContent == nil {
+		var err error
+		if fileContent, err = os.ReadFile(f.localPath); err != nil {
+			return err
+		}
+	}
+	if u.o.verbose {
+		log.Printf("Uploading %s to %s", f.localPath, f.remotePath)
+	}
+	return u.uploadContent(ctx, f.remotePath, fileContent)
+}
+
+// uploadContent writes content to remotePath atomically if necessary
+func (u *upload) uploadContent(ctx context.Context, remotePath string, content []byte) error {
+	if u.isAtomic(remotePath) {
+		return u.uploadAtomic(ctx, remotePath, content)
+	}
+	_, err := u.o.Rfm.Upload(ctx, remotePath, bytes.NewReader(content))
+	return err
+}
+
+// isAtomic checks whether the file should be uploaded via a temporary file.
+// A half-written file in the system directory can leave the device unbootable
+// so this is always done there.
+func (u *upload) isAtomic(remotePath string) bool {
+	return u.o.atomic || u.o.keepBackup || strings.HasPrefix(remotePath, SysDir+"/")
+}
+
+// uploadAtomic uploads content to a temporary file next to remotePath, checks
+// that it arrived completely and only then replaces remotePath with it
+func (u *upload) uploadAtomic(ctx context.Context, remotePath string, content []byte) error {
+	tmpPath := remotePath + uploadTempSuffix
+	if _, err := u.o.Rfm.Upload(ctx, tmpPath, bytes.NewReader(content)); err != nil {
+
+		// ctx might be cancelled already but the leftover should still go away
+		u.o.Rfm.Delete(context.Background(), tmpPath)
+		return err
+	}
+	fi, err := u.o.Rfm.Fileinfo(ctx, tmpPath)
+	if err != nil {
+		u.o.Rfm.Delete(context.Background(), tmpPath)
+		return err
+	}
+	if fi.Size != uint64(len(content)) {
+		u.o.Rfm.Delete(context.Background(), tmpPath)
+		return fmt.Errorf("Uploaded %s has %d bytes instead of %d. Leaving %s untouched", tmpPath, fi.Size, len(content), remotePath)
+	}
+
+	// Once the new version is complete do not leave the device without the file
+	// because of a cancellation in between
+	ctx = context.Background()
+
+	// Move does not overwrite existing files so get the old version out of the way.
+	// It is kept until the new version is in place.
+	oldPath := ""
+	if _, err = u.o.Rfm.Fileinfo(ctx, remotePath); err == nil {
+		oldPath = remotePath + uploadOldSuffix
+		if u.o.keepBackup {
+			oldPath = remotePath + backupSuffix
+		}
+		if _, err = u.o.Rfm.Fileinfo(ctx, oldPath); err == nil {
+			if err = u.o.Rfm.Delete(ctx, oldPath); err != nil {
+				return err
+			}
+		}
+		if u.o.verbose && u.o.keepBackup {
+			log.Println("  Keeping previous version as", oldPath)
+		}
+		if err = u.o.Rfm.Move(ctx, remotePath, oldPath); err != nil {
+			return err
+		}
+	} else if err != librfm.ErrFileNotFound {
+		return err
+	}
+	if err = u.o.Rfm.Move(ctx, tmpPath, remotePath); err != nil {
+		if oldPath == "" {
+			return err
+		}
+		if restoreErr := u.o.Rfm.Move(ctx, oldPath, remotePath); restoreErr != nil {
+			return fmt.Errorf("Unable to replace %s: %s. The previous version is at %s and the new one at %s", remotePath, err, oldPath, tmpPath)
+		}
+		u.o.Rfm.Delete(ctx, tmpPath)
+		return err
+	}
+	if oldPath != "" && !u.o.keepBackup {
+		return u.o.Rfm.Delete(ctx, oldPath)
+	}
+	return nil
+}
+
+// checkFreeSpace makes sure the files will fit onto the volume of remotePath
+func (u *upload) checkFreeSpace(ctx context.Context, remotePath string, files []uploadFile) error {
+	var needed uint64
+	for _, f := range files {
+		needed += f.size
+	}
+	if needed == 0 {
+		return nil
+	}
+	free, err := remoteFreeSpace(ctx, u.o.Machine, remotePath)
+	if err == librfm.ErrDriveNotMounted {
+		return err
+	}
+	if err != nil {
+		log.Println("Unable to determine free space, uploading anyway:", err)
+		return nil
+	}
+	if u.o.verbose {
+		log.Printf("Uploading %s with %s free on %d:/", humanSize(needed), humanSize(free), rfm.RemoteVolume(remotePath))
+	}
+	if needed > free {
+		return fmt.Errorf("Not enough space on %d:/: %s needed but only %s free. Use -force to upload anyway",
+			rfm.RemoteVolume(remotePath), humanSize(needed), humanSize(free))
+	}
+	return nil
+}
+
+// collect gathers all files below localPath that are not excluded
+func (u *upload) collect(localPath, remotePath string) ([]uploadFile, error) {
+	files := make([]uploadFile, 0)
+	err := filepath.Walk(localPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if u.excluded(localPath, path, info.IsDir()) {
 			if info.IsDir() {
 				if u.o.verbose {
 					log.Println("Skipping directory", path)
@@ -99,20 +310,54 @@ func (u *upload) Upload(ctx context.Context, localPath, remotePath string) error
 			return nil
 		}
 
-		lp := strings.TrimPrefix(path, u.o.localPath)
-		if lp == "" {
-			lp = info.Name()
+		f, err := u.newUploadFile(path, u.remotePathOf(localPath, remotePath, path), info.Size())
+		if err != nil {
+			return err
 		}
-		rp := rfm.CleanRemotePath(fmt.Sprintf("%s/%s", remotePath, lp))
+		files = append(files, f)
+		return nil
+	})
+	return files, err
+}
 
-		fileContent, err := os.ReadFile(path)
+// excluded checks whether path inside the uploaded localPath is to be skipped
+func (u *upload) excluded(localPath, path string, isDir bool) bool {
+
+	// Patterns are matched relative to the uploaded directory
+	rel := filepath.ToSlash(strings.TrimPrefix(path, localPath))
+	if rel == "" && !isDir {
+		rel = filepath.Base(path)
+	}
+	return strings.TrimPrefix(rel, "/") == rfm.IgnoreFileName || u.o.excls.Excluded(rel, isDir)
+}
+
+// remotePathOf maps path inside the uploaded localPath to its location below remotePath
+func (u *upload) remotePathOf(localPath, remotePath, path string) string {
+	lp := strings.TrimPrefix(path, localPath)
+	if lp == "" {
+		lp = filepath.Base(path)
+	}
+	return rfm.CleanRemotePath(fmt.Sprintf("%s/%s", remotePath, filepath.ToSlash(lp)))
+}
+
+// newUploadFile creates the uploadFile for a local file. Templates are
+// rendered right away so errors show before anything is uploaded.
+func (u *upload) newUploadFile(path, remotePath string, size int64) (uploadFile, error) {
+	f := uploadFile{
+		localPath:  path,
+		remotePath: remotePath,
+		size:       uint64(size),
+	}
+	if isTemplate(path) {
+		content, err := os.ReadFile(path)
 		if err != nil {
-			return err
+			return f, err
 		}
-		if u.o.verbose {
-			log.Printf("Uploading %s to %s", path, rp)
+		if f.content, err = u.o.renderTemplate(path, content); err != nil {
+			return f, err
 		}
-		_, err = u.o.Rfm.Upload(ctx, rp, bytes.NewReader(fileContent))
-		return err
-	})
+		f.remotePath = strings.TrimSuffix(f.remotePath, templateSuffix)
+		f.size = uint64(len(f.content))
+	}
+	return f, nil
 }
@@ -0,0 +1,213 @@
+package commands
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/wilriker/librfm/v2"
+	"github.com/wilriker/rfm"
+)
+
+// VerifyOptions holds the specific parameters for verify
+type VerifyOptions struct {
+	*BaseOptions
+	path   string
+	remote bool
+}
+
+// Check checks all parameters for valid values
+func (v *VerifyOptions) Check() error {
+	if v.path == "" {
+		return errors.New("<local/backup> is mandatory")
+	}
+	v.path = rfm.GetAbsPath(v.path)
+
+	// Connection parameters are only needed to compare against the device
+	if v.remote {
+		return v.checkRemote()
+	}
+	return nil
+}
+
+// checkRemote selects the device the backup was made from unless another
+// device was given explicitly
+func (v *VerifyOptions) checkRemote() error {
+	m, _, err := NewVerify(v).openBackup(v.path)
+	if err != nil {
+		return err
+	}
+	fs := v.GetFlagSet()
+	deviceSeen := false
+	fs.Visit(func(f *flag.Flag) {
+		deviceSeen = deviceSeen || f.Name == "device"
+	})
+	if !deviceSeen && v.session == nil && m.Device != "" {
+		fs.Set("device", m.Device)
+	}
+	if err = v.BaseOptions.Check(); err != nil {
+		return err
+	}
+	if m.Device != "" && v.device != m.Device {
+		log.Printf("Warning: %s is a backup of %s but is compared to %s", v.path, m.Device, v.device)
+	}
+	return nil
+}
+
+// InitVerifyOptions initializes a VerifyOptions instance from command-line parameters
+func InitVerifyOptions(ctx context.Context, session *BaseOptions, arguments []string) (*VerifyOptions, error) {
+	v := VerifyOptions{BaseOptions: &BaseOptions{session: session}}
+
+	fs := v.GetFlagSet()
+	fs.BoolVar(&v.remote, "remote", false, "Download remote files and compare them to the manifest")
+	if err := fs.Parse(arguments); err != nil {
+		return nil, err
+	}
+
+	if fs.NArg() > 0 {
+		v.path = fs.Arg(0)
+	}
+
+	if err := v.Check(); err != nil {
+		return nil, err
+	}
+
+	if v.remote {
+		if err := v.Connect(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	return &v, nil
+}
+
+// DoVerify is a convenience function to run verify from command-line parameters
+func DoVerify(ctx context.Context, session *BaseOptions, arguments []string) error {
+	vo, err := InitVerifyOptions(ctx, session, arguments)
+	if err != nil {
+		return err
+	}
+	return NewVerify(vo).Verify(ctx, vo.path, vo.remote)
+}
+
+// verify implements the Verify interface
+type verify struct {
+	o *VerifyOptions
+}
+
+// NewVerify creates a new instance of the Verify interface
+func NewVerify(vo *VerifyOptions) *verify {
+	return &verify{
+		o: vo,
+	}
+}
+
+// Verify checks the files of a backup directory or archive against its manifest.
+// If remote is true the files are also downloaded from the device and compared
+// to the manifest.
+func (v *verify) Verify(ctx context.Context, path string, remote bool) error {
+	m, readFile, err := v.openBackup(path)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Verifying %d files in %s (backup of %s on %s from %s)", len(m.Files), path, m.Root, m.Device, m.Created.Format(librfm.TimeFormat))
+	failed := 0
+	for _, e := range m.Files {
+		content, err := readFile(e.Path)
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			log.Println("  Missing:   ", e.Path)
+			failed++
+		case err != nil:
+			return err
+		case uint64(len(content)) != e.Size || sha256Sum(content) != e.SHA256:
+			log.Println("  Corrupt:   ", e.Path)
+			failed++
+		default:
+			if v.o.verbose {
+				log.Println("  OK:        ", e.Path)
+			}
+		}
+
+		if !remote {
+			continue
+		}
+		ok, err := v.verifyRemote(ctx, m, e)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("Verification failed for %d of %d files", failed, len(m.Files))
+	}
+	log.Println("All files verified successfully")
+	return nil
+}
+
+// verifyRemote compares a remote file to its manifest entry
+func (v *verify) verifyRemote(ctx context.Context, m *manifest, e manifestEntry) (bool, error) {
+	remotePath := fmt.Sprintf("%s/%s", m.Root, e.Path)
+	if _, err := v.o.Rfm.Fileinfo(ctx, remotePath); err != nil {
+		if err == librfm.ErrFileNotFound {
+			log.Println("  Missing remote:", remotePath)
+			return false, nil
+		}
+		return false, err
+	}
+	body, _, err := v.o.Rfm.Download(ctx, remotePath)
+	if err != nil {
+		return false, err
+	}
+	if uint64(len(body)) != e.Size || sha256Sum(body) != e.SHA256 {
+		log.Println("  Changed remote:", remotePath)
+		return false, nil
+	}
+	if v.o.verbose {
+		log.Println("  OK remote: ", remotePath)
+	}
+	return true, nil
+}
+
+// openBackup reads the manifest of a backup directory or archive and returns
+// it together with a function to read files of the backup
+func (v *verify) openBackup(path string) (*manifest, func(string) ([]byte, error), error) {
+	if isArchive(path) {
+		files, err := readArchive(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		content, ok := files[manifestFileName]
+		if !ok {
+			return nil, nil, fmt.Errorf("No manifest found in %s", path)
+		}
+		m, err := unmarshalManifest(content)
+		if err != nil {
+			return nil, nil, err
+		}
+		return m, func(name string) ([]byte, error) {
+			content, ok := files[name]
+			if !ok {
+				return nil, fs.ErrNotExist
+			}
+			return content, nil
+		}, nil
+	}
+
+	m, err := readManifest(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return m, func(name string) ([]byte, error) {
+		return os.ReadFile(filepath.Join(path, filepath.FromSlash(name)))
+	}, nil
+}
@@ -0,0 +1,120 @@
+package commands
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// backupFiles are the files of the backups verified by the tests
+var backupFiles = map[string]string{
+	"config.g":      "M550 P\"printer\"",
+	"macros/home.g": "G28",
+}
+
+// writeBackupDir creates a backup directory of backupFiles with a manifest
+func writeBackupDir(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	m := newManifest(&BaseOptions{device: "printer"}, "0:/sys")
+	for name, content := range backupFiles {
+		fileName := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(fileName), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(fileName, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		m.add(name, time.Now(), []byte(content))
+	}
+	if err := m.write(dir); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// writeBackupArchive creates an archive of backupFiles with a manifest. The
+// files are replaced by the given ones, an empty content leaves a file out.
+func writeBackupArchive(t *testing.T, name string, replace map[string]string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	a, err := newArchiveWriter(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := newManifest(&BaseOptions{device: "printer"}, "0:/sys")
+	for name, content := range backupFiles {
+		m.add(name, time.Now(), []byte(content))
+		if r, ok := replace[name]; ok {
+			content = r
+		}
+		if content == "" {
+			continue
+		}
+		if err = a.addFile(name, time.Now(), []byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	content, err := m.marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = a.addFile(manifestFileName, time.Now(), content); err != nil {
+		t.Fatal(err)
+	}
+	if err = a.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestVerifyDirectory(t *testing.T) {
+	v := NewVerify(&VerifyOptions{BaseOptions: &BaseOptions{}})
+
+	dir := writeBackupDir(t)
+	if err := v.Verify(context.Background(), dir, false); err != nil {
+		t.Errorf("Verify() of intact backup = %v", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "config.g"), []byte("M550 P\"other\""), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(dir, "macros", "home.g")); err != nil {
+		t.Fatal(err)
+	}
+	err := v.Verify(context.Background(), dir, false)
+	if err == nil || err.Error() != "Verification failed for 2 of 2 files" {
+		t.Errorf("Verify() of damaged backup = %v", err)
+	}
+
+	if err = v.Verify(context.Background(), t.TempDir(), false); err == nil {
+		t.Error("Verify() succeeded without a manifest")
+	}
+}
+
+func TestVerifyArchive(t *testing.T) {
+	tests := []struct {
+		name    string
+		replace map[string]string
+		wantErr string
+	}{
+		{"intact", nil, ""},
+		{"missing", map[string]string{"macros/home.g": ""}, "Verification failed for 1 of 2 files"},
+		{"corrupt", map[string]string{"config.g": "M550 P\"printes\""}, "Verification failed for 1 of 2 files"},
+	}
+	v := NewVerify(&VerifyOptions{BaseOptions: &BaseOptions{}})
+	for _, ext := range []string{".zip", ".tar.gz"} {
+		for _, tt := range tests {
+			t.Run(strings.TrimPrefix(ext, ".")+"/"+tt.name, func(t *testing.T) {
+				path := writeBackupArchive(t, "backup"+ext, tt.replace)
+				err := v.Verify(context.Background(), path, false)
+				if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || err.Error() != tt.wantErr) {
+					t.Errorf("Verify() = %v, want %q", err, tt.wantErr)
+				}
+			})
+		}
+	}
+}
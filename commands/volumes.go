@@ -0,0 +1,277 @@
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/wilriker/librfm/v2"
+	"github.com/wilriker/rfm"
+)
+
+// volume is the object model representation of a storage volume
+type volume struct {
+	Path       string
+	Mounted    bool
+	Capacity   uint64
+	FreeSpace  uint64
+	Speed      uint64
+	FileSystem string
+}
+
+// fetchVolumes reads all volumes from the object model. The index of a volume
+// is its number.
+func fetchVolumes(ctx context.Context, m *rfm.Machine) ([]volume, error) {
+	result, err := m.Model(ctx, "volumes", rfm.ModelFlagsDefault)
+	if err != nil {
+		return nil, err
+	}
+	var volumes []volume
+	if err = json.Unmarshal(result, &volumes); err != nil {
+		return nil, err
+	}
+	return volumes, nil
+}
+
+// remoteFreeSpace returns the free space of the volume the given remote path is on.
+// It uses the object model and falls back to M39 for older firmware versions.
+func remoteFreeSpace(ctx context.Context, m *rfm.Machine, remotePath string) (uint64, error) {
+	vol := rfm.RemoteVolume(remotePath)
+	vols, err := fetchVolumes(ctx, m)
+	if err == nil && vol < uint64(len(vols)) {
+		if !vols[vol].Mounted {
+			return 0, librfm.ErrDriveNotMounted
+		}
+		return vols[vol].FreeSpace, nil
+	}
+
+	reply, err := m.Gcode(ctx, fmt.Sprintf("M39 P%d S2", vol), defaultReplyTimeout)
+	if err != nil {
+		return 0, err
+	}
+	var info struct {
+		SDinfo struct {
+			Present uint64
+			Free    uint64
+		}
+	}
+	if err = json.Unmarshal([]byte(reply), &info); err != nil {
+		return 0, fmt.Errorf("Unable to determine free space of %d:/", vol)
+	}
+	if info.SDinfo.Present == 0 {
+		return 0, librfm.ErrDriveNotMounted
+	}
+	return info.SDinfo.Free, nil
+}
+
+// humanSize formats a size for use within a message
+func humanSize(size uint64) string {
+	return strings.TrimSpace(rfm.HumanReadableSize(size))
+}
+
+// VolumesOptions holds the specific parameters for volumes
+type VolumesOptions struct {
+	*BaseOptions
+	humanReadable bool
+}
+
+// Check checks all parameters for valid values
+func (v *VolumesOptions) Check() error {
+	return v.BaseOptions.Check()
+}
+
+// InitVolumesOptions initializes a VolumesOptions instance from command-line parameters
+func InitVolumesOptions(ctx context.Context, session *BaseOptions, arguments []string) (*VolumesOptions, error) {
+	v := VolumesOptions{BaseOptions: &BaseOptions{session: session}}
+
+	fs := v.GetFlagSet()
+	fs.BoolVar(&v.humanReadable, "h", false, "List sizes in human readable units")
+	if err := fs.Parse(arguments); err != nil {
+		return nil, err
+	}
+
+	if err := v.Check(); err != nil {
+		return nil, err
+	}
+
+	if err := v.Connect(ctx); err != nil {
+		return nil, err
+	}
+
+	return &v, nil
+}
+
+// DoVolumes is a convenience function to run volumes from command-line parameters
+func DoVolumes(ctx context.Context, session *BaseOptions, arguments []string) error {
+	vo, err := InitVolumesOptions(ctx, session, arguments)
+	if err != nil {
+		return err
+	}
+	return NewVolumes(vo).Volumes(ctx)
+}
+
+// volumes implements the Volumes interface
+type volumes struct {
+	o *VolumesOptions
+}
+
+// NewVolumes creates a new instance of the Volumes interface
+func NewVolumes(vo *VolumesOptions) *volumes {
+	return &volumes{
+		o: vo,
+	}
+}
+
+// Volumes lists all volumes of the device with their mount state,
+// capacity, free space and speed
+func (v *volumes) Volumes(ctx context.Context) error {
+	vols, err := fetchVolumes(ctx, v.o.Machine)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', tabwriter.AlignRight)
+
+	// Older firmware versions do not report the filesystem
+	withFS := false
+	for _, vol := range vols {
+		withFS = withFS || vol.FileSystem != ""
+	}
+	header := "volume\tmounted\tcapacity\tfree\tspeed\t"
+	if withFS {
+		header += "filesystem\t"
+	}
+	fmt.Fprintln(w, header)
+	for i, vol := range vols {
+		if !vol.Mounted {
+			fmt.Fprintf(w, "%d:/\tno\t-\t-\t-\t", i)
+		} else {
+			fmt.Fprintf(w, "%d:/\tyes\t%s\t%s\t%s\t", i, v.getSize(vol.Capacity), v.getSize(vol.FreeSpace), v.getSpeed(vol.Speed))
+		}
+		if withFS {
+			fmt.Fprintf(w, "%s\t", v.getFileSystem(vol))
+		}
+		fmt.Fprintln(w)
+	}
+	return w.Flush()
+}
+
+func (v *volumes) getSize(size uint64) string {
+	if v.o.humanReadable {
+		return rfm.HumanReadableSize(size)
+	}
+	return fmt.Sprintf("%d", size)
+}
+
+func (v *volumes) getFileSystem(vol volume) string {
+	if !vol.Mounted || vol.FileSystem == "" {
+		return "-"
+	}
+	return vol.FileSystem
+}
+
+func (v *volumes) getSpeed(speed uint64) string {
+	if speed == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.1fMHz", float64(speed)/1e6)
+}
+
+// MountOptions holds the specific parameters for mount and unmount
+type MountOptions struct {
+	*BaseOptions
+	volume uint64
+}
+
+// Check checks all parameters for valid values
+func (m *MountOptions) Check() error {
+	return m.BaseOptions.Check()
+}
+
+// InitMountOptions initializes a MountOptions instance from command-line parameters
+func InitMountOptions(ctx context.Context, session *BaseOptions, arguments []string) (*MountOptions, error) {
+	m := MountOptions{BaseOptions: &BaseOptions{session: session}}
+
+	fs := m.GetFlagSet()
+	if err := fs.Parse(arguments); err != nil {
+		return nil, err
+	}
+
+	if fs.NArg() == 0 {
+		return nil, errors.New("<volume> is mandatory")
+	}
+	vol, err := strconv.ParseUint(fs.Arg(0), 10, 8)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid volume: %s", fs.Arg(0))
+	}
+	m.volume = vol
+
+	if err := m.Check(); err != nil {
+		return nil, err
+	}
+
+	if err := m.Connect(ctx); err != nil {
+		return nil, err
+	}
+
+	return &m, nil
+}
+
+// DoMount is a convenience function to run mount from command-line parameters
+func DoMount(ctx context.Context, session *BaseOptions, arguments []string) error {
+	mo, err := InitMountOptions(ctx, session, arguments)
+	if err != nil {
+		return err
+	}
+	return NewMount(mo).Mount(ctx, mo.volume)
+}
+
+// DoUnmount is a convenience function to run unmount from command-line parameters
+func DoUnmount(ctx context.Context, session *BaseOptions, arguments []string) error {
+	mo, err := InitMountOptions(ctx, session, arguments)
+	if err != nil {
+		return err
+	}
+	return NewMount(mo).Unmount(ctx, mo.volume)
+}
+
+// mount implements the Mount interface
+type mount struct {
+	o *MountOptions
+}
+
+// NewMount creates a new instance of the Mount interface
+func NewMount(mo *MountOptions) *mount {
+	return &mount{
+		o: mo,
+	}
+}
+
+// Mount mounts the given volume (M21)
+func (m *mount) Mount(ctx context.Context, vol uint64) error {
+	return m.send(ctx, fmt.Sprintf("M21 P%d", vol))
+}
+
+// Unmount unmounts the given volume (M22)
+func (m *mount) Unmount(ctx context.Context, vol uint64) error {
+	return m.send(ctx, fmt.Sprintf("M22 P%d", vol))
+}
+
+func (m *mount) send(ctx context.Context, code string) error {
+	if m.o.verbose {
+		log.Println("Sending", code)
+	}
+	reply, err := m.o.Machine.Gcode(ctx, code, defaultReplyTimeout)
+	if err != nil {
+		return err
+	}
+	if reply != "" {
+		fmt.Println(reply)
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+package commands
+
+import (
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/wilriker/librfm/v2"
+	"github.com/wilriker/rfm"
+)
+
+const (
+	// watchDebounce is how long to wait for further changes before syncing
+	watchDebounce = 500 * time.Millisecond
+)
+
+// Watch uploads localPath to remotePath and then keeps watching localPath
+// for changes. Modified and new files are uploaded, new directories are
+// created and removed files and directories are deleted on the device until
+// ctx is cancelled.
+func (u *upload) Watch(ctx context.Context, localPath, remotePath string) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	// Watch first so nothing changed during the initial sync gets lost
+	if err = u.watchDirs(watcher, localPath, localPath); err != nil {
+		return err
+	}
+	if err = u.Upload(ctx, localPath, remotePath); err != nil {
+		return err
+	}
+	log.Println("Watching", localPath, "for changes")
+
+	pending := make(map[string]bool)
+	debounce := time.NewTimer(watchDebounce)
+	debounce.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-watcher.Errors:
+			log.Println("Error watching files:", err)
+		case event := <-watcher.Events:
+			if event.Op == fsnotify.Chmod {
+				continue
+			}
+
+			// Wait for the editor to finish saving
+			pending[event.Name] = true
+			debounce.Reset(watchDebounce)
+		case <-debounce.C:
+			for p := range pending {
+				if err := u.sync(ctx, watcher, localPath, remotePath, p); err != nil {
+					if ctx.Err() != nil {
+						return nil
+					}
+					log.Println(err)
+				}
+			}
+			pending = make(map[string]bool)
+		}
+	}
+}
+
+// watchDirs adds dir and all its subdirectories that are not excluded to watcher
+func (u *upload) watchDirs(watcher *fsnotify.Watcher, localPath, dir string) error {
+	return filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		if u.excluded(localPath, p, true) {
+			return filepath.SkipDir
+		}
+		return watcher.Add(p)
+	})
+}
+
+// sync brings the remote copy of a single changed local path up to date
+func (u *upload) sync(ctx context.Context, watcher *fsnotify.Watcher, localPath, remotePath, p string) error {
+	rp := u.remotePathOf(localPath, remotePath, p)
+	info, err := os.Stat(p)
+	if os.IsNotExist(err) {
+
+		// Never mirror the removal of the watched directory itself
+		if p == localPath {
+			return nil
+		}
+
+		// We cannot know anymore what it was so it has to pass both checks
+		if u.excluded(localPath, p, false) || u.excluded(localPath, p, true) {
+			return nil
+		}
+		return u.remove(ctx, strings.TrimSuffix(rp, templateSuffix))
+	}
+	if err != nil {
+		return err
+	}
+	if u.excluded(localPath, p, info.IsDir()) {
+		return nil
+	}
+
+	if !info.IsDir() {
+		f, err := u.newUploadFile(p, rp, info.Size())
+		if err != nil {
+			return err
+		}
+		if err = u.o.checkProtected(f.remotePath, u.o.forceProtected); err != nil {
+			return err
+		}
+		log.Println("Uploading", f.remotePath)
+		return u.transfer(ctx, f)
+	}
+
+	// New directories might already contain files, e.g. if moved here
+	if err = u.watchDirs(watcher, localPath, p); err != nil {
+		return err
+	}
+	return filepath.Walk(p, func(sp string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if u.excluded(localPath, sp, info.IsDir()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() {
+			dir := u.remotePathOf(localPath, remotePath, sp)
+			if u.o.verbose {
+				log.Println("Creating directory", dir)
+			}
+			return mkdirAll(ctx, u.o.Rfm, dir)
+		}
+		return u.sync(ctx, watcher, localPath, remotePath, sp)
+	})
+}
+
+// remove deletes a remote file or directory if it exists
+func (u *upload) remove(ctx context.Context, rp string) error {
+	r := NewRm(&RmOptions{
+		BaseOptions:    u.o.BaseOptions,
+		trash:          rfm.GetDevice(u.o.device).TrashEnabled(),
+		assumeYes:      true,
+		forceProtected: u.o.forceProtected,
+	})
+	if _, err := u.o.Rfm.Fileinfo(ctx, rp); err == nil {
+		log.Println("Deleting", rp)
+		return r.Rm(ctx, rp, false)
+	}
+	_, err := u.o.Rfm.Filelist(ctx, rp, false)
+	if err == librfm.ErrDirectoryNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	log.Println("Deleting directory", rp)
+	return r.Rm(ctx, rp, true)
+}
@@ -0,0 +1,403 @@
+package commands
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/wilriker/librfm/v2"
+	"github.com/wilriker/rfm"
+	"golang.org/x/net/webdav"
+)
+
+const (
+	defaultWebdavListen = "127.0.0.1:8080"
+	defaultContentType  = "application/octet-stream"
+)
+
+// remoteFileInfo implements os.FileInfo for a remote file or directory
+type remoteFileInfo struct {
+	f librfm.File
+}
+
+func (r remoteFileInfo) Name() string       { return r.f.Name }
+func (r remoteFileInfo) Size() int64        { return int64(r.f.Size) }
+func (r remoteFileInfo) ModTime() time.Time { return r.f.Date() }
+func (r remoteFileInfo) IsDir() bool        { return r.f.IsDir() }
+func (r remoteFileInfo) Sys() interface{}   { return nil }
+
+func (r remoteFileInfo) Mode() fs.FileMode {
+	if r.f.IsDir() {
+		return fs.ModeDir | 0755
+	}
+	return 0644
+}
+
+// ContentType implements webdav.ContentTyper. It guesses the type from the
+// extension. Otherwise listing a directory would download all files in it to
+// sniff their type.
+func (r remoteFileInfo) ContentType(ctx context.Context) (string, error) {
+	if t := mime.TypeByExtension(path.Ext(r.f.Name)); t != "" {
+		return t, nil
+	}
+	return defaultContentType, nil
+}
+
+// davFS implements webdav.FileSystem on top of a remoteFS. The first element
+// of each path is the number of a volume.
+type davFS struct {
+	fs *remoteFS
+}
+
+func (d *davFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	remotePath, err := remotePathOf(name)
+	if err != nil {
+		return err
+	}
+	if remotePath == "" || isVolumeRoot(remotePath) {
+		return fs.ErrExist
+	}
+	return d.fs.mkdir(ctx, remotePath)
+}
+
+func (d *davFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	remotePath, err := remotePathOf(name)
+	if err != nil {
+		return nil, err
+	}
+	writable := flag&(os.O_WRONLY|os.O_RDWR) != 0
+	if remotePath == "" {
+		if writable {
+			return nil, fs.ErrPermission
+		}
+		return &davFile{fs: d.fs, ctx: ctx, info: remoteFileInfo{librfm.File{Type: remoteTypeDir, Name: "/"}}}, nil
+	}
+
+	file, err := d.fs.stat(ctx, remotePath)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	if file == nil {
+		if flag&os.O_CREATE == 0 {
+			return nil, fs.ErrNotExist
+		}
+
+		// The parent has to exist already
+		if parent, err := d.fs.stat(ctx, path.Dir(remotePath)); err != nil || !parent.IsDir() {
+			return nil, fs.ErrNotExist
+		}
+		return &davFile{
+			fs:         d.fs,
+			ctx:        ctx,
+			remotePath: remotePath,
+			info:       remoteFileInfo{librfm.File{Name: path.Base(remotePath)}},
+			writable:   true,
+			dirty:      true,
+			content:    make([]byte, 0),
+		}, nil
+	}
+	if flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL {
+		return nil, fs.ErrExist
+	}
+	if file.IsDir() && writable {
+		return nil, fs.ErrPermission
+	}
+	df := &davFile{fs: d.fs, ctx: ctx, remotePath: remotePath, info: remoteFileInfo{*file}, writable: writable}
+	if flag&os.O_TRUNC != 0 && writable {
+		df.content = make([]byte, 0)
+		df.dirty = true
+	}
+	return df, nil
+}
+
+func (d *davFS) RemoveAll(ctx context.Context, name string) error {
+	remotePath, err := remotePathOf(name)
+	if err != nil {
+		return err
+	}
+	if remotePath == "" {
+		return fs.ErrPermission
+	}
+	return d.fs.remove(ctx, remotePath)
+}
+
+func (d *davFS) Rename(ctx context.Context, oldName, newName string) error {
+	oldPath, err := remotePathOf(oldName)
+	if err != nil {
+		return err
+	}
+	newPath, err := remotePathOf(newName)
+	if err != nil {
+		return err
+	}
+	if oldPath == "" || newPath == "" {
+		return fs.ErrPermission
+	}
+
+	// The handler already removed an existing target if it was allowed to
+	return d.fs.rename(ctx, oldPath, newPath, false)
+}
+
+func (d *davFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	remotePath, err := remotePathOf(name)
+	if err != nil {
+		return nil, err
+	}
+	if remotePath == "" {
+		return remoteFileInfo{librfm.File{Type: remoteTypeDir, Name: "/"}}, nil
+	}
+	file, err := d.fs.stat(ctx, remotePath)
+	if err != nil {
+		return nil, err
+	}
+	return remoteFileInfo{*file}, nil
+}
+
+// davFile is an open remote file or directory. Files are read completely on
+// first access and written back on Close if they have been changed.
+type davFile struct {
+	fs         *remoteFS
+	ctx        context.Context
+	remotePath string
+	info       remoteFileInfo
+
+	// Directories
+	entries []os.FileInfo
+	listed  bool
+
+	// Files. A shared content belongs to the cache and is copied before it
+	// is changed.
+	content  []byte
+	shared   bool
+	offset   int64
+	writable bool
+	dirty    bool
+}
+
+// load fetches the content of the file if that has not happened yet
+func (d *davFile) load() error {
+	if d.content != nil {
+		return nil
+	}
+	if d.info.IsDir() {
+		return fs.ErrInvalid
+	}
+	content, err := d.fs.read(d.ctx, d.remotePath)
+	if err != nil {
+		return err
+	}
+	d.content = content
+	d.shared = true
+	return nil
+}
+
+func (d *davFile) Read(p []byte) (int, error) {
+	if err := d.load(); err != nil {
+		return 0, err
+	}
+	if d.offset >= int64(len(d.content)) {
+		return 0, io.EOF
+	}
+	n := copy(p, d.content[d.offset:])
+	d.offset += int64(n)
+	return n, nil
+}
+
+func (d *davFile) Write(p []byte) (int, error) {
+	if !d.writable {
+		return 0, fs.ErrPermission
+	}
+	if err := d.load(); err != nil {
+		return 0, err
+	}
+	if d.shared {
+		d.content = append(make([]byte, 0, len(d.content)), d.content...)
+		d.shared = false
+	}
+	if end := d.offset + int64(len(p)); end > int64(len(d.content)) {
+		d.content = append(d.content, make([]byte, end-int64(len(d.content)))...)
+	}
+	n := copy(d.content[d.offset:], p)
+	d.offset += int64(n)
+	d.dirty = true
+	return n, nil
+}
+
+func (d *davFile) Seek(offset int64, whence int) (int64, error) {
+	var base int64
+	switch whence {
+	case io.SeekCurrent:
+		base = d.offset
+	case io.SeekEnd:
+		if d.content != nil {
+			base = int64(len(d.content))
+		} else {
+			base = d.info.Size()
+		}
+	}
+	if base+offset < 0 {
+		return 0, fs.ErrInvalid
+	}
+	d.offset = base + offset
+	return d.offset, nil
+}
+
+func (d *davFile) Readdir(count int) ([]fs.FileInfo, error) {
+	if !d.info.IsDir() {
+		return nil, fs.ErrInvalid
+	}
+	if !d.listed {
+		if err := d.list(); err != nil {
+			return nil, err
+		}
+		d.listed = true
+	}
+	if count <= 0 {
+		entries := d.entries
+		d.entries = nil
+		return entries, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	if count > len(d.entries) {
+		count = len(d.entries)
+	}
+	entries := d.entries[:count]
+	d.entries = d.entries[count:]
+	return entries, nil
+}
+
+// list reads the directory entries. The root contains the mounted volumes.
+func (d *davFile) list() error {
+	if d.remotePath == "" {
+		vols, err := d.fs.volumes(d.ctx)
+		if err != nil {
+			return err
+		}
+		for _, v := range vols {
+			d.entries = append(d.entries, remoteFileInfo{librfm.File{Type: remoteTypeDir, Name: strconv.FormatUint(v, 10)}})
+		}
+		return nil
+	}
+	files, err := d.fs.list(d.ctx, d.remotePath)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		d.entries = append(d.entries, remoteFileInfo{f})
+	}
+	return nil
+}
+
+func (d *davFile) Stat() (fs.FileInfo, error) {
+	if d.dirty {
+		info := d.info
+		info.f.Size = uint64(len(d.content))
+		return info, nil
+	}
+	return d.info, nil
+}
+
+// Close uploads the file if it has been changed
+func (d *davFile) Close() error {
+	if !d.dirty {
+		return nil
+	}
+	d.dirty = false
+	return d.fs.write(d.ctx, d.remotePath, d.content)
+}
+
+// ServeWebdavOptions holds the specific parameters for serve-webdav
+type ServeWebdavOptions struct {
+	*BaseOptions
+	listen    string
+	cacheTime time.Duration
+}
+
+// Check checks all parameters for valid values
+func (s *ServeWebdavOptions) Check() error {
+	if err := s.BaseOptions.Check(); err != nil {
+		return err
+	}
+
+	if s.cacheTime < 0 {
+		return fmt.Errorf("Invalid value for -cache: %s", s.cacheTime)
+	}
+	return nil
+}
+
+// InitServeWebdavOptions initializes a ServeWebdavOptions instance from command-line parameters
+func InitServeWebdavOptions(ctx context.Context, session *BaseOptions, arguments []string) (*ServeWebdavOptions, error) {
+	s := ServeWebdavOptions{BaseOptions: &BaseOptions{session: session}}
+
+	fs := s.GetFlagSet()
+	fs.StringVar(&s.listen, "listen", defaultWebdavListen, "Address to serve WebDAV on")
+	fs.DurationVar(&s.cacheTime, "cache", defaultCacheTime, "Reuse directory listings for this long")
+	if err := fs.Parse(arguments); err != nil {
+		return nil, err
+	}
+
+	if err := s.Check(); err != nil {
+		return nil, err
+	}
+
+	if err := s.Connect(ctx); err != nil {
+		return nil, err
+	}
+
+	return &s, nil
+}
+
+// DoServeWebdav is a convenience function to run serve-webdav from command-line parameters
+func DoServeWebdav(ctx context.Context, session *BaseOptions, arguments []string) error {
+	so, err := InitServeWebdavOptions(ctx, session, arguments)
+	if err != nil {
+		return err
+	}
+	return NewServeWebdav(so).Serve(ctx, so.listen)
+}
+
+// serveWebdav implements the ServeWebdav interface
+type serveWebdav struct {
+	o *ServeWebdavOptions
+}
+
+// NewServeWebdav creates a new instance of the ServeWebdav interface
+func NewServeWebdav(so *ServeWebdavOptions) *serveWebdav {
+	return &serveWebdav{
+		o: so,
+	}
+}
+
+// Serve exposes the volumes of the device over WebDAV on listen until ctx is
+// cancelled
+func (s *serveWebdav) Serve(ctx context.Context, listen string) error {
+	handler := &webdav.Handler{
+		FileSystem: &davFS{fs: newRemoteFS(s.o.BaseOptions, s.o.cacheTime, rfm.GetDevice(s.o.device).TrashEnabled())},
+		LockSystem: webdav.NewMemLS(),
+		Logger: func(r *http.Request, err error) {
+			if err != nil {
+				log.Printf("%s %s: %s", r.Method, r.URL.Path, err)
+			} else if s.o.verbose {
+				log.Println(r.Method, r.URL.Path)
+			}
+		},
+	}
+	addr, err := startServer(ctx, listen, handler)
+	if err != nil {
+		return err
+	}
+	log.Printf("Serving %s over WebDAV on http://%s/", s.o.device, addr)
+	<-ctx.Done()
+	return nil
+}
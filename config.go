@@ -4,6 +4,8 @@ import (
 	"path/filepath"
 
 	"os"
+	"reflect"
+	"sort"
 
 	"sync"
 
@@ -12,8 +14,14 @@ import (
 )
 
 const (
-	// ConfigFileName is the name of config file
+	// ConfigFileName is the name of the legacy config file in the user's home directory
 	ConfigFileName = "rfm.toml"
+	// XDGConfigFileName is the name of the config file inside the XDG config directory
+	XDGConfigFileName = "config.toml"
+	// ProjectConfigFileName is the name of project-local config files
+	ProjectConfigFileName = ".rfm.toml"
+	// ConfigEnv is the environment variable that can point to an explicit config file
+	ConfigEnv = "RFM_CONFIG"
 	// DefaultDevice is the name of the default device
 	DefaultDevice = "default"
 	// DefaultPort is to be used if the user did not pass a port
@@ -22,28 +30,100 @@ const (
 	DefaultPassword = "reprap"
 )
 
-type device struct {
-	Domain   string
-	Port     uint64
-	Password string
-	Excludes map[string]Excludes
+// Device holds the settings for a single device
+type Device struct {
+	Domain      string
+	Port        uint64
+	Password    string
+	RemotePath  string                 `toml:"remote_path,omitempty"`
+	Trash       *bool                  `toml:"trash,omitempty"`
+	Protected   []string               `toml:"protected,omitempty"`
+	Vars        map[string]interface{} `toml:"vars,omitempty"`
+	BackupDir   string                 `toml:"backup_dir,omitempty"`
+	BackupEvery string                 `toml:"backup_every,omitempty"`
+	Excludes    map[string]Excludes
+}
+
+// merge copies all values set in other over the values of d
+func (d *Device) merge(other Device) {
+	if other.Domain != "" {
+		d.Domain = other.Domain
+	}
+	if other.Port != 0 {
+		d.Port = other.Port
+	}
+	if other.Password != "" {
+		d.Password = other.Password
+	}
+	if other.RemotePath != "" {
+		d.RemotePath = other.RemotePath
+	}
+	if other.Trash != nil {
+		d.Trash = other.Trash
+	}
+	if len(other.Protected) > 0 {
+		d.Protected = other.Protected
+	}
+	if other.BackupDir != "" {
+		d.BackupDir = other.BackupDir
+	}
+	if other.BackupEvery != "" {
+		d.BackupEvery = other.BackupEvery
+	}
+	if len(other.Vars) > 0 && d.Vars == nil {
+		d.Vars = make(map[string]interface{})
+	}
+	for k, v := range other.Vars {
+		d.Vars[k] = v
+	}
+	if len(other.Excludes) > 0 && d.Excludes == nil {
+		d.Excludes = make(map[string]Excludes)
+	}
+	for k, v := range other.Excludes {
+		d.Excludes[k] = v
+	}
+}
+
+// TrashEnabled checks whether deleted paths of the device go to the trash
+func (d *Device) TrashEnabled() bool {
+	return d.Trash != nil && *d.Trash
 }
 
 // Config holds the configuration sets
 type Config struct {
+	// Device is the device to use if none is selected explicitly
+	Device string `toml:"device,omitempty"`
 	// Devices is only exported for marshalling/unmarshalling. Use GetDevice(string) instead
-	Devices map[string]device
+	Devices map[string]Device
+}
+
+// merge applies all settings of other on top of c
+func (c *Config) merge(other *Config) {
+	if other.Device != "" {
+		c.Device = other.Device
+	}
+	for name, od := range other.Devices {
+		d := c.Devices[name]
+		d.merge(od)
+		c.Devices[name] = d
+	}
 }
 
-var conf = &Config{}
+// conf is the merged view of all config files, userConf the contents
+// of the one config file that will be written by SaveConfigs
+var conf = &Config{Devices: make(map[string]Device)}
+var userConf = &Config{Devices: make(map[string]Device)}
+var userConfPath string
 var mu sync.Mutex
 var load sync.Once
 
-// GetDevice returns a pointer to the config for the given device name.
+// GetDevice returns a copy of the merged config for the given device name.
 // Even though Config.Devices is exported this is the preferred way
-// to fetch a device
-func GetDevice(deviceName string) *device {
+// to fetch a device. Use UpdateDevice to persist changes.
+func GetDevice(deviceName string) *Device {
 	loadConfigs()
+	mu.Lock()
+	defer mu.Unlock()
 	d, ok := conf.Devices[deviceName]
 	if !ok {
 		return nil
@@ -54,42 +134,157 @@ func GetDevice(deviceName string) *device {
 	return &d
 }
 
-// LoadConfigs tries to read the config file and returns
-// either its contents or an empty config and in case of
-// an error also an error instance
+// DeviceNames returns the names of all configured devices in alphabetical order
+func DeviceNames() []string {
+	loadConfigs()
+	mu.Lock()
+	defer mu.Unlock()
+	names := make([]string, 0, len(conf.Devices))
+	for name := range conf.Devices {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// GetDefaultDevice returns the name of the device to use if none
+// was given explicitly
+func GetDefaultDevice() string {
+	loadConfigs()
+	mu.Lock()
+	defer mu.Unlock()
+	if conf.Device != "" {
+		return conf.Device
+	}
+	return DefaultDevice
+}
+
+// ConfigPath returns the path of the config file SaveConfigs writes to
+func ConfigPath() string {
+	loadConfigs()
+	return userConfPath
+}
+
+// ConfigDir returns the XDG config directory of rfm
+func ConfigDir() (string, error) {
+	if x := os.Getenv("XDG_CONFIG_HOME"); x != "" {
+		return filepath.Join(x, "rfm"), nil
+	}
+	h, err := homedir.Dir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(h, ".config", "rfm"), nil
+}
+
+// userConfigPaths returns the paths of all user-level config files in order of
+// precedence (lowest first) as well as the path config changes are written to.
+// New configs are created in the XDG directory, an existing legacy file in the
+// user's home directory keeps being used.
+func userConfigPaths() ([]string, string, error) {
+	h, err := homedir.Dir()
+	if err != nil {
+		return nil, "", err
+	}
+	legacy := filepath.Join(h, ConfigFileName)
+	d, err := ConfigDir()
+	if err != nil {
+		return nil, "", err
+	}
+	xdg := filepath.Join(d, XDGConfigFileName)
+	paths := []string{legacy, xdg}
+
+	savePath := xdg
+	if _, err := os.Stat(xdg); os.IsNotExist(err) {
+		if _, err := os.Stat(legacy); err == nil {
+			savePath = legacy
+		}
+	}
+	if e := os.Getenv(ConfigEnv); e != "" {
+		paths = append(paths, e)
+		savePath = e
+	}
+	return paths, savePath, nil
+}
+
+// projectConfigPaths returns all project-local config files found by searching
+// upwards from the working directory. The outermost file comes first.
+func projectConfigPaths() []string {
+	dir, err := os.Getwd()
+	if err != nil {
+		return nil
+	}
+	var paths []string
+	for {
+		p := filepath.Join(dir, ProjectConfigFileName)
+		if fi, err := os.Stat(p); err == nil && !fi.IsDir() {
+			paths = append([]string{p}, paths...)
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return paths
+		}
+		dir = parent
+	}
+}
+
+// readConfig reads a single config file. A file that does not exist
+// results in an empty config.
+func readConfig(path string) (*Config, error) {
+	c := &Config{}
+
+	// Try to open the file
+	f, err := os.Open(path)
+	if err != nil {
+
+		// If it does not exist return an empty config
+		if os.IsNotExist(err) {
+			return c, nil
+		}
+
+		return nil, err
+	}
+	defer f.Close()
+
+	// Read the file and unmarshal it
+	if err = toml.NewDecoder(f).Decode(c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// loadConfigs reads all config files and merges them in the order legacy
+// home file, $XDG_CONFIG_HOME/rfm/config.toml, $RFM_CONFIG and finally all
+// project-local .rfm.toml files from the outermost to the innermost.
+// It returns the merged config and in case of an error also an error instance.
 func loadConfigs() (*Config, error) {
 	var err error
 	load.Do(func() {
 		mu.Lock()
 		defer mu.Unlock()
 
-		// Get the user's home dir
-		var h string
-		h, err = homedir.Dir()
+		var paths []string
+		paths, userConfPath, err = userConfigPaths()
 		if err != nil {
 			return
 		}
+		paths = append(paths, projectConfigPaths()...)
 
-		// Try to open the file
-		f, err := os.Open(filepath.Join(h, ConfigFileName))
-		if err != nil {
-
-			// If it does not exist return an empty config
-			if os.IsNotExist(err) {
-				err = nil
+		for _, p := range paths {
+			var c *Config
+			c, err = readConfig(p)
+			if err != nil {
 				return
 			}
-
-			return
+			conf.merge(c)
+			if p == userConfPath {
+				userConf = c
+				if userConf.Devices == nil {
+					userConf.Devices = make(map[string]Device)
+				}
+			}
 		}
-		defer f.Close()
-
-		// Read the file and unmarshal it
-		err = toml.NewDecoder(f).Decode(conf)
 	})
-	if conf.Devices == nil {
-		conf.Devices = make(map[string]device)
-	}
 	return conf, err
 }
 
@@ -98,34 +293,62 @@ func AddConfig(deviceName string, domain string, port uint64, password string) {
 	loadConfigs()
 	mu.Lock()
 	defer mu.Unlock()
-	d := device{
+	d := Device{
 		Domain:   domain,
 		Port:     port,
 		Password: password,
 		Excludes: make(map[string]Excludes),
 	}
 	conf.Devices[deviceName] = d
+	userConf.Devices[deviceName] = d
 }
 
-// SaveConfigs writes all known configurations to the config file
+// UpdateDevice applies the given function to the merged config of the given
+// device. If the function sets anything it is also applied to the entry of the
+// device in the user's config file so the change will be persisted on the next
+// call to SaveConfigs. Devices only configured in other files are not copied
+// into the user's config otherwise.
+func UpdateDevice(deviceName string, update func(d *Device)) {
+	loadConfigs()
+	mu.Lock()
+	defer mu.Unlock()
+
+	// Find out whether update changes anything by applying it to an empty device
+	changes := Device{Excludes: make(map[string]Excludes)}
+	update(&changes)
+	configs := []*Config{conf}
+	if !reflect.DeepEqual(changes, Device{Excludes: make(map[string]Excludes)}) {
+		configs = append(configs, userConf)
+	}
+	for _, c := range configs {
+		d := c.Devices[deviceName]
+		if d.Excludes == nil {
+			d.Excludes = make(map[string]Excludes)
+		}
+		update(&d)
+		c.Devices[deviceName] = d
+	}
+}
+
+// SaveConfigs writes the user's configuration to the config file
 func SaveConfigs() error {
+	loadConfigs()
 	mu.Lock()
 	defer mu.Unlock()
 
 	// Marshal the config
-	bytes, err := toml.Marshal(conf)
+	bytes, err := toml.Marshal(userConf)
 	if err != nil {
 		return err
 	}
 
-	// Get the user's home directory
-	h, err := homedir.Dir()
-	if err != nil {
+	dir := filepath.Dir(userConfPath)
+	if err = os.MkdirAll(dir, 0755); err != nil {
 		return err
 	}
 
 	// Create a temporary file to not kill current contents in case of error
-	f, err := os.CreateTemp(h, ConfigFileName)
+	f, err := os.CreateTemp(dir, filepath.Base(userConfPath))
 	if err != nil {
 		return err
 	}
@@ -140,5 +363,5 @@ func SaveConfigs() error {
 	f.Close()
 
 	// If we get here rename the temporary file to the real name
-	return os.Rename(f.Name(), filepath.Join(h, ConfigFileName))
+	return os.Rename(f.Name(), userConfPath)
 }
@@ -0,0 +1,159 @@
+package rfm
+
+import (
+	"testing"
+
+	"github.com/pelletier/go-toml"
+)
+
+// useConfigs replaces the loaded configs for the duration of a test
+func useConfigs(t *testing.T, merged, user *Config) {
+	t.Helper()
+
+	// Make sure no config files are read anymore
+	load.Do(func() {})
+	oldConf, oldUserConf := conf, userConf
+	conf, userConf = merged, user
+	t.Cleanup(func() {
+		conf, userConf = oldConf, oldUserConf
+	})
+}
+
+func TestUpdateDevice(t *testing.T) {
+	tests := []struct {
+		name       string
+		user       map[string]Device
+		update     func(d *Device)
+		wantDomain string
+		wantInUser bool
+	}{
+		{
+			name:       "no changes leave project device out of user config",
+			update:     func(d *Device) {},
+			wantDomain: "project.local",
+		},
+		{
+			name:       "changes are persisted",
+			update:     func(d *Device) { d.Domain = "changed.local" },
+			wantDomain: "changed.local",
+			wantInUser: true,
+		},
+		{
+			name:       "new excludes are persisted",
+			update:     func(d *Device) { d.Excludes["backup"] = Excludes{} },
+			wantDomain: "project.local",
+			wantInUser: true,
+		},
+		{
+			name:       "user device is kept",
+			user:       map[string]Device{"printer": {Domain: "user.local"}},
+			update:     func(d *Device) {},
+			wantDomain: "project.local",
+			wantInUser: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user := &Config{Devices: make(map[string]Device)}
+			for name, d := range tt.user {
+				user.Devices[name] = d
+			}
+			merged := &Config{Devices: map[string]Device{"printer": {Domain: "project.local"}}}
+			useConfigs(t, merged, user)
+
+			UpdateDevice("printer", tt.update)
+			if d := GetDevice("printer"); d.Domain != tt.wantDomain {
+				t.Errorf("merged Domain = %q, want %q", d.Domain, tt.wantDomain)
+			}
+			if _, ok := userConf.Devices["printer"]; ok != tt.wantInUser {
+				t.Errorf("device in user config = %v, want %v", ok, tt.wantInUser)
+			}
+		})
+	}
+}
+
+func TestConfigMerge(t *testing.T) {
+	c := &Config{Devices: map[string]Device{"a": {Domain: "a.local", Port: 8080}}}
+	c.merge(&Config{
+		Device: "b",
+		Devices: map[string]Device{
+			"a": {Password: "secret"},
+			"b": {Domain: "b.local"},
+		},
+	})
+	if c.Device != "b" {
+		t.Errorf("Device = %q, want b", c.Device)
+	}
+	if a := c.Devices["a"]; a.Domain != "a.local" || a.Port != 8080 || a.Password != "secret" {
+		t.Errorf("merged device a = %+v", a)
+	}
+	if b := c.Devices["b"]; b.Domain != "b.local" {
+		t.Errorf("merged device b = %+v", b)
+	}
+}
+
+func TestDeviceMerge(t *testing.T) {
+	on, off := true, false
+	d := Device{
+		Domain:    "printer.local",
+		Port:      80,
+		Trash:     &on,
+		Protected: []string{"0:/sys/config.g"},
+		Vars:      map[string]interface{}{"a": 1, "b": 2},
+		Excludes:  map[string]Excludes{"backup": {Excls: []string{"*.bak"}}},
+	}
+	d.merge(Device{
+		Port:     8080,
+		Trash:    &off,
+		Vars:     map[string]interface{}{"b": 3},
+		Excludes: map[string]Excludes{"upload": {Excls: []string{"*.tmp"}}},
+	})
+	if d.Domain != "printer.local" || d.Port != 8080 {
+		t.Errorf("Domain, Port = %q, %d", d.Domain, d.Port)
+	}
+	if d.TrashEnabled() {
+		t.Error("trash not switched off")
+	}
+	if len(d.Protected) != 1 {
+		t.Errorf("Protected = %q", d.Protected)
+	}
+	if d.Vars["a"] != 1 || d.Vars["b"] != 3 {
+		t.Errorf("Vars = %v", d.Vars)
+	}
+	if len(d.Excludes) != 2 {
+		t.Errorf("Excludes = %v", d.Excludes)
+	}
+
+	// Unset values do not change anything
+	d.merge(Device{})
+	if d.Trash == nil || d.Port != 8080 {
+		t.Errorf("empty merge changed the device: %+v", d)
+	}
+
+	var empty Device
+	empty.merge(Device{Trash: &on})
+	if !empty.TrashEnabled() {
+		t.Error("trash not switched on")
+	}
+}
+
+func TestTrashRoundTrip(t *testing.T) {
+	off := false
+	content, err := toml.Marshal(&Config{Devices: map[string]Device{
+		"off":   {Domain: "off.local", Trash: &off},
+		"unset": {Domain: "unset.local"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var c Config
+	if err = toml.Unmarshal(content, &c); err != nil {
+		t.Fatal(err)
+	}
+	if tr := c.Devices["off"].Trash; tr == nil || *tr {
+		t.Errorf("trash = false was not kept:\n%s", content)
+	}
+	if c.Devices["unset"].Trash != nil {
+		t.Errorf("unset trash was written:\n%s", content)
+	}
+}
@@ -1,14 +1,48 @@
 package rfm
 
-import "strings"
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+)
 
 const (
 	resetKeyword = "reset"
+	// IgnoreFileName is the name of the file in a local root that holds
+	// additional exclude patterns
+	IgnoreFileName = ".rfmignore"
+	negationPrefix = "!"
 )
 
-/// Excludes contains simple starts-with patterns for upload/download excludes
+// Excludes contains gitignore-style patterns for upload/download excludes.
+// Patterns are matched against slash-separated paths relative to the root
+// of the transfer:
+//   - "*" and "?" match anything but a slash, "[...]" matches a character class
+//   - "**" matches across directories, e.g. "**/tmp/" or "macros/**"
+//   - a pattern containing a slash at the beginning or in the middle is anchored
+//     at the root, all others match at any level
+//   - a trailing slash only matches directories
+//   - a leading "!" re-includes paths excluded by an earlier pattern
+//
+// The last matching pattern wins and contents of excluded directories are
+// always excluded.
 type Excludes struct {
-	Excls []string
+	Excls    []string
+	patterns []pattern
+
+	// compiled is the copy of Excls that patterns was built from
+	compiled []string
+}
+
+type pattern struct {
+	re      *regexp.Regexp
+	negate  bool
+	dirOnly bool
 }
 
 func (e *Excludes) String() string {
@@ -18,24 +52,206 @@ func (e *Excludes) String() string {
 func (e *Excludes) Set(value string) error {
 	if value == resetKeyword {
 		e.Excls = make([]string, 0)
+		return nil
+	}
+	if _, err := compilePattern(value); err != nil {
+		return err
 	}
 	e.Excls = append(e.Excls, value)
 	return nil
 }
 
-// ForEach performs the given function on all entries
-func (e *Excludes) ForEach(f func(string) string) {
-	for i := 0; i < len(e.Excls); i++ {
-		e.Excls[i] = f(e.Excls[i])
+// includes adds negated patterns to Excludes
+type includes struct {
+	e *Excludes
+}
+
+func (i includes) String() string {
+	if i.e == nil {
+		return ""
 	}
+	return i.e.String()
+}
+
+func (i includes) Set(value string) error {
+	return i.e.Set(negationPrefix + strings.TrimPrefix(value, negationPrefix))
 }
 
-// Contains checks if the given path starts with any of the known excludes
-func (e *Excludes) Contains(path string) bool {
+// Includes returns a flag.Value that adds re-include patterns
+func (e *Excludes) Includes() flag.Value {
+	return includes{e: e}
+}
+
+// ForEach performs the given function on all entries. Entries for
+// which the function returns an empty string are removed.
+func (e *Excludes) ForEach(f func(string) string) {
+	excls := make([]string, 0, len(e.Excls))
 	for _, excl := range e.Excls {
-		if strings.HasPrefix(path, excl) {
+		if excl = f(excl); excl != "" {
+			excls = append(excls, excl)
+		}
+	}
+	e.Excls = excls
+}
+
+// Rebase converts legacy patterns that denote an absolute path below root into
+// patterns anchored at root. All other patterns are kept as they are, so e.g.
+// "/build/" stays a pattern anchored at root.
+func (e *Excludes) Rebase(root string) {
+	root = strings.TrimSuffix(filepath.ToSlash(root), "/")
+	e.ForEach(func(excl string) string {
+		slashed := filepath.ToSlash(excl)
+		if slashed == root {
+			return "/**"
+		}
+		if !strings.HasPrefix(slashed, root+"/") {
+			return excl
+		}
+		return strings.TrimPrefix(slashed, root)
+	})
+}
+
+// LoadIgnoreFile prepends the patterns found in the IgnoreFileName file in
+// the given directory. A missing file is not an error.
+func (e *Excludes) LoadIgnoreFile(dir string) error {
+	f, err := os.Open(filepath.Join(dir, IgnoreFileName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	var lines []string
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if _, err := compilePattern(line); err != nil {
+			return fmt.Errorf("%s: %w", f.Name(), err)
+		}
+		lines = append(lines, line)
+	}
+	if err = s.Err(); err != nil {
+		return err
+	}
+
+	// Always create a new slice to not modify the configured patterns
+	e.Excls = append(lines, e.Excls...)
+	return nil
+}
+
+// Excluded checks if the given slash-separated path relative to the root of the
+// transfer is excluded, either by itself or by one of its parent directories
+func (e *Excludes) Excluded(path string, isDir bool) bool {
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return false
+	}
+	if !slices.Equal(e.compiled, e.Excls) {
+		e.compile()
+	}
+	parts := strings.Split(path, "/")
+	for i := 1; i < len(parts); i++ {
+		if e.match(strings.Join(parts[:i], "/"), true) {
 			return true
 		}
 	}
-	return false
+	return e.match(path, isDir)
+}
+
+func (e *Excludes) match(path string, isDir bool) bool {
+	excluded := false
+	for _, p := range e.patterns {
+		if p.re == nil || (p.dirOnly && !isDir) {
+			continue
+		}
+		if p.re.MatchString(path) {
+			excluded = !p.negate
+		}
+	}
+	return excluded
+}
+
+func (e *Excludes) compile() {
+	e.patterns = make([]pattern, len(e.Excls))
+	for i, excl := range e.Excls {
+		// Invalid patterns have been rejected by Set already
+		p, _ := compilePattern(excl)
+		e.patterns[i] = p
+	}
+	e.compiled = slices.Clone(e.Excls)
+}
+
+// compilePattern translates a single gitignore-style pattern into a regular expression
+func compilePattern(excl string) (pattern, error) {
+	var p pattern
+	if strings.HasPrefix(excl, negationPrefix) {
+		p.negate = true
+		excl = strings.TrimPrefix(excl, negationPrefix)
+	}
+	if strings.HasSuffix(excl, "/") {
+		p.dirOnly = true
+		excl = strings.TrimRight(excl, "/")
+	}
+	anchored := strings.Contains(excl, "/")
+	excl = strings.TrimPrefix(excl, "/")
+
+	var b strings.Builder
+	b.WriteString("^")
+	if !anchored {
+		b.WriteString("(?:.*/)?")
+	}
+	for i := 0; i < len(excl); i++ {
+		c := excl[i]
+		switch c {
+		case '*':
+			if strings.HasPrefix(excl[i:], "**") {
+				switch {
+				case (i == 0 || excl[i-1] == '/') && strings.HasPrefix(excl[i:], "**/"):
+					// Zero or more leading directories
+					b.WriteString("(?:.*/)?")
+					i += 2
+				default:
+					b.WriteString(".*")
+					i++
+				}
+				continue
+			}
+			b.WriteString("[^/]*")
+		case '?':
+			b.WriteString("[^/]")
+		case '[':
+			end := strings.IndexByte(excl[i+1:], ']')
+			if end < 0 {
+				b.WriteString(regexp.QuoteMeta(string(c)))
+				continue
+			}
+			class := excl[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+			i += end + 1
+		case '\\':
+			if i+1 < len(excl) {
+				i++
+				c = excl[i]
+			}
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+
+	re, err := regexp.Compile(b.String())
+	if err != nil {
+		return p, fmt.Errorf("invalid pattern %q: %w", excl, err)
+	}
+	p.re = re
+	return p, nil
 }
@@ -0,0 +1,173 @@
+package rfm
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestExcluded(t *testing.T) {
+	tests := []struct {
+		name     string
+		patterns []string
+		path     string
+		isDir    bool
+		want     bool
+	}{
+		{"no patterns", nil, "sys/config.g", false, false},
+		{"plain name at root", []string{"config.g"}, "config.g", false, true},
+		{"plain name at any level", []string{"config.g"}, "sys/config.g", false, true},
+		{"plain name is not a prefix", []string{"config"}, "config.g", false, false},
+		{"leading slash anchors", []string{"/config.g"}, "sys/config.g", false, false},
+		{"leading slash matches at root", []string{"/config.g"}, "config.g", false, true},
+		{"inner slash anchors", []string{"sys/config.g"}, "www/sys/config.g", false, false},
+		{"inner slash matches at root", []string{"sys/config.g"}, "sys/config.g", false, true},
+		{"star stays in one directory", []string{"/sys/*.g"}, "sys/sub/config.g", false, false},
+		{"star matches name", []string{"*.bak"}, "macros/old.bak", false, true},
+		{"question mark", []string{"config?.g"}, "config1.g", false, true},
+		{"character class", []string{"config[0-9].g"}, "configx.g", false, false},
+		{"negated character class", []string{"config[!0-9].g"}, "configx.g", false, true},
+		{"escaped star", []string{`\*.g`}, "a.g", false, false},
+		{"leading double star", []string{"**/tmp"}, "a/b/tmp", true, true},
+		{"leading double star at root", []string{"**/tmp"}, "tmp", true, true},
+		{"trailing double star", []string{"macros/**"}, "macros/a/b.g", false, true},
+		{"trailing double star needs contents", []string{"macros/**"}, "macros", true, false},
+		{"inner double star", []string{"a/**/b"}, "a/x/y/b", false, true},
+		{"inner double star matches nothing", []string{"a/**/b"}, "a/b", false, true},
+		{"dir-only matches directory", []string{"tmp/"}, "tmp", true, true},
+		{"dir-only skips file", []string{"tmp/"}, "tmp", false, false},
+		{"dir-only excludes contents", []string{"tmp/"}, "tmp/a.g", false, true},
+		{"excluded parent", []string{"/sys"}, "sys/config.g", false, true},
+		{"negation re-includes", []string{"*.g", "!config.g"}, "sys/config.g", false, false},
+		{"last match wins", []string{"!config.g", "*.g"}, "sys/config.g", false, true},
+		{"negation cannot re-include below excluded dir", []string{"/sys", "!/sys/config.g"}, "sys/config.g", false, true},
+		{"surrounding slashes of path", []string{"/sys/config.g"}, "/sys/config.g/", false, true},
+		{"empty path", []string{"**"}, "", true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var e Excludes
+			for _, p := range tt.patterns {
+				if err := e.Set(p); err != nil {
+					t.Fatalf("Set(%q): %v", p, err)
+				}
+			}
+			if got := e.Excluded(tt.path, tt.isDir); got != tt.want {
+				t.Errorf("Excluded(%q, %v) with %q = %v, want %v", tt.path, tt.isDir, tt.patterns, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExcludedRecompiles(t *testing.T) {
+	var e Excludes
+	e.Set("*.g")
+	if !e.Excluded("config.g", false) {
+		t.Fatal("config.g not excluded by *.g")
+	}
+
+	// Same number of patterns but a different one
+	e.Excls[0] = "*.bak"
+	if e.Excluded("config.g", false) {
+		t.Error("config.g still excluded after replacing the pattern")
+	}
+	if !e.Excluded("config.bak", false) {
+		t.Error("config.bak not excluded after replacing the pattern")
+	}
+
+	e.ForEach(func(string) string { return "*.txt" })
+	if !e.Excluded("a.txt", false) || e.Excluded("config.bak", false) {
+		t.Error("ForEach did not replace the pattern")
+	}
+
+	e.Set(resetKeyword)
+	e.Set("!a.txt")
+	if e.Excluded("a.txt", false) {
+		t.Error("a.txt excluded after reset")
+	}
+}
+
+func TestSetRejectsInvalidPattern(t *testing.T) {
+	var e Excludes
+	if err := e.Set("a[z-a]"); err == nil {
+		t.Error("Set accepted an invalid character class")
+	}
+	if len(e.Excls) != 0 {
+		t.Errorf("invalid pattern was added: %q", e.Excls)
+	}
+}
+
+func TestIncludes(t *testing.T) {
+	var e Excludes
+	e.Set("*.g")
+	e.Includes().Set("config.g")
+	e.Includes().Set("!homeall.g")
+	want := []string{"*.g", "!config.g", "!homeall.g"}
+	if !slices.Equal(e.Excls, want) {
+		t.Errorf("Excls = %q, want %q", e.Excls, want)
+	}
+}
+
+func TestRebase(t *testing.T) {
+	root := filepath.FromSlash("/home/user/backup")
+	tests := []struct {
+		name    string
+		pattern string
+		want    []string
+	}{
+		{"relative pattern is kept", "*.bak", []string{"*.bak"}},
+		{"anchored pattern is kept", "sys/config.g", []string{"sys/config.g"}},
+		{"path below root", "/home/user/backup/sys/config.g", []string{"/sys/config.g"}},
+		{"root itself", "/home/user/backup", []string{"/**"}},
+		{"anchored directory pattern is kept", "/build/", []string{"/build/"}},
+		{"path outside root is kept", "/home/user/other", []string{"/home/user/other"}},
+		{"sibling with common prefix is kept", "/home/user/backup2/a", []string{"/home/user/backup2/a"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := Excludes{Excls: []string{tt.pattern}}
+			e.Rebase(root)
+			if !slices.Equal(e.Excls, tt.want) {
+				t.Errorf("Rebase(%q) = %q, want %q", tt.pattern, e.Excls, tt.want)
+			}
+		})
+	}
+}
+
+func TestRebaseKeepsAnchoredPatterns(t *testing.T) {
+	e := Excludes{Excls: []string{"/build/", "*.bak"}}
+	e.Rebase(filepath.FromSlash("/home/user/project"))
+	if !e.Excluded("build", true) || !e.Excluded("build/out.g", false) {
+		t.Error("build/ is not excluded")
+	}
+	if e.Excluded("sys/build", true) {
+		t.Error("anchored pattern matches below root")
+	}
+	if !e.Excluded("a.bak", false) {
+		t.Error("a.bak is not excluded")
+	}
+}
+
+func TestLoadIgnoreFile(t *testing.T) {
+	dir := t.TempDir()
+	content := "# comment\n\n*.bak\n!keep.bak\n"
+	if err := os.WriteFile(filepath.Join(dir, IgnoreFileName), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	e := Excludes{Excls: []string{"/sys/"}}
+	if err := e.LoadIgnoreFile(dir); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"*.bak", "!keep.bak", "/sys/"}
+	if !slices.Equal(e.Excls, want) {
+		t.Errorf("Excls = %q, want %q", e.Excls, want)
+	}
+	if !e.Excluded("a.bak", false) || e.Excluded("keep.bak", false) {
+		t.Error("patterns of the ignore file are not applied")
+	}
+
+	if err := e.LoadIgnoreFile(t.TempDir()); err != nil {
+		t.Errorf("missing ignore file: %v", err)
+	}
+}
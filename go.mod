@@ -7,4 +7,11 @@ require (
 	github.com/pelletier/go-toml v1.9.5
 )
 
-require github.com/wilriker/librfm/v2 v2.0.0
+require (
+	github.com/fsnotify/fsnotify v1.7.0
+	github.com/hanwen/go-fuse/v2 v2.5.1
+	github.com/wilriker/librfm/v2 v2.0.0
+	golang.org/x/net v0.25.0
+	golang.org/x/sys v0.20.0
+	golang.org/x/term v0.20.0
+)
@@ -0,0 +1,173 @@
+package rfm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	gcodeURL          = "%s/rr_gcode?%s"
+	replyURL          = "%s/rr_reply"
+	disconnectURL     = "%s/rr_disconnect"
+	replyPollInterval = 250 * time.Millisecond
+	// replyQuietTime is how long no further reply has to arrive before a
+	// reply is considered complete
+	replyQuietTime = 2 * replyPollInterval
+	// machineStatusBusy is the state of a device executing commands
+	// outside of a print
+	machineStatusBusy = "busy"
+)
+
+// ErrUnauthorized is returned if the device does not accept the session
+var ErrUnauthorized = errors.New("Not authorized")
+
+// Machine provides access to the G-code interface of RepRapFirmware.
+// It complements librfm.RRFFileManager which only handles files and
+// relies on the session established by it.
+type Machine struct {
+	httpClient *http.Client
+	baseURL    string
+	debug      bool
+
+	// mu serializes G-code requests so replies are not mixed up
+	mu sync.Mutex
+}
+
+// NewMachine creates a new Machine for the given device
+func NewMachine(domain string, port uint64, debug bool) *Machine {
+	tr := &http.Transport{DisableCompression: true}
+	return &Machine{
+		httpClient: &http.Client{Transport: tr},
+		baseURL:    fmt.Sprintf("http://%s:%d", domain, port),
+		debug:      debug,
+	}
+}
+
+func (m *Machine) doGetRequest(ctx context.Context, url string) ([]byte, error) {
+	if m.debug {
+		log.Printf("Doing GET request to %s", url)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := m.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if m.debug {
+		log.Printf("Received response %s\n%s", resp.Status, string(body))
+	}
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusUnauthorized {
+		return nil, fmt.Errorf("Request to %s failed: %w", url, ErrUnauthorized)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Request to %s failed: %s", url, resp.Status)
+	}
+	return body, nil
+}
+
+// Reply fetches the pending G-code reply. It returns an empty string if
+// there is none.
+func (m *Machine) Reply(ctx context.Context) (string, error) {
+	body, err := m.doGetRequest(ctx, fmt.Sprintf(replyURL, m.baseURL))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(body)), nil
+}
+
+// Disconnect ends the session with the device
+func (m *Machine) Disconnect(ctx context.Context) error {
+	_, err := m.doGetRequest(ctx, fmt.Sprintf(disconnectURL, m.baseURL))
+	return err
+}
+
+// isBusy checks whether the device is still executing commands. A device
+// whose state cannot be read is considered busy.
+func (m *Machine) isBusy(ctx context.Context) bool {
+	result, err := m.Model(ctx, "state.status", ModelFlagsDefault)
+	if err != nil {
+		return true
+	}
+	var status string
+	if err = json.Unmarshal(result, &status); err != nil {
+		return true
+	}
+	return status == machineStatusBusy
+}
+
+// SendGcode sends G-code to the device without waiting for a reply
+func (m *Machine) SendGcode(ctx context.Context, gcode string) error {
+	vals := url.Values{}
+	vals.Set("gcode", gcode)
+	_, err := m.doGetRequest(ctx, fmt.Sprintf(gcodeURL, m.baseURL, vals.Encode()))
+	return err
+}
+
+// Gcode sends G-code to the device and waits up to timeout for its reply.
+// Replies can arrive in several parts so polling continues until no more
+// parts arrived for a short time. Commands that do not reply return an empty
+// string as soon as the device is no longer busy executing them, at the
+// latest after timeout.
+func (m *Machine) Gcode(ctx context.Context, gcode string, timeout time.Duration) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Discard stale replies of earlier commands
+	if _, err := m.Reply(ctx); err != nil {
+		return "", err
+	}
+
+	if err := m.SendGcode(ctx, gcode); err != nil {
+		return "", err
+	}
+
+	var parts []string
+	var lastPart time.Time
+	sent := time.Now()
+	deadline := sent.Add(timeout)
+	for {
+		reply, err := m.Reply(ctx)
+		if err != nil {
+			return "", err
+		}
+		now := time.Now()
+		if reply != "" {
+			parts = append(parts, reply)
+			lastPart = now
+		}
+		if len(parts) > 0 && (now.Sub(lastPart) >= replyQuietTime || now.After(deadline)) {
+			return strings.Join(parts, "\n"), nil
+		}
+		if now.After(deadline) {
+			return "", nil
+		}
+
+		// Give the firmware time to pick up the command before deciding
+		// that it has no reply
+		if len(parts) == 0 && now.Sub(sent) >= replyQuietTime && !m.isBusy(ctx) {
+			return "", nil
+		}
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(replyPollInterval):
+		}
+	}
+}
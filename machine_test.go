@@ -0,0 +1,79 @@
+package rfm
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// replyServer simulates a device in the given state that delivers the reply
+// to each G-code in the given parts, one part per request of rr_reply
+func replyServer(t *testing.T, state string, parts ...string) *Machine {
+	t.Helper()
+	var mu sync.Mutex
+	var pending []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.URL.Path {
+		case "/rr_gcode":
+			pending = append(pending, parts...)
+			w.Write([]byte(`{"buff":200}`))
+		case "/rr_reply":
+			if len(pending) > 0 {
+				w.Write([]byte(pending[0]))
+				pending = pending[1:]
+			}
+		case "/rr_model":
+			w.Write([]byte(`{"key":"state.status","flags":"d99vn","result":"` + state + `"}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	host, port, _ := strings.Cut(strings.TrimPrefix(srv.URL, "http://"), ":")
+	p, err := strconv.ParseUint(port, 10, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewMachine(host, p, false)
+}
+
+func TestGcode(t *testing.T) {
+	tests := []struct {
+		name     string
+		state    string
+		parts    []string
+		want     string
+		wantWait bool
+	}{
+		{"no reply", "idle", nil, "", false},
+		{"no reply while busy", "busy", nil, "", true},
+		{"no reply during print", "processing", nil, "", false},
+		{"single reply", "idle", []string{"ok"}, "ok", false},
+		{"reply in parts", "idle", []string{"first", "second", "third"}, "first\nsecond\nthird", false},
+	}
+	const timeout = 3 * time.Second
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := replyServer(t, tt.state, tt.parts...)
+			start := time.Now()
+			reply, err := m.Gcode(context.Background(), "M122", timeout)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if reply != tt.want {
+				t.Errorf("Gcode() = %q, want %q", reply, tt.want)
+			}
+			if waited := time.Since(start) >= timeout; waited != tt.wantWait {
+				t.Errorf("Gcode() waited for the timeout = %v, want %v", waited, tt.wantWait)
+			}
+		})
+	}
+}
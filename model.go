@@ -0,0 +1,119 @@
+package rfm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	modelURL = "%s/rr_model?%s"
+	// dsfStatusURL is used by DuetSoftwareFramework versions without rr_model emulation
+	dsfStatusURL = "%s/machine/status"
+	// ModelFlagsDefault requests all verbose values up to maximum depth including nulls
+	ModelFlagsDefault = "d99vn"
+	// ModelFlagsFrequent requests only frequently changing values
+	ModelFlagsFrequent = "d99fn"
+)
+
+// ErrNoSuchKey is returned if a path does not exist in the object model
+var ErrNoSuchKey = errors.New("No such key in object model")
+
+var pathElementRegex = regexp.MustCompile(`^([^\[\]]*)((?:\[\d+\])*)$`)
+
+type modelResponse struct {
+	Key    string
+	Flags  string
+	Result json.RawMessage
+}
+
+// Model fetches the subtree of the object model denoted by key. Key is a path of the
+// form "heat.heaters[0].current" or empty for the complete model. Flags are passed
+// on to the firmware, see ModelFlagsDefault and ModelFlagsFrequent.
+func (m *Machine) Model(ctx context.Context, key, flags string) (json.RawMessage, error) {
+
+	// The firmware only knows about dotted keys so array indices are resolved here
+	fwKey, rest := splitModelKey(key)
+	vals := url.Values{}
+	vals.Set("key", fwKey)
+	vals.Set("flags", flags)
+	body, err := m.doGetRequest(ctx, fmt.Sprintf(modelURL, m.baseURL, vals.Encode()))
+	if err != nil {
+
+		// Try DSF instead which only delivers the full model
+		body, dsfErr := m.doGetRequest(ctx, fmt.Sprintf(dsfStatusURL, m.baseURL))
+		if dsfErr != nil {
+			return nil, err
+		}
+		return LookupModelPath(body, key)
+	}
+
+	var resp modelResponse
+	if err = json.Unmarshal(body, &resp); err != nil {
+		return nil, err
+	}
+	if len(resp.Result) == 0 || string(resp.Result) == "null" {
+		return nil, fmt.Errorf("%w: %s", ErrNoSuchKey, key)
+	}
+	result, err := LookupModelPath(resp.Result, rest)
+	if errors.Is(err, ErrNoSuchKey) {
+
+		// Report the full key instead of only the part resolved here
+		return nil, fmt.Errorf("%w: %s", ErrNoSuchKey, key)
+	}
+	return result, err
+}
+
+// splitModelKey splits a key into the leading dotted part the firmware can
+// resolve and the remainder starting at the first array index
+func splitModelKey(key string) (string, string) {
+	i := strings.Index(key, "[")
+	if i < 0 {
+		return key, ""
+	}
+	return key[:i], key[i:]
+}
+
+// LookupModelPath resolves a path like "heaters[0].current" or "[1].name" in the
+// given JSON document. An empty path returns the whole document.
+func LookupModelPath(doc json.RawMessage, path string) (json.RawMessage, error) {
+	path = strings.TrimPrefix(path, ".")
+	if path == "" {
+		return doc, nil
+	}
+	current := doc
+	for _, element := range strings.Split(path, ".") {
+		parts := pathElementRegex.FindStringSubmatch(element)
+		if parts == nil {
+			return nil, fmt.Errorf("Invalid path element: %s", element)
+		}
+		if parts[1] != "" {
+			var obj map[string]json.RawMessage
+			if err := json.Unmarshal(current, &obj); err != nil {
+				return nil, fmt.Errorf("%w: %s", ErrNoSuchKey, path)
+			}
+			next, ok := obj[parts[1]]
+			if !ok {
+				return nil, fmt.Errorf("%w: %s", ErrNoSuchKey, path)
+			}
+			current = next
+		}
+		for _, index := range strings.Split(strings.Trim(parts[2], "[]"), "][") {
+			if index == "" {
+				continue
+			}
+			i, _ := strconv.Atoi(index)
+			var arr []json.RawMessage
+			if err := json.Unmarshal(current, &arr); err != nil || i >= len(arr) {
+				return nil, fmt.Errorf("%w: %s", ErrNoSuchKey, path)
+			}
+			current = arr[i]
+		}
+	}
+	return current, nil
+}
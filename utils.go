@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
 )
 
@@ -18,10 +19,11 @@ const (
 )
 
 var multiSlashRegex = regexp.MustCompile(`/{2,}`)
-var absRemotePath = regexp.MustCompile(`^[0-9]:/`)
+var absRemotePath = regexp.MustCompile(`^[0-9]+:(/|$)`)
 
-// CleanRemotePath will reduce multiple consecutive slashes into one and
-// then remove a trailing slash if any.
+// CleanRemotePath will prefix paths without volume with the default volume,
+// reduce multiple consecutive slashes into one and then remove a trailing
+// slash if any.
 func CleanRemotePath(path string) string {
 	cleanedPath := strings.TrimSpace(path)
 	if !absRemotePath.MatchString(cleanedPath) {
@@ -32,6 +34,21 @@ func CleanRemotePath(path string) string {
 	return cleanedPath
 }
 
+// IsAbsRemotePath checks whether the given path starts with a volume
+func IsAbsRemotePath(path string) bool {
+	return absRemotePath.MatchString(path)
+}
+
+// RemoteVolume returns the number of the volume of the given remote path
+func RemoteVolume(path string) uint64 {
+	i := strings.Index(path, ":")
+	if i < 0 || !IsAbsRemotePath(path) {
+		return 0
+	}
+	vol, _ := strconv.ParseUint(path[:i], 10, 64)
+	return vol
+}
+
 // GetAbsPath tries to make an absolute path from the given value
 // in case of an error it returns the original value unchanged.
 func GetAbsPath(path string) string {